@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/schmich/stash/crypt"
+	"github.com/schmich/stash/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// profileName selects a profile in ~/.stash instead of its default one.
+var profileName string
+
+// profile holds the settings a named profile overrides.
+type profile struct {
+	Backend         string            `json:"backend,omitempty"`
+	S3              *storage.S3Config `json:"s3,omitempty"`
+	Password        string            `json:"password,omitempty"`
+	PasswordCommand string            `json:"password_command,omitempty"`
+	To              []string          `json:"to,omitempty"`
+	Compression     string            `json:"compression,omitempty"`
+	Expire          string            `json:"expire,omitempty"`
+}
+
+// config is ~/.stash. Its own settings apply to every profile unless the
+// profile overrides them.
+type config struct {
+	profile
+	Profile    string              `json:"profile,omitempty"`
+	Profiles   map[string]*profile `json:"profiles,omitempty"`
+	Recipients map[string]string   `json:"recipients,omitempty"`
+}
+
+// settingNames are the settings of a profile, as config get and set name them.
+var settingNames = []string{"backend", "password", "password_command", "to", "compression", "expire"}
+
+func getConfigPath() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".stash"), nil
+}
+
+func loadConfig() (*config, error) {
+	stashPath, err := getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(stashPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &config{}, nil
+		}
+
+		return nil, err
+	}
+
+	var config config
+	if err = json.Unmarshal(content, &config); err != nil {
+		return nil, errors.Wrapf(err, "read %s", stashPath)
+	}
+
+	return &config, nil
+}
+
+func saveConfig(config *config) error {
+	stashPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(stashPath, append(content, '\n'), 0600)
+}
+
+// loadProfile returns the settings of the selected profile, or of the
+// config's default profile, falling back on the config's own settings.
+func loadProfile() (*profile, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	name := profileName
+	if name == "" {
+		name = config.Profile
+	}
+
+	settings := config.profile
+	if name == "" {
+		return &settings, nil
+	}
+
+	named, ok := config.Profiles[name]
+	if !ok {
+		stashPath, _ := getConfigPath()
+		return nil, fmt.Errorf("no profile \"%s\" in %s", name, stashPath)
+	}
+
+	log.Debugf("Using profile %s.", name)
+
+	// Settings that go together are overridden together.
+	if named.Backend != "" || named.S3 != nil {
+		settings.Backend, settings.S3 = named.Backend, named.S3
+	}
+
+	if named.Password != "" || named.PasswordCommand != "" {
+		settings.Password, settings.PasswordCommand = named.Password, named.PasswordCommand
+	}
+
+	if len(named.To) > 0 {
+		settings.To = named.To
+	}
+
+	if named.Compression != "" {
+		settings.Compression = named.Compression
+	}
+
+	if named.Expire != "" {
+		settings.Expire = named.Expire
+	}
+
+	return &settings, nil
+}
+
+func getConfigPassword() ([]byte, error) {
+	settings, err := loadProfile()
+	if err != nil {
+		return []byte{}, err
+	}
+
+	stashPath, _ := getConfigPath()
+	if settings.Password != "" {
+		log.Debugf("Using password in %s.", stashPath)
+		return []byte(settings.Password), nil
+	}
+
+	if settings.PasswordCommand != "" {
+		log.Debugf("Using password_command in %s.", stashPath)
+		return getCommandPassword(settings.PasswordCommand)
+	}
+
+	return nil, nil
+}
+
+func (settings *profile) get(name string) (string, error) {
+	switch name {
+	case "backend":
+		return settings.Backend, nil
+	case "password":
+		return settings.Password, nil
+	case "password_command":
+		return settings.PasswordCommand, nil
+	case "to":
+		return strings.Join(settings.To, ","), nil
+	case "compression":
+		return settings.Compression, nil
+	case "expire":
+		return settings.Expire, nil
+	}
+
+	return "", fmt.Errorf("unknown setting \"%s\", expected one of %s", name, strings.Join(settingNames, ", "))
+}
+
+// set changes a setting; an empty value removes it.
+func (settings *profile) set(name string, value string) error {
+	switch name {
+	case "backend":
+		if value != "" {
+			if _, err := storage.Open(value); err != nil {
+				return err
+			}
+		}
+
+		settings.Backend = value
+	case "password":
+		settings.Password = value
+	case "password_command":
+		settings.PasswordCommand = value
+	case "to":
+		settings.To = nil
+		for _, recipient := range strings.Split(value, ",") {
+			if recipient = strings.TrimSpace(recipient); recipient != "" {
+				settings.To = append(settings.To, recipient)
+			}
+		}
+	case "compression":
+		if value != "" && value != crypt.CompressionGzip && value != crypt.CompressionNone {
+			return fmt.Errorf("invalid compression \"%s\", expected gzip or none", value)
+		}
+
+		settings.Compression = value
+	case "expire":
+		if value != "" {
+			if _, err := parseExpire(value); err != nil {
+				return err
+			}
+		}
+
+		settings.Expire = value
+	default:
+		_, err := settings.get(name)
+		return err
+	}
+
+	return nil
+}
+
+// parseConfigKey splits a key of config get and set, such as "backend" or
+// "work.backend", into the profile it names, if any, and the setting. A key
+// without a profile refers to the one selected with --profile, if any.
+func parseConfigKey(key string) (string, string) {
+	if dot := strings.LastIndex(key, "."); dot >= 0 {
+		return key[:dot], key[dot+1:]
+	}
+
+	return profileName, key
+}
+
+func runConfigGet(key string) (string, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+
+	if key == "profile" {
+		return config.Profile, nil
+	}
+
+	name, setting := parseConfigKey(key)
+	settings := &config.profile
+	if name != "" {
+		if settings = config.Profiles[name]; settings == nil {
+			return "", fmt.Errorf("no profile \"%s\"", name)
+		}
+	}
+
+	return settings.get(setting)
+}
+
+func runConfigSet(key string, value string) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if key == "profile" {
+		if _, ok := config.Profiles[value]; value != "" && !ok {
+			return fmt.Errorf("no profile \"%s\"", value)
+		}
+
+		config.Profile = value
+		return saveConfig(config)
+	}
+
+	name, setting := parseConfigKey(key)
+	settings := &config.profile
+	if name != "" {
+		if config.Profiles == nil {
+			config.Profiles = make(map[string]*profile)
+		}
+
+		if settings = config.Profiles[name]; settings == nil {
+			settings = &profile{}
+			config.Profiles[name] = settings
+		}
+	}
+
+	if err := settings.set(setting, value); err != nil {
+		return err
+	}
+
+	// A profile left without settings is removed.
+	if name != "" && isEmptyProfile(settings) {
+		delete(config.Profiles, name)
+		if config.Profile == name {
+			config.Profile = ""
+		}
+	}
+
+	return saveConfig(config)
+}
+
+func isEmptyProfile(settings *profile) bool {
+	return settings.S3 == nil && len(settings.To) == 0 && settings.Backend == "" && settings.Password == "" &&
+		settings.PasswordCommand == "" && settings.Compression == "" && settings.Expire == ""
+}
+
+// runConfigList returns every setting in ~/.stash as "key = value", with
+// passwords hidden.
+func runConfigList() ([]string, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	list := func(prefix string, settings *profile) {
+		for _, setting := range settingNames {
+			value, _ := settings.get(setting)
+			if value == "" {
+				continue
+			}
+
+			if setting == "password" {
+				value = "********"
+			}
+
+			lines = append(lines, fmt.Sprintf("%s%s = %s", prefix, setting, value))
+		}
+
+		if settings.S3 != nil {
+			lines = append(lines, fmt.Sprintf("%ss3 = %s/%s%s", prefix, settings.S3.Endpoint, settings.S3.Bucket, settings.S3.Prefix))
+		}
+	}
+
+	if config.Profile != "" {
+		lines = append(lines, "profile = "+config.Profile)
+	}
+
+	list("", &config.profile)
+
+	var names []string
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		list(name+".", config.Profiles[name])
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+// ownedStash is a stash copied here, with the owner token that lets its
+// uploader replace or delete it, or change its expiry.
+type ownedStash struct {
+	ID    string
+	Token string
+}
+
+// historyEntry records an owned stash in ~/.stash-history.
+type historyEntry struct {
+	ID      string    `json:"id"`
+	Token   string    `json:"token"`
+	Backend string    `json:"backend"`
+	Created time.Time `json:"created"`
+}
+
+func getHistoryPath() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".stash-history"), nil
+}
+
+func loadHistory() ([]*historyEntry, error) {
+	path, err := getHistoryPath()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var history []*historyEntry
+	if err := json.Unmarshal(content, &history); err != nil {
+		return nil, errors.Wrapf(err, "read %s", path)
+	}
+
+	return history, nil
+}
+
+// saveHistory keeps the tokens readable only by the user, as they grant
+// control of the stashes.
+func saveHistory(history []*historyEntry) error {
+	path, err := getHistoryPath()
+	if err != nil {
+		return err
+	}
+
+	if len(history) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	content, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+func recordStashes(backend string, stashes []ownedStash) error {
+	history, err := loadHistory()
+	if err != nil {
+		return err
+	}
+
+	for _, stash := range stashes {
+		history = append(history, &historyEntry{ID: stash.ID, Token: stash.Token, Backend: backend, Created: time.Now()})
+	}
+
+	return saveHistory(history)
+}
+
+func forgetStash(backend, id string) error {
+	history, err := loadHistory()
+	if err != nil {
+		return err
+	}
+
+	var kept []*historyEntry
+	for _, entry := range history {
+		if entry.Backend != backend || entry.ID != id {
+			kept = append(kept, entry)
+		}
+	}
+
+	return saveHistory(kept)
+}
+
+// findToken returns the owner token of the stash with id, token if given, or
+// else the one recorded when it was copied to backend.
+func findToken(backend, id, token string) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+
+	history, err := loadHistory()
+	if err != nil {
+		return "", err
+	}
+
+	// The latest copy wins should an ID be reused.
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Backend == backend && history[i].ID == id {
+			return history[i].Token, nil
+		}
+	}
+
+	return "", fmt.Errorf("no owner token for stash %s in ~/.stash-history, use --token", id)
+}
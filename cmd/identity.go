@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/schmich/stash/crypt"
+	log "github.com/sirupsen/logrus"
+)
+
+func getIdentityPath() (string, error) {
+	if path := os.Getenv("STASH_IDENTITY"); path != "" {
+		return path, nil
+	}
+
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".stash-identity"), nil
+}
+
+func getSigningKeyPath() (string, error) {
+	if path := os.Getenv("STASH_SIGNING_KEY"); path != "" {
+		return path, nil
+	}
+
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".stash-signing-key"), nil
+}
+
+func getTrustedKeysPath() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".stash-trusted-keys"), nil
+}
+
+func loadIdentities() ([]*crypt.Identity, error) {
+	identityPath, err := getIdentityPath()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(identityPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	identities, err := crypt.ParseIdentities(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", identityPath)
+	}
+
+	log.Debugf("Using identity in %s.", identityPath)
+	return identities, nil
+}
+
+func loadSigningKey() (*crypt.SigningKey, error) {
+	signingKeyPath, err := getSigningKeyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(signingKeyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no signing key in %s, create one with keygen --sign", signingKeyPath)
+		}
+
+		return nil, err
+	}
+
+	signingKey, err := crypt.ParseSigningKey(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", signingKeyPath)
+	}
+
+	log.Debugf("Using signing key in %s.", signingKeyPath)
+	return signingKey, nil
+}
+
+// loadTrustedKeys maps trusted signer keys to names. Each line of the
+// trusted keys file holds a key optionally followed by a name.
+func loadTrustedKeys() (map[string]string, error) {
+	trustedKeysPath, err := getTrustedKeysPath()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(trustedKeysPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]string{}, nil
+		}
+
+		return nil, err
+	}
+
+	trusted := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		signer, err := crypt.ParseSigner(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s", trustedKeysPath)
+		}
+
+		name := signer.String()
+		if len(fields) > 1 {
+			name = strings.Join(fields[1:], " ")
+		}
+
+		trusted[signer.String()] = name
+	}
+
+	return trusted, nil
+}
+
+// resolveRecipients parses public keys, looking up names that are not
+// public keys in the recipients section of the config.
+func resolveRecipients(names []string) ([]*crypt.Recipient, error) {
+	var config *config
+	var recipients []*crypt.Recipient
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, "age1") {
+			if config == nil {
+				var err error
+				if config, err = loadConfig(); err != nil {
+					return nil, err
+				}
+			}
+
+			alias, ok := config.Recipients[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown recipient \"%s\"", name)
+			}
+
+			log.Debugf("Recipient %s is %s.", name, alias)
+			name = alias
+		}
+
+		recipient, err := crypt.ParseRecipient(name)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients, nil
+}
+
+func writeKey(path string, force bool, content string) error {
+	if !force {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("key already exists in %s, use --force to replace it", path)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		return err
+	}
+
+	log.Debugf("Key written to %s.", path)
+	return nil
+}
+
+func runKeygen(force bool) error {
+	identityPath, err := getIdentityPath()
+	if err != nil {
+		return err
+	}
+
+	identity, err := crypt.GenerateIdentity()
+	if err != nil {
+		return err
+	}
+
+	recipient := identity.Recipient()
+	content := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), recipient, identity)
+	if err := writeKey(identityPath, force, content); err != nil {
+		return err
+	}
+
+	log.Infof("Public key: %s", recipient)
+	return nil
+}
+
+func runSigningKeygen(force bool) error {
+	signingKeyPath, err := getSigningKeyPath()
+	if err != nil {
+		return err
+	}
+
+	signingKey, err := crypt.GenerateSigningKey()
+	if err != nil {
+		return err
+	}
+
+	signer := signingKey.Signer()
+	content := fmt.Sprintf("# created: %s\n# signer key: %s\n%s\n", time.Now().Format(time.RFC3339), signer, signingKey)
+	if err := writeKey(signingKeyPath, force, content); err != nil {
+		return err
+	}
+
+	log.Infof("Signer key: %s", signer)
+	return nil
+}
+
+// checkSigner refuses stashes that are unsigned or signed by untrusted keys
+// when requireSigned is set. It returns the name to report for the signer.
+func checkSigner(header *crypt.Header, requireSigned bool) (string, error) {
+	var signer *crypt.Signer
+	if header != nil {
+		signer = header.SignedBy()
+	}
+
+	if signer == nil {
+		if requireSigned {
+			return "", errors.New("stash is not signed")
+		}
+
+		return "", nil
+	}
+
+	trusted, err := loadTrustedKeys()
+	if err != nil {
+		return "", err
+	}
+
+	name, ok := trusted[signer.String()]
+	if !ok {
+		if requireSigned {
+			return "", fmt.Errorf("stash is signed by untrusted key %s", signer)
+		}
+
+		return "", nil
+	}
+
+	return name, nil
+}
@@ -2,86 +2,107 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/howeyc/gopass"
 	cli "github.com/jawher/mow.cli"
 	"github.com/mattn/go-isatty"
-	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/schmich/stash/crypt"
+	"github.com/schmich/stash/identifier"
+	"github.com/schmich/stash/relay"
 	"github.com/schmich/stash/storage"
 	log "github.com/sirupsen/logrus"
 )
 
-func pack(paths []string, writer io.Writer) error {
-	archive := tar.NewWriter(writer)
+const maxPasswordAttempts = 3
 
-	packFile := func(path string) error {
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
+func isStdinTerminal() bool {
+	return isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd())
+}
 
-		defer file.Close()
+// entry is a file to be packed, or the contents of stdin.
+type entry struct {
+	name string
+	path string
+	info os.FileInfo
+	data []byte
+}
 
-		if _, err = io.Copy(archive, file); err != nil {
-			return err
-		}
+// readStdin reads stdin to the end, or until ctx is done, as a read from a
+// terminal cannot be interrupted.
+func readStdin(ctx context.Context) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
 
-		return nil
+	done := make(chan result, 1)
+	go func() {
+		data, err := ioutil.ReadAll(os.Stdin)
+		done <- result{data, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.data, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+}
+
+func collect(ctx context.Context, paths []string) ([]entry, error) {
+	var entries []entry
 
-	packStdin := func() error {
-		stdin, err := ioutil.ReadAll(os.Stdin)
+	collectStdin := func() error {
+		stdin, err := readStdin(ctx)
 		if err != nil {
 			return errors.Wrap(err, "create archive")
 		}
 
-		header := &tar.Header{Name: "$stdin", Size: int64(len(stdin))}
-		if err := archive.WriteHeader(header); err != nil {
-			return err
-		}
-
-		if _, err := archive.Write(stdin); err != nil {
-			return err
-		}
-
+		entries = append(entries, entry{name: "$stdin", data: stdin})
 		return nil
 	}
 
-	isTerminal := isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd())
+	isTerminal := isStdinTerminal()
 	if !isTerminal {
 		log.Debug("Copy from stdin.")
-		if err := packStdin(); err != nil {
-			return err
+		if err := collectStdin(); err != nil {
+			return nil, err
 		}
 	} else if len(paths) == 0 {
 		log.Info("Copy from stdin (^D when done).")
-		if err := packStdin(); err != nil {
-			return err
+		if err := collectStdin(); err != nil {
+			return nil, err
 		}
 	}
 
 	for _, path := range paths {
 		if path == "-" && isTerminal {
 			log.Info("Copy from stdin (^D when done).")
-			if err := packStdin(); err != nil {
-				return err
+			if err := collectStdin(); err != nil {
+				return nil, err
 			}
 			continue
 		}
 
 		absname, err := filepath.Abs(path)
 		if err != nil {
-			return errors.Wrap(err, "create archive")
+			return nil, errors.Wrap(err, "create archive")
 		}
 
 		basename := filepath.Base(absname)
@@ -102,25 +123,71 @@ func pack(paths []string, writer io.Writer) error {
 				return err
 			}
 
-			archivePath := filepath.Join(basename, rel)
-			header, err := tar.FileInfoHeader(info, info.Name())
-			header.Name = archivePath
+			entries = append(entries, entry{name: filepath.Join(basename, rel), path: file, info: info})
+			return nil
+		})
 
-			if err = archive.WriteHeader(header); err != nil {
-				return err
-			}
+		if err != nil {
+			return nil, errors.Wrap(err, "create archive")
+		}
+	}
 
-			log.Debugf("Copy %s.", archivePath)
-			if err = packFile(file); err != nil {
-				return err
-			}
+	return entries, nil
+}
 
-			return nil
-		})
+func pack(entries []entry, writer io.Writer) error {
+	archive := tar.NewWriter(writer)
+
+	packFile := func(path string) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		if _, err = io.Copy(archive, file); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	packStdin := func(stdin []byte) error {
+		header := &tar.Header{Name: "$stdin", Size: int64(len(stdin))}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := archive.Write(stdin); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	for _, entry := range entries {
+		if entry.path == "" {
+			if err := packStdin(entry.data); err != nil {
+				return errors.Wrap(err, "create archive")
+			}
+			continue
+		}
 
+		header, err := tar.FileInfoHeader(entry.info, entry.info.Name())
 		if err != nil {
 			return errors.Wrap(err, "create archive")
 		}
+
+		header.Name = entry.name
+		if err = archive.WriteHeader(header); err != nil {
+			return errors.Wrap(err, "create archive")
+		}
+
+		log.Debugf("Copy %s.", entry.name)
+		if err = packFile(entry.path); err != nil {
+			return errors.Wrap(err, "create archive")
+		}
 	}
 
 	if err := archive.Close(); err != nil {
@@ -130,7 +197,49 @@ func pack(paths []string, writer io.Writer) error {
 	return nil
 }
 
-func unpack(reader io.Reader) error {
+// unpacked is what unpack created, which a failed paste removes.
+type unpacked struct {
+	files       []string
+	directories []string
+}
+
+// mkdirAll creates directory and its missing parents, recording them.
+func (unpacked *unpacked) mkdirAll(directory string) error {
+	// The missing directories, deepest first.
+	var missing []string
+	for path := directory; path != filepath.Dir(path); path = filepath.Dir(path) {
+		if _, err := os.Lstat(path); err == nil {
+			break
+		}
+
+		missing = append(missing, path)
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return err
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		unpacked.directories = append(unpacked.directories, missing[i])
+	}
+
+	return nil
+}
+
+// remove deletes the files unpacked, then the directories created for them
+// that are left empty.
+func (unpacked *unpacked) remove() {
+	for _, file := range unpacked.files {
+		log.Debugf("Remove %s.", file)
+		os.Remove(file)
+	}
+
+	for i := len(unpacked.directories) - 1; i >= 0; i-- {
+		os.Remove(unpacked.directories[i])
+	}
+}
+
+func unpack(reader io.Reader, unpacked *unpacked) error {
 	archive := tar.NewReader(reader)
 
 	unpackFile := func(header *tar.Header) error {
@@ -139,6 +248,7 @@ func unpack(reader io.Reader) error {
 			return err
 		}
 
+		unpacked.files = append(unpacked.files, header.Name)
 		defer file.Close()
 
 		if _, err = io.Copy(file, archive); err != nil {
@@ -169,7 +279,7 @@ func unpack(reader io.Reader) error {
 		// TODO: Do not allow relative paths (resolve to something relative to pwd).
 
 		directory := filepath.Dir(header.Name)
-		if err = os.MkdirAll(directory, 0700); err != nil {
+		if err = unpacked.mkdirAll(directory); err != nil {
 			return err
 		}
 
@@ -180,19 +290,44 @@ func unpack(reader io.Reader) error {
 	}
 }
 
-func runCopy(client storage.Client, password []byte, paths []string) error {
-	// files -> pack -> compress -> encrypt -> encode/upload
+// prepareCopy collects the entries to copy and describes them in the
+// metadata of options.
+func prepareCopy(ctx context.Context, paths []string, message string, options *crypt.Options) ([]entry, error) {
+	entries, err := collect(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO: Limit upload size.
-	log.Debug("Upload.")
-	uploader := client.Upload()
-	encrypter := crypt.NewEncrypter(uploader, password)
-	compressor, err := gzip.NewWriterLevel(encrypter, gzip.BestCompression)
+	if options.Metadata, err = json.Marshal(newMetadata(entries, message)); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// writeEntries packs, compresses and encrypts entries to writer.
+func writeEntries(writer io.Writer, entries []entry, compression string, newEncrypter func(io.Writer) (io.WriteCloser, error)) error {
+	encrypter, err := newEncrypter(writer)
 	if err != nil {
 		return err
 	}
 
-	if err := pack(paths, compressor); err != nil {
+	var compressor io.WriteCloser = nopWriteCloser{encrypter}
+	if compression != crypt.CompressionNone {
+		if compressor, err = gzip.NewWriterLevel(encrypter, gzip.BestCompression); err != nil {
+			return err
+		}
+	}
+
+	if err := pack(entries, compressor); err != nil {
 		return err
 	}
 
@@ -200,30 +335,251 @@ func runCopy(client storage.Client, password []byte, paths []string) error {
 		return err
 	}
 
-	if err := encrypter.Close(); err != nil {
-		return err
+	return encrypter.Close()
+}
+
+// uploadEntries uploads entries as a new stash. Clients that support it
+// upload in resumable chunks; an interrupted upload is recorded under key,
+// if given, for a later copy to finish.
+func uploadEntries(ctx context.Context, client storage.Client, entries []entry, compression string, upload storage.UploadOptions, key *resumeKey, newEncrypter func(io.Writer) (io.WriteCloser, error)) (ownedStash, error) {
+	// TODO: Limit upload size.
+	if resumable, ok := client.(storage.ResumableClient); ok {
+		return uploadResumable(ctx, resumable, entries, compression, upload, key, newEncrypter)
+	}
+
+	// Cancelling the upload before closing it discards it.
+	log.Debug("Upload.")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	uploader := client.Upload(ctx, upload)
+	if err := writeEntries(uploader, entries, compression, newEncrypter); err != nil {
+		cancel()
+		uploader.Close()
+		return ownedStash{}, err
 	}
 
 	if err := uploader.Close(); err != nil {
-		return err
+		return ownedStash{}, err
+	}
+
+	return ownedStash{ID: uploader.GetID(), Token: uploader.GetToken()}, nil
+}
+
+// stashLimits are the limits a copy puts on its stash, if set.
+type stashLimits struct {
+	expire       time.Duration
+	maxDownloads int
+}
+
+// newUploadOptions returns the options of a stash copied now with limits.
+func newUploadOptions(limits stashLimits) storage.UploadOptions {
+	options := storage.UploadOptions{MaxDownloads: limits.maxDownloads}
+	if limits.expire > 0 {
+		options.Expires = time.Now().Add(limits.expire)
+	}
+
+	return options
+}
+
+// runCopy uploads paths as a new stash. Unless resume is false, e.g. for a
+// password that is not given again, an interrupted upload is recorded for
+// the same copy to finish later.
+func runCopy(ctx context.Context, client storage.Client, password []byte, options crypt.Options, limits stashLimits, paths []string, message string, resume bool) (ownedStash, error) {
+	// files -> pack -> compress -> encrypt -> encode/upload
+
+	entries, err := prepareCopy(ctx, paths, message, &options)
+	if err != nil {
+		return ownedStash{}, err
+	}
+
+	var key *resumeKey
+	if resume {
+		if key, err = newResumeKey(entries, message, limits, password, options); err != nil {
+			return ownedStash{}, err
+		}
+	}
+
+	return uploadEntries(ctx, client, entries, options.Compression, newUploadOptions(limits), key, func(writer io.Writer) (io.WriteCloser, error) {
+		return crypt.NewEncrypter(writer, password, options), nil
+	})
+}
+
+func decompress(reader io.Reader, compression string) (io.Reader, error) {
+	switch compression {
+	case crypt.CompressionGzip:
+		return gzip.NewReader(reader)
+	case crypt.CompressionNone:
+		return reader, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression \"%s\"", compression)
+	}
+}
+
+func logHeader(header *crypt.Header) {
+	if header.Format == crypt.FormatAge {
+		log.Debug("Stash format age v1.")
+	} else if header.KDF != nil {
+		log.Debugf("Stash format v%d: %s, %s, %s.", header.Version, header.Cipher, header.KDF.Name, header.Compression)
+	} else {
+		log.Debugf("Stash format v%d: %s, %d recipient(s), %s.", header.Version, header.Cipher, len(header.Recipients), header.Compression)
+	}
+}
+
+// unlock returns a decrypter for the stash, re-prompting for the password
+// when it is incorrect and stdin is interactive.
+func unlock(reader io.Reader, header *crypt.Header, password, keyFile []byte) (*crypt.Decrypter, error) {
+	for attempt := 1; ; attempt++ {
+		if header.KDF != nil && header.KDF.Name == crypt.KDFArgon2id {
+			log.Debugf("Derive key (%d MiB).", header.KDF.Memory/1024)
+		}
+
+		decrypter, err := crypt.NewDecrypter(reader, header, password, keyFile)
+		if err != crypt.ErrIncorrectPassword || attempt == maxPasswordAttempts || !isStdinTerminal() {
+			return decrypter, err
+		}
+
+		log.Info("Incorrect password, try again.")
+		if password, err = getInteractivePassword(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// openStash reads the stash header and unlocks the stash with an identity or
+// a password, as the header requires. Legacy stashes have a nil header.
+func openStash(reader io.Reader, getPassword func() ([]byte, error), keyFile []byte) (*crypt.Header, *crypt.Decrypter, error) {
+	header, reader, err := crypt.ReadHeader(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return unlockStash(header, reader, getPassword, keyFile)
+}
+
+// unlockStash unlocks the stash with header, whose payload is read from
+// reader.
+func unlockStash(header *crypt.Header, reader io.Reader, getPassword func() ([]byte, error), keyFile []byte) (*crypt.Header, *crypt.Decrypter, error) {
+	if header == nil {
+		log.Debug("Legacy stash format.")
+		password, err := getPassword()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nil, crypt.NewLegacyDecrypter(reader, password), nil
+	}
+
+	logHeader(header)
+	if header.Split != nil {
+		return nil, nil, fmt.Errorf("stash is split, paste %d of its %d share IDs together", header.Split.Threshold, header.Split.Shares)
+	}
+
+	if !header.PasswordProtected() {
+		identities, err := loadIdentities()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		decrypter, err := crypt.NewIdentityDecrypter(reader, header, identities)
+		return header, decrypter, err
+	}
+
+	if header.KeyFile && keyFile == nil {
+		return nil, nil, crypt.ErrKeyFileRequired
+	}
+
+	password, err := getPassword()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decrypter, err := unlock(reader, header, password, keyFile)
+	return header, decrypter, err
+}
+
+// checkUnlimited fails for a stash with a download limit, which reading it
+// for the named command would use up.
+func checkUnlimited(ctx context.Context, client storage.Client, ids []string, command string) error {
+	manager, ok := client.(storage.Manager)
+	if !ok {
+		return nil
+	}
+
+	for _, id := range ids {
+		info, err := manager.Stat(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if info.MaxDownloads > 0 {
+			return fmt.Errorf("stash %s has a download limit, which %s would use up", id, command)
+		}
 	}
 
-	log.Infof("Stash ID: %s", uploader.GetID())
 	return nil
 }
 
-func runPaste(client storage.Client, password []byte, id string) error {
-	// download/decode -> decrypt -> decompress -> unpack -> files
+// download opens the stash with a single ID, or the split stash that the
+// shares with several IDs belong to.
+func download(ctx context.Context, client storage.Client, ids []string, getPassword func() ([]byte, error), keyFile []byte) (*crypt.Header, *crypt.Decrypter, io.Closer, error) {
+	if len(ids) > 1 {
+		return openShares(ctx, client, ids, getPassword, keyFile)
+	}
 
 	log.Debug("Download.")
-	downloader := client.Download(id)
-	decrypter := crypt.NewDecrypter(downloader, password)
-	decompressor, err := gzip.NewReader(decrypter)
+	downloader := downloadStash(ctx, client, ids[0])
+	header, decrypter, err := openStash(downloader, getPassword, keyFile)
+	if err != nil {
+		downloader.Close()
+		return nil, nil, nil, err
+	}
+
+	if header != nil && header.Share {
+		downloader.Close()
+		return nil, nil, nil, errors.New("stash is a share of a split stash, paste it together with the other share IDs")
+	}
+
+	return header, decrypter, downloader, nil
+}
+
+// runPaste unpacks the stash into the current directory. Should it fail,
+// e.g. when interrupted, the files it unpacked are removed.
+func runPaste(ctx context.Context, client storage.Client, getPassword func() ([]byte, error), keyFile []byte, ids []string, requireSigned bool) error {
+	// download/decode -> decrypt -> decompress -> unpack -> files
+
+	header, decrypter, downloader, err := download(ctx, client, ids, getPassword, keyFile)
+	if err != nil {
+		return err
+	}
+
+	defer downloader.Close()
+
+	compression := crypt.CompressionGzip
+	if header != nil {
+		compression = header.Compression
+	}
+
+	signer, err := checkSigner(header, requireSigned)
+	if err != nil {
+		return err
+	}
+
+	decompressor, err := decompress(decrypter, compression)
 	if err != nil {
 		return err
 	}
 
-	if err := unpack(decompressor); err != nil {
+	var unpacked unpacked
+	if err := unpack(decompressor, &unpacked); err != nil {
+		unpacked.remove()
+		return err
+	}
+
+	// Read through to the end so the final segment and signature are
+	// authenticated.
+	if _, err := io.Copy(ioutil.Discard, decompressor); err != nil {
+		unpacked.remove()
 		return err
 	}
 
@@ -231,6 +587,12 @@ func runPaste(client storage.Client, password []byte, id string) error {
 		return err
 	}
 
+	if signer != "" {
+		log.Infof("Signed by %s.", signer)
+	} else if header != nil && header.SignedBy() != nil {
+		log.Warnf("Warning: signed by untrusted key %s.", header.SignedBy())
+	}
+
 	return nil
 }
 
@@ -243,36 +605,100 @@ func getEnvPassword() []byte {
 	return nil
 }
 
-func getConfigPassword() ([]byte, error) {
-	homeDir, err := homedir.Dir()
+// getCommandPassword runs command with the shell and uses the first line of
+// its output as the password.
+func getCommandPassword(command string) ([]byte, error) {
+	shell := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		shell = exec.Command("cmd", "/C", command)
+	}
+
+	shell.Stdin = os.Stdin
+	shell.Stderr = os.Stderr
+	output, err := shell.Output()
 	if err != nil {
-		return []byte{}, err
+		return nil, errors.Wrap(err, "password_command")
+	}
+
+	password := firstLine(output)
+	if len(password) == 0 {
+		return nil, errors.New("password_command: no password in output")
 	}
 
-	stashPath := filepath.Join(homeDir, ".stash")
-	content, err := ioutil.ReadFile(stashPath)
+	return password, nil
+}
+
+func getFilePassword(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
+		return nil, err
+	}
+
+	password := firstLine(content)
+	if len(password) == 0 {
+		return nil, fmt.Errorf("no password in %s", path)
+	}
+
+	return password, nil
+}
+
+// parseExpire reads a time to live such as "30m", "1h", "7d" or "2w".
+func parseExpire(value string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(value, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(value, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+
+	var expire time.Duration
+	if unit > 0 {
+		count, err := strconv.Atoi(value[:len(value)-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid expiry \"%s\", expected e.g. 1h or 7d", value)
 		}
 
-		return []byte{}, err
+		expire = time.Duration(count) * unit
+	} else {
+		var err error
+		if expire, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("invalid expiry \"%s\", expected e.g. 1h or 7d", value)
+		}
 	}
 
-	var config struct {
-		Password string `json:"password"`
+	if expire <= 0 {
+		return 0, fmt.Errorf("invalid expiry \"%s\", expected a positive duration", value)
 	}
 
-	if err = json.Unmarshal(content, &config); err != nil {
-		return []byte{}, err
+	return expire, nil
+}
+
+func firstLine(content []byte) []byte {
+	if end := bytes.IndexByte(content, '\n'); end >= 0 {
+		content = content[:end]
+	}
+
+	return bytes.TrimSuffix(content, []byte("\r"))
+}
+
+// loadKeyFile reads the key file at path, or returns nil if path is empty.
+func loadKeyFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	keyFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	if config.Password != "" {
-		log.Debugf("Using password in %s.", stashPath)
-		return []byte(config.Password), nil
+	if len(keyFile) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", path)
 	}
 
-	return nil, nil
+	log.Debugf("Using key file %s.", path)
+	return keyFile, nil
 }
 
 func getInteractivePassword() ([]byte, error) {
@@ -280,15 +706,25 @@ func getInteractivePassword() ([]byte, error) {
 	return gopass.GetPasswd()
 }
 
-func getPassword(passwords ...string) ([]byte, error) {
+// getPassword uses the first password source available: passwords given on
+// the command line, passwordFile, STASH_PASSWORD, password in ~/.stash,
+// password_command in ~/.stash, and finally an interactive prompt.
+func getPassword(passwordFile string, passwords ...string) ([]byte, error) {
 	for _, password := range passwords {
 		if password != "" {
+			log.Debug("Using password from the command line.")
 			return []byte(password), nil
 		}
 	}
 
+	if passwordFile != "" {
+		log.Debugf("Using password in %s.", passwordFile)
+		return getFilePassword(passwordFile)
+	}
+
 	password := getEnvPassword()
 	if password != nil {
+		log.Debug("Using password in STASH_PASSWORD.")
 		return password, nil
 	}
 
@@ -302,14 +738,108 @@ func getPassword(passwords ...string) ([]byte, error) {
 	return getInteractivePassword()
 }
 
-type plainFormatter struct {
-}
+// newContext returns the context of a command, done when it is interrupted
+// or, with a timeout, once that has passed.
+func newContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 
-func (f *plainFormatter) Format(entry *log.Entry) ([]byte, error) {
-	return []byte(entry.Message + "\n"), nil
+	// A second interrupt ends the command at once.
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if timeout <= 0 {
+		return ctx, stop
+	}
+
+	return context.WithTimeout(ctx, timeout)
 }
 
-func main() {
+// exitIfDone ends the command if it failed with err because it was
+// interrupted or timed out, which err itself may not tell.
+func exitIfDone(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+
+	switch ctx.Err() {
+	case context.Canceled:
+		log.Fatal("Error: interrupted.")
+	case context.DeadlineExceeded:
+		log.Fatal("Error: timed out.")
+	}
+}
+
+// describeError explains why a command failed with err, which storage and
+// crypt report alike to every command.
+func describeError(err error) string {
+	switch cause := errors.Cause(err); {
+	case cause == crypt.ErrIntegrity:
+		return fmt.Sprintf("integrity check failed, %s", err)
+	case cause == crypt.ErrIncorrectPassword:
+		return "incorrect password"
+	case cause == crypt.ErrKeyFileRequired:
+		return "stash requires a key file, use --key-file"
+	case cause == storage.ErrNotOwner:
+		return "owner token does not match the stash"
+	case cause == storage.ErrExpired:
+		return "stash expired"
+	case cause == storage.ErrConsumed:
+		return "stash already consumed"
+	case storage.IsNotFound(cause):
+		return "stash not found"
+	default:
+		return err.Error()
+	}
+}
+
+// newClient returns the storage selected by backend, a URL such as
+// file:///var/stash, or else by the profile, or the hosted storage, along
+// with the URL that names it in the history.
+func newClient(backend string) (storage.Client, string, error) {
+	settings, err := loadProfile()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if backend == "" {
+		backend = settings.Backend
+	}
+
+	if backend == "" && settings.S3 != nil {
+		client, err := storage.NewS3Client(*settings.S3)
+		return client, "s3://" + settings.S3.Bucket + "/" + settings.S3.Prefix, err
+	}
+
+	if backend == "" {
+		backend = storage.DefaultBackend
+	}
+
+	client, err := storage.Open(backend)
+	return client, backend, err
+}
+
+// recordOwned keeps the owner tokens of new stashes in the history. The
+// stashes are there regardless, so failing to is only a warning.
+func recordOwned(backend string, stashes ...ownedStash) {
+	for _, stash := range stashes {
+		log.Debugf("Record owner token for %s.", stash.ID)
+	}
+
+	if err := recordStashes(backend, stashes); err != nil {
+		log.Warnf("Warning: failed to record owner tokens: %s", err)
+	}
+}
+
+type plainFormatter struct {
+}
+
+func (f *plainFormatter) Format(entry *log.Entry) ([]byte, error) {
+	return []byte(entry.Message + "\n"), nil
+}
+
+func main() {
 	app := cli.App("stash", "Encrypted Internet clipboard")
 	log.SetFormatter(&plainFormatter{})
 	log.SetLevel(log.InfoLevel)
@@ -317,53 +847,642 @@ func main() {
 
 	appVerbose := app.BoolOpt("v verbose", false, "Verbose output")
 	appPassword := app.StringOpt("p password", "", "Password")
+	appBackend := app.String(cli.StringOpt{Name: "backend", EnvVar: "STASH_BACKEND", Desc: "Storage URL: https://server, file:///dir, s3://bucket/prefix, or mem://"})
+	appProfile := app.String(cli.StringOpt{Name: "profile", EnvVar: "STASH_PROFILE", Desc: "Profile in ~/.stash to use"})
+	appTimeout := app.String(cli.StringOpt{Name: "timeout", EnvVar: "STASH_TIMEOUT", Desc: "Give up on storage after a time, e.g. 30s or 5m"})
+
+	app.Before = func() {
+		profileName = *appProfile
+	}
 
-	client := storage.NewGCPClient("https://us-central1-stash-215008.cloudfunctions.net")
-	// client := storage.NewFilesystemClient("/tmp/stash-storage")
-	// client := storage.NewInMemoryClient();
+	// Commands that use storage open it first, and use it within ctx.
+	var client storage.Client
+	var backend string
+	var ctx context.Context
+	var cancel context.CancelFunc
+	openClient := func() {
+		var timeout time.Duration
+		if *appTimeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(*appTimeout); err != nil || timeout <= 0 {
+				log.Fatalf("Error: invalid timeout \"%s\", expected e.g. 30s or 5m.", *appTimeout)
+			}
+		}
+
+		var err error
+		if client, backend, err = newClient(*appBackend); err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+
+		ctx, cancel = newContext(timeout)
+	}
+
+	app.After = func() {
+		if cancel != nil {
+			cancel()
+		}
+	}
 
 	app.Command("copy c", "Copy data: files, directories, and/or stdin", func(cmd *cli.Cmd) {
 		copyPassword := cmd.StringOpt("p password", "", "Password")
+		copyPasswordFile := cmd.StringOpt("password-file", "", "Read the password from the first line of a file")
+		copyKeyFile := cmd.StringOpt("key-file", "", "Require a key file in addition to the password")
 		copyVerbose := cmd.BoolOpt("v verbose", false, "Verbose output")
+		copyFormat := cmd.StringOpt("format", crypt.FormatStash, "Encryption format: stash or age")
+		copyCipher := cmd.StringOpt("cipher", crypt.CipherAES256GCM, "Cipher for stash format: aes-256-gcm or xchacha20-poly1305")
+		copyKDFCost := cmd.IntOpt("kdf-cost", crypt.DefaultKDFCost, "Password key derivation memory cost in MiB (Argon2id)")
+		copyTo := cmd.StringsOpt("t to", nil, "Encrypt to a public key or recipient alias instead of a password")
+		copySign := cmd.BoolOpt("s sign", false, "Sign the stash with your signing key")
+		copyPad := cmd.StringOpt("pad", crypt.PaddingAuto, "Length-hiding padding: auto, padme, bucket, or none")
+		copyWormhole := cmd.BoolOpt("w wormhole", false, "Encrypt with a secret phrase appended to the stash ID instead of a password")
+		copySplit := cmd.StringOpt("split", "", "Split the key into shares, each its own stash, e.g. 3-of-5")
+		copyMessage := cmd.StringOpt("m message", "", "Note for the recipient, shown by info")
+		copyCompression := cmd.StringOpt("compression", "", "Compression: gzip or none (default gzip)")
+		copyExpire := cmd.StringOpt("expire", "", "Delete the stash after a time, e.g. 1h or 7d")
+		copyBurn := cmd.BoolOpt("burn", false, "Delete the stash once it is downloaded")
+		copyMaxDownloads := cmd.IntOpt("max-downloads", 0, "Delete the stash after it is downloaded this many times")
 		paths := cmd.StringsArg("PATH", nil, "File or directory to copy")
 		cmd.Spec = "[OPTIONS] [PATH...]"
 
+		cmd.Before = openClient
 		cmd.Action = func() {
 			if *copyVerbose || *appVerbose {
 				log.SetLevel(log.DebugLevel)
 			}
 
-			password, err := getPassword(*copyPassword, *appPassword)
+			if *copyKDFCost < 1 || *copyKDFCost > crypt.MaxKDFCost {
+				log.Fatalf("Error: --kdf-cost must be between 1 and %d.", crypt.MaxKDFCost)
+			}
+
+			var threshold, count int
+			if *copySplit != "" {
+				if *copyWormhole {
+					log.Fatal("Error: --split cannot be used with --wormhole.")
+				}
+
+				var err error
+				if threshold, count, err = parseSplit(*copySplit); err != nil {
+					log.Fatalf("Error: %s", err)
+				}
+			}
+
+			settings, err := loadProfile()
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			// The profile's recipients apply unless a password is given.
+			to := *copyTo
+			if len(to) == 0 && !*copyWormhole && *copyPassword == "" && *copyPasswordFile == "" && *appPassword == "" {
+				to = settings.To
+			}
+
+			recipients, err := resolveRecipients(to)
 			if err != nil {
 				log.Fatalf("Error: %s", err)
 			}
 
-			err = runCopy(client, password, *paths)
+			compression := *copyCompression
+			if compression == "" {
+				compression = settings.Compression
+			}
+
+			if compression == "" || *copyFormat == crypt.FormatAge {
+				compression = crypt.CompressionGzip
+			} else if compression != crypt.CompressionGzip && compression != crypt.CompressionNone {
+				log.Fatalf("Error: invalid compression \"%s\", expected gzip or none.", compression)
+			}
+
+			var limits stashLimits
+			if value := *copyExpire; value != "" || settings.Expire != "" {
+				if value == "" {
+					value = settings.Expire
+				}
+
+				if limits.expire, err = parseExpire(value); err != nil {
+					log.Fatalf("Error: %s.", err)
+				}
+			}
+
+			limits.maxDownloads = *copyMaxDownloads
+			if limits.maxDownloads < 0 {
+				log.Fatal("Error: --max-downloads must be positive.")
+			}
+
+			if *copyBurn {
+				if limits.maxDownloads > 1 {
+					log.Fatal("Error: --burn cannot be used with --max-downloads.")
+				}
+
+				limits.maxDownloads = 1
+			}
+
+			var password []byte
+			var secret string
+			if *copyWormhole {
+				if len(recipients) > 0 {
+					log.Fatal("Error: --wormhole cannot be used with --to.")
+				}
+
+				if secret, err = identifier.NewSecret(identifier.SecretWords); err != nil {
+					log.Fatalf("Error: %s", err)
+				}
+
+				password = []byte(secret)
+			} else if len(recipients) == 0 {
+				if password, err = getPassword(*copyPasswordFile, *copyPassword, *appPassword); err != nil {
+					log.Fatalf("Error: %s", err)
+				}
+			}
+
+			keyFile, err := loadKeyFile(*copyKeyFile)
 			if err != nil {
 				log.Fatalf("Error: %s", err)
 			}
+
+			var signingKey *crypt.SigningKey
+			if *copySign {
+				if signingKey, err = loadSigningKey(); err != nil {
+					log.Fatalf("Error: %s", err)
+				}
+			}
+
+			options := crypt.Options{
+				Format:      *copyFormat,
+				Cipher:      *copyCipher,
+				KDFCost:     *copyKDFCost,
+				Compression: compression,
+				Recipients:  recipients,
+				SigningKey:  signingKey,
+				Padding:     *copyPad,
+				KeyFile:     keyFile,
+			}
+
+			if count > 0 {
+				shares, payload, err := runSplitCopy(ctx, client, password, options, limits, *paths, *copyMessage, threshold, count)
+				exitIfDone(ctx, err)
+				if err != nil {
+					log.Fatalf("Error: %s.", describeError(err))
+				}
+
+				recordOwned(backend, append(shares, payload)...)
+				log.Infof("Paste any %d of these share IDs together:", threshold)
+				for _, share := range shares {
+					log.Infof("Share ID: %s", share.ID)
+				}
+
+				return
+			}
+
+			// A wormhole copy picks a new secret each time, so it cannot
+			// finish an interrupted one.
+			stash, err := runCopy(ctx, client, password, options, limits, *paths, *copyMessage, !*copyWormhole)
+			exitIfDone(ctx, err)
+			if err != nil {
+				log.Fatalf("Error: %s.", describeError(err))
+			}
+
+			recordOwned(backend, stash)
+			if secret != "" {
+				log.Infof("Stash phrase: %s %s", stash.ID, secret)
+			} else {
+				log.Infof("Stash ID: %s", stash.ID)
+			}
 		}
 	})
 
 	app.Command("paste p", "Paste data", func(cmd *cli.Cmd) {
 		pastePassword := cmd.StringOpt("p password", "", "Password")
+		pastePasswordFile := cmd.StringOpt("password-file", "", "Read the password from the first line of a file")
+		pasteKeyFile := cmd.StringOpt("key-file", "", "Key file the stash was copied with")
 		pasteVerbose := cmd.BoolOpt("v verbose", false, "Verbose output")
-		parts := cmd.StringsArg("STASH_ID", nil, "Stash ID from copy")
+		pasteRequireSigned := cmd.BoolOpt("require-signed", false, "Refuse stashes not signed by a trusted key")
+		parts := cmd.StringsArg("STASH_ID", nil, "Stash ID, phrase, or share IDs from copy")
 		cmd.Spec = "[OPTIONS] STASH_ID..."
 
+		cmd.Before = openClient
 		cmd.Action = func() {
 			if *pasteVerbose || *appVerbose {
 				log.SetLevel(log.DebugLevel)
 			}
 
-			password, err := getPassword(*pastePassword, *appPassword)
+			ids, secret, err := identifier.Parse(strings.Join(*parts, " "))
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			password := func() ([]byte, error) {
+				return getPassword(*pastePasswordFile, secret, *pastePassword, *appPassword)
+			}
+
+			keyFile, err := loadKeyFile(*pasteKeyFile)
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			err = runPaste(ctx, client, password, keyFile, ids, *pasteRequireSigned)
+			exitIfDone(ctx, err)
+			if err != nil {
+				log.Fatalf("Error: %s.", describeError(err))
+			}
+		}
+	})
+
+	app.Command("info i", "Show the contents of a stash without pasting it", func(cmd *cli.Cmd) {
+		infoPassword := cmd.StringOpt("p password", "", "Password")
+		infoPasswordFile := cmd.StringOpt("password-file", "", "Read the password from the first line of a file")
+		infoKeyFile := cmd.StringOpt("key-file", "", "Key file the stash was copied with")
+		infoVerbose := cmd.BoolOpt("v verbose", false, "Verbose output")
+		parts := cmd.StringsArg("STASH_ID", nil, "Stash ID, phrase, or share IDs from copy")
+		cmd.Spec = "[OPTIONS] STASH_ID..."
+
+		cmd.Before = openClient
+		cmd.Action = func() {
+			if *infoVerbose || *appVerbose {
+				log.SetLevel(log.DebugLevel)
+			}
+
+			ids, secret, err := identifier.Parse(strings.Join(*parts, " "))
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			password := func() ([]byte, error) {
+				return getPassword(*infoPasswordFile, secret, *infoPassword, *appPassword)
+			}
+
+			keyFile, err := loadKeyFile(*infoKeyFile)
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			err = runInfo(ctx, client, password, keyFile, ids)
+			exitIfDone(ctx, err)
+			if err != nil {
+				log.Fatalf("Error: %s.", describeError(err))
+			}
+		}
+	})
+
+	app.Command("rekey", "Encrypt a stash again with a new password or recipients, keeping its ID", func(cmd *cli.Cmd) {
+		rekeyPassword := cmd.StringOpt("p password", "", "Current password")
+		rekeyPasswordFile := cmd.StringOpt("password-file", "", "Read the current password from the first line of a file")
+		rekeyKeyFile := cmd.StringOpt("key-file", "", "Key file the stash was copied with")
+		rekeyNewPassword := cmd.StringOpt("new-password", "", "New password")
+		rekeyNewPasswordFile := cmd.StringOpt("new-password-file", "", "Read the new password from the first line of a file")
+		rekeyNewKeyFile := cmd.StringOpt("new-key-file", "", "Require a key file in addition to the new password")
+		rekeyVerbose := cmd.BoolOpt("v verbose", false, "Verbose output")
+		rekeyCipher := cmd.StringOpt("cipher", crypt.CipherAES256GCM, "Cipher: aes-256-gcm or xchacha20-poly1305")
+		rekeyKDFCost := cmd.IntOpt("kdf-cost", crypt.DefaultKDFCost, "Password key derivation memory cost in MiB (Argon2id)")
+		rekeyTo := cmd.StringsOpt("t to", nil, "Encrypt to a public key or recipient alias instead of a password")
+		rekeySign := cmd.BoolOpt("s sign", false, "Sign the stash with your signing key")
+		rekeyPad := cmd.StringOpt("pad", "", "Length-hiding padding: auto, padme, bucket, or none (default the stash's own)")
+		rekeyToken := cmd.StringOpt("token", "", "Owner token from copy (default from ~/.stash-history)")
+		parts := cmd.StringsArg("STASH_ID", nil, "Stash ID or phrase from copy")
+		cmd.Spec = "[OPTIONS] STASH_ID..."
+
+		cmd.Before = openClient
+		cmd.Action = func() {
+			if *rekeyVerbose || *appVerbose {
+				log.SetLevel(log.DebugLevel)
+			}
+
+			if *rekeyKDFCost < 1 || *rekeyKDFCost > crypt.MaxKDFCost {
+				log.Fatalf("Error: --kdf-cost must be between 1 and %d.", crypt.MaxKDFCost)
+			}
+
+			ids, secret, err := identifier.Parse(strings.Join(*parts, " "))
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			if len(ids) != 1 {
+				log.Fatal("Error: split stashes cannot be rekeyed.")
+			}
+
+			token, err := findToken(backend, ids[0], *rekeyToken)
+			if err != nil {
+				log.Fatalf("Error: %s.", err)
+			}
+
+			password := func() ([]byte, error) {
+				return getPassword(*rekeyPasswordFile, secret, *rekeyPassword, *appPassword)
+			}
+
+			keyFile, err := loadKeyFile(*rekeyKeyFile)
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			recipients, err := resolveRecipients(*rekeyTo)
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			var newPassword []byte
+			if len(recipients) == 0 {
+				if *rekeyNewPasswordFile != "" && *rekeyNewPassword == "" {
+					newPassword, err = getFilePassword(*rekeyNewPasswordFile)
+				} else {
+					newPassword, err = getNewPassword(*rekeyNewPassword)
+				}
+
+				if err != nil {
+					log.Fatalf("Error: %s", err)
+				}
+			}
+
+			newKeyFile, err := loadKeyFile(*rekeyNewKeyFile)
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			var signingKey *crypt.SigningKey
+			if *rekeySign {
+				if signingKey, err = loadSigningKey(); err != nil {
+					log.Fatalf("Error: %s", err)
+				}
+			}
+
+			options := crypt.Options{
+				Format:     crypt.FormatStash,
+				Cipher:     *rekeyCipher,
+				KDFCost:    *rekeyKDFCost,
+				Recipients: recipients,
+				SigningKey: signingKey,
+				Padding:    *rekeyPad,
+				KeyFile:    newKeyFile,
+			}
+
+			err = runRekey(ctx, client, password, keyFile, ids[0], token, newPassword, options)
+			exitIfDone(ctx, err)
+			if err != nil {
+				log.Fatalf("Error: %s.", describeError(err))
+			}
+
+			log.Infof("Stash ID: %s", ids[0])
+		}
+	})
+
+	app.Command("send", "Send data directly to a receiver, protected by a short code", func(cmd *cli.Cmd) {
+		sendVerbose := cmd.BoolOpt("v verbose", false, "Verbose output")
+		sendRelay := cmd.String(cli.StringOpt{Name: "relay", Value: relay.DefaultAddress, EnvVar: "STASH_RELAY", Desc: "Relay address"})
+		paths := cmd.StringsArg("PATH", nil, "File or directory to send")
+		cmd.Spec = "[OPTIONS] [PATH...]"
+
+		cmd.Action = func() {
+			if *sendVerbose || *appVerbose {
+				log.SetLevel(log.DebugLevel)
+			}
+
+			err := runSend(*sendRelay, *paths)
+			if errors.Cause(err) == crypt.ErrCodeMismatch {
+				log.Fatal("Error: receiver used the wrong code, send again for a new code.")
+			} else if err != nil {
+				log.Fatalf("Error: %s.", describeError(err))
+			}
+		}
+	})
+
+	app.Command("receive", "Receive data from a sender", func(cmd *cli.Cmd) {
+		receiveVerbose := cmd.BoolOpt("v verbose", false, "Verbose output")
+		receiveRelay := cmd.String(cli.StringOpt{Name: "relay", Value: relay.DefaultAddress, EnvVar: "STASH_RELAY", Desc: "Relay address"})
+		parts := cmd.StringsArg("CODE", nil, "Code from send")
+		cmd.Spec = "[OPTIONS] CODE..."
+
+		cmd.Action = func() {
+			if *receiveVerbose || *appVerbose {
+				log.SetLevel(log.DebugLevel)
+			}
+
+			code := strings.Join(*parts, "-")
+			err := runReceive(*receiveRelay, code)
+			if errors.Cause(err) == crypt.ErrCodeMismatch {
+				log.Fatal("Error: incorrect code.")
+			} else if err != nil {
+				log.Fatalf("Error: %s.", describeError(err))
+			}
+		}
+	})
+
+	app.Command("relay", "Run a relay for send and receive", func(cmd *cli.Cmd) {
+		relayListen := cmd.StringOpt("l listen", relay.DefaultAddress, "Address to listen on")
+		relayVerbose := cmd.BoolOpt("v verbose", false, "Verbose output")
+
+		cmd.Action = func() {
+			if *relayVerbose || *appVerbose {
+				log.SetLevel(log.DebugLevel)
+			}
+
+			if err := runRelay(*relayListen); err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+		}
+	})
+
+	app.Command("server", "Run a stash server", func(cmd *cli.Cmd) {
+		serverListen := cmd.StringOpt("l listen", ":8080", "Address to listen on")
+		serverStorage := cmd.String(cli.StringOpt{Name: "storage", EnvVar: "STASH_SERVER_STORAGE", Desc: "Where to keep stashes: file:///dir, s3://bucket/prefix, or mem://"})
+		serverCert := cmd.StringOpt("tls-cert", "", "TLS certificate file")
+		serverKey := cmd.StringOpt("tls-key", "", "TLS private key file")
+		serverAllowList := cmd.BoolOpt("allow-list", false, "Let anyone list the IDs of the stashes")
+		serverMaxSize := cmd.IntOpt("max-size", 1024, "Largest stash accepted in MiB, or 0 for no limit")
+		serverVerbose := cmd.BoolOpt("v verbose", false, "Verbose output")
+
+		cmd.Action = func() {
+			if *serverVerbose || *appVerbose {
+				log.SetLevel(log.DebugLevel)
+			}
+
+			if *serverStorage == "" {
+				log.Fatal("Error: choose where to keep stashes with --storage, e.g. file:///var/stash.")
+			}
+
+			if (*serverCert == "") != (*serverKey == "") {
+				log.Fatal("Error: --tls-cert and --tls-key must be used together.")
+			}
+
+			if *serverMaxSize < 0 {
+				log.Fatal("Error: --max-size must be positive.")
+			}
+
+			backend, err := storage.Open(*serverStorage)
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			if err := runServer(backend, *serverListen, *serverCert, *serverKey, *serverAllowList, int64(*serverMaxSize)*1024*1024); err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+		}
+	})
+
+	app.Command("rm", "Delete a stash", func(cmd *cli.Cmd) {
+		rmToken := cmd.StringOpt("token", "", "Owner token from copy (default from ~/.stash-history)")
+		parts := cmd.StringsArg("STASH_ID", nil, "Stash ID, phrase, or share IDs from copy")
+		cmd.Spec = "[OPTIONS] STASH_ID..."
+
+		cmd.Before = openClient
+		cmd.Action = func() {
+			ids, _, err := identifier.Parse(strings.Join(*parts, " "))
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			for _, id := range ids {
+				token, err := findToken(backend, id, *rmToken)
+				if err != nil {
+					log.Fatalf("Error: %s.", err)
+				}
+
+				err = runRemove(ctx, client, id, token)
+				exitIfDone(ctx, err)
+				if err != nil {
+					log.Fatalf("Error: %s: %s.", id, describeError(err))
+				}
+
+				if err := forgetStash(backend, id); err != nil {
+					log.Warnf("Warning: failed to update history: %s", err)
+				}
+
+				log.Infof("Deleted stash %s.", id)
+			}
+		}
+	})
+
+	app.Command("expire", "Change when a stash expires", func(cmd *cli.Cmd) {
+		expireToken := cmd.StringOpt("token", "", "Owner token from copy (default from ~/.stash-history)")
+		after := cmd.StringArg("EXPIRE", "", "Time from now, e.g. 1h or 7d, or never")
+		parts := cmd.StringsArg("STASH_ID", nil, "Stash ID, phrase, or share IDs from copy")
+		cmd.Spec = "[OPTIONS] EXPIRE STASH_ID..."
+
+		cmd.Before = openClient
+		cmd.Action = func() {
+			var expire time.Duration
+			if *after != "never" {
+				var err error
+				if expire, err = parseExpire(*after); err != nil {
+					log.Fatalf("Error: %s.", err)
+				}
+			}
+
+			ids, _, err := identifier.Parse(strings.Join(*parts, " "))
 			if err != nil {
 				log.Fatalf("Error: %s", err)
 			}
 
-			id := strings.Join(*parts, " ")
-			err = runPaste(client, password, id)
+			for _, id := range ids {
+				token, err := findToken(backend, id, *expireToken)
+				if err != nil {
+					log.Fatalf("Error: %s.", err)
+				}
+
+				err = runExpire(ctx, client, id, token, expire)
+				exitIfDone(ctx, err)
+				if err != nil {
+					log.Fatalf("Error: %s: %s.", id, describeError(err))
+				}
+
+				if expire > 0 {
+					log.Infof("Stash %s expires in %s.", id, *after)
+				} else {
+					log.Infof("Stash %s no longer expires.", id)
+				}
+			}
+		}
+	})
+
+	app.Command("stat", "Show the size, expiry, and download limit of a stash", func(cmd *cli.Cmd) {
+		parts := cmd.StringsArg("STASH_ID", nil, "Stash ID or phrase from copy")
+		cmd.Spec = "STASH_ID..."
+
+		cmd.Before = openClient
+		cmd.Action = func() {
+			ids, _, err := identifier.Parse(strings.Join(*parts, " "))
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+
+			if len(ids) != 1 {
+				log.Fatal("Error: stat takes a single stash ID.")
+			}
+
+			err = runStat(ctx, client, ids[0])
+			exitIfDone(ctx, err)
 			if err != nil {
+				log.Fatalf("Error: %s.", describeError(err))
+			}
+		}
+	})
+
+	app.Command("sweep", "Purge expired stashes from a directory or memory backend", func(cmd *cli.Cmd) {
+		cmd.Before = openClient
+
+		cmd.Action = func() {
+			count, err := runSweep(client)
+			if err != nil {
+				log.Fatalf("Error: %s.", err)
+			}
+
+			log.Infof("Purged %d expired stash(es).", count)
+		}
+	})
+
+	app.Command("config", "Show or change settings in ~/.stash", func(cmd *cli.Cmd) {
+		cmd.Command("get", "Show a setting, e.g. backend or work.backend for the work profile", func(cmd *cli.Cmd) {
+			key := cmd.StringArg("KEY", "", "Setting")
+
+			cmd.Action = func() {
+				value, err := runConfigGet(*key)
+				if err != nil {
+					log.Fatalf("Error: %s", err)
+				}
+
+				fmt.Println(value)
+			}
+		})
+
+		cmd.Command("set", "Change a setting; an empty value removes it", func(cmd *cli.Cmd) {
+			key := cmd.StringArg("KEY", "", "Setting: profile, or [PROFILE.]backend, password, password_command, to, compression, or expire")
+			value := cmd.StringArg("VALUE", "", "Value")
+
+			cmd.Action = func() {
+				if err := runConfigSet(*key, *value); err != nil {
+					log.Fatalf("Error: %s", err)
+				}
+			}
+		})
+
+		cmd.Command("list ls", "Show all settings", func(cmd *cli.Cmd) {
+			cmd.Action = func() {
+				lines, err := runConfigList()
+				if err != nil {
+					log.Fatalf("Error: %s", err)
+				}
+
+				for _, line := range lines {
+					fmt.Println(line)
+				}
+			}
+		})
+	})
+
+	app.Command("keygen", "Generate an identity for receiving stashes, or a signing key", func(cmd *cli.Cmd) {
+		keygenForce := cmd.BoolOpt("f force", false, "Replace an existing key")
+		keygenSign := cmd.BoolOpt("s sign", false, "Generate a signing key instead of an identity")
+		keygenVerbose := cmd.BoolOpt("v verbose", false, "Verbose output")
+
+		cmd.Action = func() {
+			if *keygenVerbose || *appVerbose {
+				log.SetLevel(log.DebugLevel)
+			}
+
+			keygen := runKeygen
+			if *keygenSign {
+				keygen = runSigningKeygen
+			}
+
+			if err := keygen(*keygenForce); err != nil {
 				log.Fatalf("Error: %s", err)
 			}
 		}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/schmich/stash/crypt"
+	"github.com/schmich/stash/storage"
+)
+
+func TestParseExpire(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"90m": 90 * time.Minute, "1h": time.Hour, "7d": 7 * 24 * time.Hour, "2w": 14 * 24 * time.Hour} {
+		if expire, err := parseExpire(value); err != nil || expire != expected {
+			t.Errorf("%s: got %s, %v", value, expire, err)
+		}
+	}
+
+	for _, value := range []string{"", "d", "1x", "-1h", "0d", "soon"} {
+		if _, err := parseExpire(value); err == nil {
+			t.Errorf("%s: accepted", value)
+		}
+	}
+}
+
+// cancelling cancels a copy once it has uploaded a chunk, or a paste once it
+// has downloaded some of the stash.
+type cancelling struct {
+	storage.ResumableClient
+	cancel context.CancelFunc
+}
+
+func (client cancelling) UploadChunk(ctx context.Context, session string, offset int64, chunk []byte, checksum []byte) error {
+	defer client.cancel()
+	return client.ResumableClient.UploadChunk(ctx, session, offset, chunk, checksum)
+}
+
+func (client cancelling) DownloadFrom(ctx context.Context, id string, offset int64) io.ReadCloser {
+	return &cancellingReader{client.ResumableClient.DownloadFrom(ctx, id, offset), client.cancel, 0}
+}
+
+type cancellingReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	count  int
+}
+
+func (reader *cancellingReader) Read(buf []byte) (int, error) {
+	if reader.count > 256*1024 {
+		reader.cancel()
+	}
+
+	count, err := reader.ReadCloser.Read(buf)
+	reader.count += count
+	return count, err
+}
+
+// copyTree creates files of the given sizes under source in a new directory,
+// which becomes the working directory.
+func copyTree(t *testing.T, sizes ...int) string {
+	homedir.DisableCache = true
+	t.Setenv("HOME", t.TempDir())
+	t.Chdir(t.TempDir())
+
+	if err := os.Mkdir("source", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, size := range sizes {
+		content := make([]byte, size)
+		rand.Read(content)
+		if err := ioutil.WriteFile(filepath.Join("source", strconv.Itoa(i)), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return "source"
+}
+
+func TestCancelledCopy(t *testing.T) {
+	source := copyTree(t, storage.ChunkSize)
+	directory := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := cancelling{storage.NewFilesystemClient(directory), cancel}
+	options := crypt.Options{Compression: crypt.CompressionNone, KDFCost: 1}
+	if _, err := runCopy(ctx, client, []byte("password"), options, stashLimits{}, []string{source}, "", true); errors.Cause(err) != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+
+	// The session is aborted rather than kept to resume.
+	if files, err := ioutil.ReadDir(directory); err != nil || len(files) != 0 {
+		t.Errorf("storage has %d files, %v", len(files), err)
+	}
+
+	if uploads, err := loadUploads(); err != nil || len(uploads) != 0 {
+		t.Errorf("uploads recorded: %v, %v", uploads, err)
+	}
+
+	spool, _ := getSpoolPath()
+	if files, err := ioutil.ReadDir(spool); err != nil || len(files) != 0 {
+		t.Errorf("spool has %d files, %v", len(files), err)
+	}
+}
+
+func TestCancelledPaste(t *testing.T) {
+	source := copyTree(t, 1000, 1024*1024)
+	client := storage.NewInMemoryClient()
+	options := crypt.Options{Compression: crypt.CompressionNone, KDFCost: 1}
+	stash, err := runCopy(context.Background(), client, []byte("password"), options, stashLimits{}, []string{source}, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := t.TempDir()
+	t.Chdir(output)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	password := func() ([]byte, error) { return []byte("password"), nil }
+	if err := runPaste(ctx, cancelling{client, cancel}, password, nil, []string{stash.ID}, false); errors.Cause(err) != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+
+	// The first file was unpacked whole, and removed with the second.
+	if files, err := ioutil.ReadDir(output); err != nil || len(files) != 0 {
+		t.Errorf("paste left %d files, %v", len(files), err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schmich/stash/storage"
+)
+
+func getManager(client storage.Client) (storage.Manager, error) {
+	manager, ok := client.(storage.Manager)
+	if !ok {
+		return nil, errors.New("this storage cannot manage stashes")
+	}
+
+	return manager, nil
+}
+
+func runRemove(ctx context.Context, client storage.Client, id, token string) error {
+	manager, err := getManager(client)
+	if err != nil {
+		return err
+	}
+
+	return manager.Delete(ctx, id, token)
+}
+
+// runExpire changes when the stash with id expires, or with a zero expire,
+// keeps it until it is deleted.
+func runExpire(ctx context.Context, client storage.Client, id, token string, expire time.Duration) error {
+	manager, err := getManager(client)
+	if err != nil {
+		return err
+	}
+
+	var expires time.Time
+	if expire > 0 {
+		expires = time.Now().Add(expire)
+	}
+
+	return manager.SetExpires(ctx, id, token, expires)
+}
+
+func runStat(ctx context.Context, client storage.Client, id string) error {
+	manager, err := getManager(client)
+	if err != nil {
+		return err
+	}
+
+	info, err := manager.Stat(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("ID:      %s\n", info.ID)
+	fmt.Printf("Size:    %d bytes\n", info.Size)
+	fmt.Printf("Created: %s\n", info.Created.Local().Format(time.RFC1123))
+	if !info.Expires.IsZero() {
+		expired := ""
+		if storage.IsExpired(info.Expires) {
+			expired = " (expired)"
+		}
+
+		fmt.Printf("Expires: %s%s\n", info.Expires.Local().Format(time.RFC1123), expired)
+	}
+
+	if info.MaxDownloads > 0 {
+		fmt.Printf("Limit:   %d of %d downloads left\n", info.MaxDownloads-info.Downloads, info.MaxDownloads)
+	}
+
+	return nil
+}
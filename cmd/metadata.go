@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schmich/stash/storage"
+)
+
+type fileMetadata struct {
+	Name string      `json:"name"`
+	Size int64       `json:"size"`
+	Mode os.FileMode `json:"mode"`
+}
+
+// metadata describes the contents of a stash. It is encrypted separately
+// from the payload so it can be read without downloading the files.
+type metadata struct {
+	Files     []fileMetadata `json:"files"`
+	TotalSize int64          `json:"total_size"`
+	Created   time.Time      `json:"created"`
+	Message   string         `json:"message,omitempty"`
+}
+
+func newMetadata(entries []entry, message string) *metadata {
+	metadata := &metadata{Created: time.Now().UTC(), Message: message}
+	for _, entry := range entries {
+		file := fileMetadata{Name: entry.name, Size: int64(len(entry.data)), Mode: 0600}
+		if entry.info != nil {
+			file.Size = entry.info.Size()
+			file.Mode = entry.info.Mode()
+		}
+
+		metadata.Files = append(metadata.Files, file)
+		metadata.TotalSize += file.Size
+	}
+
+	return metadata
+}
+
+// runInfo describes the stash from its header and metadata, without reading
+// the payload. Stashes with a download limit are refused, since any download
+// counts.
+func runInfo(ctx context.Context, client storage.Client, getPassword func() ([]byte, error), keyFile []byte, ids []string) error {
+	if err := checkUnlimited(ctx, client, ids, "info"); err != nil {
+		return err
+	}
+
+	header, decrypter, downloader, err := download(ctx, client, ids, getPassword, keyFile)
+	if err != nil {
+		return err
+	}
+
+	defer downloader.Close()
+
+	if header == nil || decrypter.Metadata() == nil {
+		return errors.New("stash has no metadata")
+	}
+
+	var metadata metadata
+	if err := json.Unmarshal(decrypter.Metadata(), &metadata); err != nil {
+		return errors.Wrap(err, "read metadata")
+	}
+
+	fmt.Printf("Created: %s\n", metadata.Created.Local().Format(time.RFC1123))
+	// The signature covers the payload, which info does not read.
+	if signer := header.SignedBy(); signer != nil {
+		fmt.Printf("Signer:  %s (claimed, unverified)\n", signer)
+	}
+
+	if metadata.Message != "" {
+		fmt.Printf("Message: %s\n", metadata.Message)
+	}
+
+	fmt.Printf("Files:   %d (%d bytes)\n", len(metadata.Files), metadata.TotalSize)
+	for _, file := range metadata.Files {
+		fmt.Printf("  %s %10d %s\n", file.Mode, file.Size, file.Name)
+	}
+
+	return nil
+}
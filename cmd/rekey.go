@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/howeyc/gopass"
+	"github.com/pkg/errors"
+	"github.com/schmich/stash/crypt"
+	"github.com/schmich/stash/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+func getNewPassword(passwords ...string) ([]byte, error) {
+	for _, password := range passwords {
+		if password != "" {
+			log.Debug("Using new password from the command line.")
+			return []byte(password), nil
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "New password: ")
+	return gopass.GetPasswd()
+}
+
+// signingKeyFor returns the signing key of signer, which must be the user's
+// own, so that a signed stash is signed again by the same key.
+func signingKeyFor(signer *crypt.Signer) (*crypt.SigningKey, error) {
+	signingKey, err := loadSigningKey()
+	if err != nil {
+		return nil, errors.Wrapf(err, "stash is signed by %s", signer)
+	}
+
+	if signingKey.Signer().String() != signer.String() {
+		return nil, fmt.Errorf("stash is signed by %s, which is not your signing key, and would lose its signature", signer)
+	}
+
+	return signingKey, nil
+}
+
+// runRekey decrypts the stash with id and encrypts it again with password or
+// options.Recipients, replacing it under the same ID. The payload is copied
+// as it is, still compressed, and never written locally. Replacing it takes
+// its owner token. The stash keeps its padding, unless options.Padding is
+// set, and its signer. Stashes with a download limit, which reading them
+// would use up, and legacy stashes are refused.
+func runRekey(ctx context.Context, client storage.Client, getPassword func() ([]byte, error), keyFile []byte, id, token string, password []byte, options crypt.Options) error {
+	// download/decode -> decrypt -> encrypt -> encode/replace
+
+	if err := checkUnlimited(ctx, client, []string{id}, "rekey"); err != nil {
+		return err
+	}
+
+	log.Debug("Download.")
+	downloader := downloadStash(ctx, client, id)
+	defer downloader.Close()
+
+	header, reader, err := crypt.ReadHeader(downloader)
+	if err != nil {
+		return err
+	}
+
+	// Legacy stashes are not authenticated, so a wrong password would
+	// replace the stash with garbage.
+	if header == nil {
+		return errors.New("legacy stashes cannot be rekeyed, paste and copy it again")
+	}
+
+	_, decrypter, err := unlockStash(header, reader, getPassword, keyFile)
+	if err != nil {
+		return err
+	}
+
+	options.Compression = header.Compression
+	options.Share = header.Share
+	if options.Padding == "" && !header.Padded {
+		options.Padding = crypt.PaddingNone
+	} else if options.Padding == "" {
+		options.Padding = header.Padding
+	}
+
+	if signer := header.SignedBy(); signer != nil && options.SigningKey == nil {
+		if options.SigningKey, err = signingKeyFor(signer); err != nil {
+			return err
+		}
+	}
+
+	options.Metadata = decrypter.Metadata()
+
+	// Cancelling the upload before closing it discards the replacement.
+	log.Debug("Upload.")
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	uploader := client.Replace(uploadCtx, id, token)
+	encrypter := crypt.NewEncrypter(uploader, password, options)
+	count, err := io.Copy(encrypter, decrypter)
+	if err == nil && count == 0 {
+		err = errors.New("stash is empty")
+	}
+
+	if err == nil {
+		err = encrypter.Close()
+	}
+
+	if err != nil {
+		cancel()
+		uploader.Close()
+		return err
+	}
+
+	// The replacement only takes effect once the whole stash has been
+	// decrypted and authenticated.
+	return uploader.Close()
+}
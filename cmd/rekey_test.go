@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/schmich/stash/crypt"
+	"github.com/schmich/stash/storage"
+)
+
+func TestRekeyRefusesLegacyStash(t *testing.T) {
+	ctx := context.Background()
+	client := storage.NewInMemoryClient()
+
+	// A legacy stash is a salt and IV followed by AES-128-OFB, which any
+	// password decrypts to something.
+	legacy := bytes.Repeat([]byte{7}, 200)
+	uploader := client.Upload(ctx, storage.UploadOptions{})
+	uploader.Write(legacy)
+	if err := uploader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongPassword := func() ([]byte, error) { return []byte("wrong"), nil }
+	err := runRekey(ctx, client, wrongPassword, nil, uploader.GetID(), uploader.GetToken(), []byte("new"), crypt.Options{Padding: crypt.PaddingNone})
+	if err == nil {
+		t.Fatal("rekeyed a legacy stash")
+	}
+
+	downloader := client.Download(ctx, uploader.GetID())
+	defer downloader.Close()
+
+	content, err := ioutil.ReadAll(downloader)
+	if err != nil || !bytes.Equal(content, legacy) {
+		t.Errorf("legacy stash changed: %d bytes, %v", len(content), err)
+	}
+}
+
+func TestInfoAndRekeyRefuseLimitedStash(t *testing.T) {
+	ctx := context.Background()
+	client := storage.NewInMemoryClient()
+	uploader := client.Upload(ctx, storage.UploadOptions{MaxDownloads: 1})
+	uploader.Write([]byte("stash"))
+	if err := uploader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	password := func() ([]byte, error) { return []byte("password"), nil }
+	if err := runRekey(ctx, client, password, nil, uploader.GetID(), uploader.GetToken(), []byte("new"), crypt.Options{}); err == nil {
+		t.Fatal("rekeyed a stash with a download limit")
+	}
+
+	if err := runInfo(ctx, client, password, nil, []string{uploader.GetID()}); err == nil {
+		t.Fatal("described a stash with a download limit")
+	}
+
+	// Neither used up the download.
+	if _, err := client.(storage.Manager).Stat(ctx, uploader.GetID()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/schmich/stash/crypt"
+	"github.com/schmich/stash/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resumable sessions expire, e.g. after a week on GCS.
+const maxUploadAge = 7 * 24 * time.Hour
+
+// abortTimeout bounds discarding the session of a cancelled upload.
+const abortTimeout = 10 * time.Second
+
+// pendingUpload is an interrupted upload of a stash spooled to a local
+// file, which copying the same files again finishes.
+type pendingUpload struct {
+	Fingerprint string    `json:"fingerprint"`
+	Session     string    `json:"session"`
+	Token       string    `json:"token"`
+	Spool       string    `json:"spool"`
+	Size        int64     `json:"size"`
+	Created     time.Time `json:"created"`
+}
+
+// resumeKey identifies a copy of the same files, unchanged, with the same
+// options. The password is not part of the fingerprint; it is checked
+// against the spooled stash instead.
+type resumeKey struct {
+	fingerprint string
+	password    []byte
+	keyFile     []byte
+}
+
+func getUploadsPath() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".stash-uploads"), nil
+}
+
+func getSpoolPath() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".stash-spool"), nil
+}
+
+func loadUploads() ([]*pendingUpload, error) {
+	path, err := getUploadsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var uploads []*pendingUpload
+	if err := json.Unmarshal(content, &uploads); err != nil {
+		return nil, errors.Wrapf(err, "read %s", path)
+	}
+
+	return uploads, nil
+}
+
+func saveUploads(uploads []*pendingUpload) error {
+	path, err := getUploadsPath()
+	if err != nil {
+		return err
+	}
+
+	if len(uploads) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	content, err := json.MarshalIndent(uploads, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+// updateUploads replaces the recorded uploads with those update keeps,
+// removing the spools of the others.
+func updateUploads(update func([]*pendingUpload) []*pendingUpload) error {
+	uploads, err := loadUploads()
+	if err != nil {
+		return err
+	}
+
+	kept := update(uploads)
+	for _, upload := range uploads {
+		if !containsUpload(kept, upload) {
+			os.Remove(upload.Spool)
+		}
+	}
+
+	return saveUploads(kept)
+}
+
+func containsUpload(uploads []*pendingUpload, upload *pendingUpload) bool {
+	for _, other := range uploads {
+		if other.Session == upload.Session {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newResumeKey(entries []entry, message string, limits stashLimits, password []byte, options crypt.Options) (*resumeKey, error) {
+	digest := sha256.New()
+	fmt.Fprintf(digest, "%q %q %q %d %q %t %q %d %d\n", options.Format, options.Cipher, options.Compression, options.KDFCost, options.Padding, options.Share, message, limits.expire, limits.maxDownloads)
+	for _, recipient := range options.Recipients {
+		fmt.Fprintln(digest, recipient)
+	}
+
+	if options.SigningKey != nil {
+		fmt.Fprintln(digest, options.SigningKey.Signer())
+	}
+
+	if options.KeyFile != nil {
+		fmt.Fprintf(digest, "%x\n", sha256.Sum256(options.KeyFile))
+	}
+
+	for _, entry := range entries {
+		// Stdin cannot be read again, and a hash of it could reveal it.
+		if entry.path == "" {
+			if len(entry.data) > 0 {
+				return nil, nil
+			}
+
+			continue
+		}
+
+		path, err := filepath.Abs(entry.path)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(digest, "%q %q %d %d %s\n", entry.name, path, entry.info.Size(), entry.info.ModTime().UnixNano(), entry.info.Mode())
+	}
+
+	return &resumeKey{
+		fingerprint: hex.EncodeToString(digest.Sum(nil)),
+		password:    password,
+		keyFile:     options.KeyFile,
+	}, nil
+}
+
+// unlocks reports whether the spooled stash was encrypted with the key's
+// password. Recipients are part of the fingerprint.
+func (key *resumeKey) unlocks(upload *pendingUpload) bool {
+	spool, err := os.Open(upload.Spool)
+	if err != nil {
+		return false
+	}
+	defer spool.Close()
+
+	if key.password == nil {
+		return true
+	}
+
+	header, reader, err := crypt.ReadHeader(spool)
+	if err != nil || header == nil {
+		return false
+	}
+
+	_, err = crypt.NewDecrypter(reader, header, key.password, key.keyFile)
+	return err == nil
+}
+
+// findUpload returns the interrupted upload that key continues, if any, and
+// forgets uploads that can no longer be finished, aborting their sessions.
+func findUpload(ctx context.Context, client storage.ResumableClient, key *resumeKey) (*pendingUpload, error) {
+	var found *pendingUpload
+	var dropped []*pendingUpload
+	err := updateUploads(func(uploads []*pendingUpload) []*pendingUpload {
+		var kept []*pendingUpload
+		for _, upload := range uploads {
+			if time.Since(upload.Created) > maxUploadAge {
+				dropped = append(dropped, upload)
+				continue
+			}
+
+			if upload.Fingerprint == key.fingerprint {
+				// The same files copied with another password supersede it.
+				if found != nil || !key.unlocks(upload) {
+					dropped = append(dropped, upload)
+					continue
+				}
+
+				found = upload
+			}
+
+			kept = append(kept, upload)
+		}
+
+		return kept
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, upload := range dropped {
+		abortUpload(ctx, client, upload)
+	}
+
+	return found, nil
+}
+
+// contextWriter fails once ctx is done, to stop packing a cancelled copy.
+type contextWriter struct {
+	ctx context.Context
+	io.Writer
+}
+
+func (writer contextWriter) Write(buf []byte) (int, error) {
+	if err := writer.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return writer.Writer.Write(buf)
+}
+
+func uploadResumable(ctx context.Context, client storage.ResumableClient, entries []entry, compression string, options storage.UploadOptions, key *resumeKey, newEncrypter func(io.Writer) (io.WriteCloser, error)) (ownedStash, error) {
+	if key != nil {
+		upload, err := findUpload(ctx, client, key)
+		if err != nil {
+			return ownedStash{}, err
+		}
+
+		if upload != nil {
+			log.Info("Resume interrupted upload.")
+			return finishUpload(ctx, client, upload)
+		}
+	}
+
+	directory, err := getSpoolPath()
+	if err != nil {
+		return ownedStash{}, err
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return ownedStash{}, err
+	}
+
+	log.Debug("Spool.")
+	spool, err := ioutil.TempFile(directory, "upload-")
+	if err != nil {
+		return ownedStash{}, err
+	}
+
+	err = writeEntries(contextWriter{ctx, spool}, entries, compression, newEncrypter)
+	size, _ := spool.Seek(0, io.SeekCurrent)
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+
+	var session, token string
+	if err == nil {
+		session, token, err = client.StartSession(ctx, options)
+	}
+
+	if err != nil {
+		os.Remove(spool.Name())
+		return ownedStash{}, err
+	}
+
+	upload := &pendingUpload{Session: session, Token: token, Spool: spool.Name(), Size: size, Created: time.Now()}
+	if key != nil {
+		upload.Fingerprint = key.fingerprint
+		err := updateUploads(func(uploads []*pendingUpload) []*pendingUpload {
+			return append(uploads, upload)
+		})
+
+		if err != nil {
+			abortUpload(ctx, client, upload)
+			os.Remove(spool.Name())
+			return ownedStash{}, err
+		}
+	}
+
+	return finishUpload(ctx, client, upload)
+}
+
+// finishUpload uploads the rest of upload. An upload interrupted by a
+// transient failure stays recorded, if it was, to resume later; any other
+// that fails is discarded, along with its session.
+func finishUpload(ctx context.Context, client storage.ResumableClient, upload *pendingUpload) (ownedStash, error) {
+	spool, err := os.Open(upload.Spool)
+	if err != nil {
+		return ownedStash{}, err
+	}
+
+	log.Debug("Upload.")
+	id, err := storage.ResumeUpload(ctx, client, upload.Session, spool, upload.Size, func(offset int64) {
+		log.Debugf("Uploaded %d of %d bytes.", offset, upload.Size)
+	})
+
+	spool.Close()
+	if err != nil && upload.Fingerprint != "" && storage.IsTransient(err) && ctx.Err() == nil {
+		return ownedStash{}, errors.Wrap(err, "upload interrupted, copy again to resume")
+	} else if err != nil {
+		abortUpload(ctx, client, upload)
+	}
+
+	if upload.Fingerprint == "" {
+		os.Remove(upload.Spool)
+	} else if forgetErr := forgetUpload(upload); forgetErr != nil {
+		log.Debugf("Failed to forget upload: %s", forgetErr)
+	}
+
+	return ownedStash{ID: id, Token: upload.Token}, err
+}
+
+// abortUpload discards the session of an upload that is not kept to resume,
+// with a little time of its own in case ctx is done.
+func abortUpload(ctx context.Context, client storage.ResumableClient, upload *pendingUpload) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+
+	log.Debug("Abort upload.")
+	if err := client.AbortSession(ctx, upload.Session); err != nil {
+		log.Debugf("Failed to abort upload: %s", err)
+	}
+}
+
+func forgetUpload(upload *pendingUpload) error {
+	return updateUploads(func(uploads []*pendingUpload) []*pendingUpload {
+		var kept []*pendingUpload
+		for _, other := range uploads {
+			if other.Session != upload.Session {
+				kept = append(kept, other)
+			}
+		}
+
+		return kept
+	})
+}
+
+// downloadStash reads the stash with the given ID, resuming an interrupted
+// download where the client supports it.
+func downloadStash(ctx context.Context, client storage.Client, id string) io.ReadCloser {
+	if resumable, ok := client.(storage.ResumableClient); ok {
+		return storage.NewResumingReader(ctx, resumable, id)
+	}
+
+	return client.Download(ctx, id)
+}
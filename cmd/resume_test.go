@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/schmich/stash/crypt"
+	"github.com/schmich/stash/storage"
+)
+
+func TestSupersededUploadsAborted(t *testing.T) {
+	homedir.DisableCache = true
+	t.Setenv("HOME", t.TempDir())
+
+	ctx := context.Background()
+	client := storage.NewInMemoryClient()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	password := []byte("password")
+	options := crypt.Options{Compression: crypt.CompressionGzip, KDFCost: 1}
+	prepared := options
+	entries, err := prepareCopy(ctx, []string{path}, "", &prepared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := newResumeKey(entries, "", stashLimits{}, password, prepared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An interrupted copy of the same file with another password, and an
+	// interrupted copy too old to finish.
+	var pending []*pendingUpload
+	for _, created := range []time.Time{time.Now(), time.Now().Add(-2 * maxUploadAge)} {
+		session, token, err := client.StartSession(ctx, storage.UploadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spool := filepath.Join(t.TempDir(), "spool")
+		if err := ioutil.WriteFile(spool, []byte("another password"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		pending = append(pending, &pendingUpload{Fingerprint: key.fingerprint, Session: session, Token: token, Spool: spool, Size: 16, Created: created})
+	}
+
+	if err := saveUploads(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runCopy(ctx, client, password, options, stashLimits{}, []string{path}, "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, upload := range pending {
+		if _, err := client.SessionOffset(ctx, upload.Session); err == nil {
+			t.Errorf("session of superseded upload still open")
+		}
+
+		if _, err := os.Stat(upload.Spool); !os.IsNotExist(err) {
+			t.Errorf("spool of superseded upload left: %v", err)
+		}
+	}
+
+	if uploads, err := loadUploads(); err != nil || len(uploads) != 0 {
+		t.Errorf("uploads left: %v, %v", uploads, err)
+	}
+}
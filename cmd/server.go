@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/schmich/stash/server"
+	"github.com/schmich/stash/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// sweepInterval is how often the server purges expired stashes.
+const sweepInterval = time.Hour
+
+// Connections have a deadline to send their headers and while idle, but not
+// to transfer a stash, which takes long over a slow link.
+const (
+	readHeaderTimeout = 10 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// runServer serves the stashes in client, refusing ones larger than maxSize
+// bytes if it is set.
+func runServer(client storage.Client, address string, certFile string, keyFile string, allowList bool, maxSize int64) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	if sweeper, ok := client.(storage.Sweeper); ok {
+		go sweepPeriodically(sweeper)
+	}
+
+	handler := server.New(client)
+	handler.AllowList = allowList
+	handler.MaxStashSize = maxSize
+
+	httpServer := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+
+	log.Infof("Server listening on %s.", listener.Addr())
+	if certFile != "" || keyFile != "" {
+		return httpServer.ServeTLS(listener, certFile, keyFile)
+	}
+
+	return httpServer.Serve(listener)
+}
+
+func sweepPeriodically(sweeper storage.Sweeper) {
+	for {
+		count, err := sweeper.Sweep()
+		if err != nil {
+			log.Warnf("Warning: failed to purge expired stashes: %s", err)
+		} else if count > 0 {
+			log.Infof("Purged %d expired stash(es).", count)
+		}
+
+		time.Sleep(sweepInterval)
+	}
+}
+
+// runSweep purges expired stashes from storage that leaves it to clients.
+func runSweep(client storage.Client) (int, error) {
+	sweeper, ok := client.(storage.Sweeper)
+	if !ok {
+		return 0, errors.New("this storage purges expired stashes itself")
+	}
+
+	return sweeper.Sweep()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/schmich/stash/crypt"
+	"github.com/schmich/stash/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+const maxShareLength = 64 * 1024
+
+// share is the content of a share stash: one share of the key for the split
+// stash with ID Payload.
+type share struct {
+	Payload   string `json:"payload"`
+	Threshold int    `json:"threshold"`
+	Share     []byte `json:"share"`
+}
+
+// parseSplit reads a split such as "3-of-5".
+func parseSplit(spec string) (int, int, error) {
+	var threshold, count int
+	if _, err := fmt.Sscanf(spec, "%d-of-%d", &threshold, &count); err != nil || fmt.Sprintf("%d-of-%d", threshold, count) != spec {
+		return 0, 0, fmt.Errorf("invalid split \"%s\", expected T-of-N", spec)
+	}
+
+	if threshold < 2 || threshold > count || count > crypt.MaxShares {
+		return 0, 0, fmt.Errorf("invalid split \"%s\", expected 2 <= T <= N <= %d", spec, crypt.MaxShares)
+	}
+
+	return threshold, count, nil
+}
+
+// runSplitCopy uploads a stash whose key is split into count share stashes,
+// each encrypted with password or options.Recipients. It returns the shares,
+// then the stash they unlock.
+func runSplitCopy(ctx context.Context, client storage.Client, password []byte, options crypt.Options, limits stashLimits, paths []string, message string, threshold, count int) ([]ownedStash, ownedStash, error) {
+	entries, err := prepareCopy(ctx, paths, message, &options)
+	if err != nil {
+		return nil, ownedStash{}, err
+	}
+
+	// The split stash is only encrypted with its shares.
+	payloadOptions := options
+	payloadOptions.Recipients = nil
+	payloadOptions.KeyFile = nil
+
+	var shares [][]byte
+	upload := newUploadOptions(limits)
+	payload, err := uploadEntries(ctx, client, entries, options.Compression, upload, nil, func(writer io.Writer) (io.WriteCloser, error) {
+		encrypter, splitShares, err := crypt.NewSplitEncrypter(writer, threshold, count, payloadOptions)
+		shares = splitShares
+		return encrypter, err
+	})
+	if err != nil {
+		return nil, ownedStash{}, err
+	}
+
+	log.Debugf("Split stash %s.", payload.ID)
+
+	shareOptions := options
+	shareOptions.Compression = crypt.CompressionNone
+	shareOptions.Metadata = nil
+	shareOptions.Share = true
+
+	var owned []ownedStash
+	for _, value := range shares {
+		content, err := json.Marshal(&share{Payload: payload.ID, Threshold: threshold, Share: value})
+		if err != nil {
+			return nil, ownedStash{}, err
+		}
+
+		stash, err := uploadShare(ctx, client, upload, content, password, shareOptions)
+		if err != nil {
+			return nil, ownedStash{}, err
+		}
+
+		owned = append(owned, stash)
+	}
+
+	return owned, payload, nil
+}
+
+// uploadShare uploads a share stash with content, encrypted with password or
+// options.Recipients.
+func uploadShare(ctx context.Context, client storage.Client, upload storage.UploadOptions, content []byte, password []byte, options crypt.Options) (ownedStash, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	uploader := client.Upload(ctx, upload)
+	encrypter := crypt.NewEncrypter(uploader, password, options)
+	_, err := encrypter.Write(content)
+	if err == nil {
+		err = encrypter.Close()
+	}
+
+	if err != nil {
+		cancel()
+		uploader.Close()
+		return ownedStash{}, err
+	}
+
+	if err := uploader.Close(); err != nil {
+		return ownedStash{}, err
+	}
+
+	return ownedStash{ID: uploader.GetID(), Token: uploader.GetToken()}, nil
+}
+
+// rememberPassword asks getPassword once, for unlocking several shares.
+func rememberPassword(getPassword func() ([]byte, error)) func() ([]byte, error) {
+	var password []byte
+	return func() ([]byte, error) {
+		if password != nil {
+			return password, nil
+		}
+
+		var err error
+		password, err = getPassword()
+		return password, err
+	}
+}
+
+func readShare(ctx context.Context, client storage.Client, id string, getPassword func() ([]byte, error), keyFile []byte) (*share, error) {
+	log.Debugf("Download share %s.", id)
+	downloader := downloadStash(ctx, client, id)
+	defer downloader.Close()
+
+	header, decrypter, err := openStash(downloader, getPassword, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if header == nil || !header.Share {
+		return nil, fmt.Errorf("stash %s is not a share", id)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(decrypter, maxShareLength))
+	if err != nil {
+		return nil, err
+	}
+
+	var share share
+	if err := json.Unmarshal(content, &share); err != nil {
+		return nil, errors.Wrapf(err, "read share %s", id)
+	}
+
+	return &share, nil
+}
+
+// openShares reads the shares with the given IDs and opens the split stash
+// they belong to.
+func openShares(ctx context.Context, client storage.Client, ids []string, getPassword func() ([]byte, error), keyFile []byte) (*crypt.Header, *crypt.Decrypter, io.Closer, error) {
+	getPassword = rememberPassword(getPassword)
+
+	var payload string
+	var shares [][]byte
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			return nil, nil, nil, fmt.Errorf("share %s is given more than once", id)
+		}
+		seen[id] = true
+
+		share, err := readShare(ctx, client, id, getPassword, keyFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if payload != "" && share.Payload != payload {
+			return nil, nil, nil, fmt.Errorf("share %s belongs to a different stash", id)
+		}
+
+		if len(ids) < share.Threshold {
+			return nil, nil, nil, fmt.Errorf("stash is split, paste %d of its share IDs together", share.Threshold)
+		}
+
+		payload = share.Payload
+		shares = append(shares, share.Share)
+	}
+
+	log.Debugf("Download split stash %s.", payload)
+	downloader := downloadStash(ctx, client, payload)
+	header, reader, err := crypt.ReadHeader(downloader)
+	if err == nil && (header == nil || header.Split == nil) {
+		err = fmt.Errorf("stash %s is not split", payload)
+	}
+
+	if err != nil {
+		downloader.Close()
+		return nil, nil, nil, err
+	}
+
+	logHeader(header)
+	decrypter, err := crypt.NewSplitDecrypter(reader, header, shares)
+	if err != nil {
+		downloader.Close()
+		return nil, nil, nil, err
+	}
+
+	return header, decrypter, downloader, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/schmich/stash/crypt"
+	"github.com/schmich/stash/identifier"
+	"github.com/schmich/stash/relay"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	codeWords          = 2
+	maxNameplate       = 1000
+	maxNameplateClaims = 5
+)
+
+// newCode returns a transfer code: a nameplate to meet at on the relay, then
+// words known only to the sender and receiver.
+func newCode() (string, string, error) {
+	value, err := rand.Int(rand.Reader, big.NewInt(maxNameplate-1))
+	if err != nil {
+		return "", "", err
+	}
+
+	words, err := identifier.NewSecret(codeWords)
+	if err != nil {
+		return "", "", err
+	}
+
+	nameplate := fmt.Sprintf("%d", value.Int64()+1)
+	return nameplate, nameplate + "-" + strings.Replace(words, " ", "-", -1), nil
+}
+
+func claimNameplate(address string) (*relay.Conn, string, error) {
+	for attempt := 1; ; attempt++ {
+		nameplate, code, err := newCode()
+		if err != nil {
+			return nil, "", err
+		}
+
+		conn, err := relay.Dial(address, relay.RoleSend, nameplate)
+		if err == relay.ErrNameplateInUse && attempt < maxNameplateClaims {
+			log.Debugf("Nameplate %s is in use.", nameplate)
+			continue
+		}
+
+		return conn, code, err
+	}
+}
+
+func runSend(address string, paths []string) error {
+	// files -> pack -> compress -> PAKE session -> relay
+
+	entries, err := collect(context.Background(), paths)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Connect to relay %s.", address)
+	conn, code, err := claimNameplate(address)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	log.Infof("Code: %s", code)
+	log.Info("Waiting for receiver.")
+	if err := conn.Wait(); err != nil {
+		return err
+	}
+
+	key, err := crypt.Handshake(conn, []byte(code), true)
+	if err != nil {
+		return err
+	}
+
+	encrypter, err := crypt.NewSessionEncrypter(conn, key)
+	if err != nil {
+		return err
+	}
+
+	compressor, err := gzip.NewWriterLevel(encrypter, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+
+	if err := pack(entries, compressor); err != nil {
+		return err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+
+	if err := encrypter.Close(); err != nil {
+		return err
+	}
+
+	// Wait for the receiver to finish and hang up, so the transfer is known
+	// to be complete.
+	if tcp, ok := conn.Conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		return err
+	}
+
+	log.Info("Sent.")
+	return nil
+}
+
+func runReceive(address, code string) error {
+	// relay -> PAKE session -> decompress -> unpack -> files
+
+	separator := strings.Index(code, "-")
+	if separator < 1 || separator == len(code)-1 {
+		return errors.New("invalid code, expected nameplate-words")
+	}
+
+	log.Debugf("Connect to relay %s.", address)
+	conn, err := relay.Dial(address, relay.RoleReceive, code[:separator])
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if err := conn.Wait(); err != nil {
+		return err
+	}
+
+	key, err := crypt.Handshake(conn, []byte(code), false)
+	if err != nil {
+		return err
+	}
+
+	decrypter, err := crypt.NewSessionDecrypter(conn, key)
+	if err != nil {
+		return err
+	}
+
+	decompressor, err := gzip.NewReader(decrypter)
+	if err != nil {
+		return err
+	}
+
+	var unpacked unpacked
+	if err := unpack(decompressor, &unpacked); err != nil {
+		unpacked.remove()
+		return err
+	}
+
+	// Read through to the end so the final segment is authenticated.
+	if _, err := io.Copy(ioutil.Discard, decompressor); err != nil {
+		unpacked.remove()
+		return err
+	}
+
+	return nil
+}
+
+func runRelay(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Relay listening on %s.", listener.Addr())
+	return relay.New().Serve(listener)
+}
@@ -5,22 +5,35 @@ import (
 	"encoding/base64"
 	"io"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/flowup/cloudfunc/api"
 	"github.com/schmich/stash/identifier"
+	"github.com/schmich/stash/owner"
+	"github.com/schmich/stash/signer"
 )
 
 type CopyRequest struct {
-	Payload string `json:"payload"`
+	Payload   string `json:"payload"`
+	Stream    bool   `json:"stream,omitempty"`
+	Resumable bool   `json:"resumable,omitempty"`
+
+	// Expires is when the stash expires, in RFC 3339 format, if it does. It
+	// is kept in the object's metadata.
+	Expires string `json:"expires,omitempty"`
 }
 
 type CopyResponse struct {
-	ID    string `json:"id,omitempty"`
-	Error string `json:"error,omitempty"`
+	ID      string            `json:"id,omitempty"`
+	Token   string            `json:"token,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Error   string            `json:"error,omitempty"`
 }
 
-func store(encodedPayload string) (string, error) {
+// store keeps the stash, owned by the token with the given hash.
+func store(encodedPayload string, expires string, ownerHash string) (string, error) {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
 	if err != nil {
@@ -38,6 +51,11 @@ func store(encodedPayload string) (string, error) {
 	obj := bucket.Object(id)
 
 	writer := obj.NewWriter(ctx)
+	writer.Metadata = map[string]string{"owner": ownerHash}
+	if expires != "" {
+		writer.Metadata["expires"] = expires
+	}
+
 	reader := base64.NewDecoder(base64.StdEncoding, strings.NewReader(encodedPayload))
 	if _, err := io.Copy(writer, reader); err != nil {
 		return "", err
@@ -50,25 +68,84 @@ func store(encodedPayload string) (string, error) {
 	return id, nil
 }
 
-func run(function *api.CloudFunc) (string, error) {
+// signUpload returns a new ID and a signed URL for uploading the stash
+// directly to storage, so it never passes through the function. A resumable
+// upload starts a GCS resumable session with the URL instead.
+func signUpload(resumable bool, expires string, ownerHash string) (*CopyResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	id, err := identifier.New()
+	if err != nil {
+		return nil, err
+	}
+
+	// The upload fails rather than overwrite an existing stash.
+	conditions := map[string]string{"x-goog-if-generation-match": "0", "x-goog-meta-owner": ownerHash}
+	if expires != "" {
+		conditions["x-goog-meta-expires"] = expires
+	}
+
+	method := "PUT"
+	if resumable {
+		conditions["x-goog-resumable"] = "start"
+		method = "POST"
+	}
+
+	url, headers, err := signer.SignedURL(ctx, "stash-215008", id, method, conditions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CopyResponse{ID: id, URL: url, Headers: headers}, nil
+}
+
+func run(function *api.CloudFunc) (*CopyResponse, error) {
 	req, err := function.GetRequest()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var input CopyRequest
 	if err = req.BindBody(&input); err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if input.Expires != "" {
+		if _, err := time.Parse(time.RFC3339, input.Expires); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only the token's hash is kept with the stash.
+	token, err := owner.NewToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if input.Stream {
+		response, err := signUpload(input.Resumable, input.Expires, owner.Hash(token))
+		if err != nil {
+			return nil, err
+		}
+
+		response.Token = token
+		return response, nil
+	}
+
+	id, err := store(input.Payload, input.Expires, owner.Hash(token))
+	if err != nil {
+		return nil, err
 	}
 
-	return store(input.Payload)
+	return &CopyResponse{ID: id, Token: token}, nil
 }
 
 func main() {
 	function := api.NewCloudFunc()
-	id, err := run(function)
+	response, err := run(function)
 	if err == nil {
-		function.SendResponse(&CopyResponse{ID: id})
+		function.SendResponse(response)
 	} else {
 		function.SendResponse(&CopyResponse{Error: err.Error()})
 	}
@@ -0,0 +1,408 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The age v1 file format (https://age-encryption.org/v1), so that stashes
+// can also be decrypted with the age tool.
+
+const (
+	ageIntro       = "age-encryption.org/v1\n"
+	ageFileKeySize = 16
+	ageColumns     = 64
+
+	// ageMaxLogN bounds scrypt to the memory of MaxKDFCost.
+	ageMaxLogN = 20
+)
+
+var ageEncoding = base64.RawStdEncoding
+
+type ageStanza struct {
+	Type string
+	Args []string
+	Body []byte
+}
+
+type ageHeader struct {
+	stanzas []ageStanza
+
+	// Everything up to and including "---", covered by the MAC.
+	raw []byte
+	mac []byte
+}
+
+func ageKey(secret, salt []byte, info string, size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func ageSeal(key, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil), nil
+}
+
+func ageOpen(key, body []byte) ([]byte, bool) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, false
+	}
+
+	fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), body, nil)
+	if err != nil || len(fileKey) != ageFileKeySize {
+		return nil, false
+	}
+
+	return fileKey, true
+}
+
+// ageLogN returns the scrypt work factor using about cost MiB of memory.
+func ageLogN(cost int) int {
+	if cost == 0 {
+		cost = DefaultKDFCost
+	}
+
+	// scrypt with r = 8 uses 1 KiB per unit of N.
+	return bits.Len(uint(cost*1024)) - 1
+}
+
+func ageScryptKey(password, salt []byte, logN int) ([]byte, error) {
+	return scrypt.Key(password, append([]byte("age-encryption.org/v1/scrypt"), salt...), 1<<uint(logN), 8, 1, chacha20poly1305.KeySize)
+}
+
+func newAgeScryptStanza(password, fileKey []byte, cost int) (*ageStanza, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	logN := ageLogN(cost)
+	key, err := ageScryptKey(password, salt, logN)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ageSeal(key, fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ageStanza{
+		Type: "scrypt",
+		Args: []string{ageEncoding.EncodeToString(salt), strconv.Itoa(logN)},
+		Body: body,
+	}, nil
+}
+
+func newAgeX25519Stanza(recipient *Recipient, fileKey []byte) (*ageStanza, error) {
+	var ephemeral, share, shared [32]byte
+	if _, err := io.ReadFull(rand.Reader, ephemeral[:]); err != nil {
+		return nil, err
+	}
+
+	curve25519.ScalarBaseMult(&share, &ephemeral)
+	curve25519.ScalarMult(&shared, &ephemeral, &recipient.key)
+
+	var zero [32]byte
+	if bytes.Equal(shared[:], zero[:]) {
+		return nil, errors.New("invalid X25519 shared secret")
+	}
+
+	salt := append(append([]byte{}, share[:]...), recipient.key[:]...)
+	key, err := ageKey(shared[:], salt, "age-encryption.org/v1/X25519", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ageSeal(key, fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ageStanza{
+		Type: "X25519",
+		Args: []string{ageEncoding.EncodeToString(share[:])},
+		Body: body,
+	}, nil
+}
+
+func (stanza *ageStanza) unwrapScrypt(password []byte) ([]byte, bool, error) {
+	if len(stanza.Args) != 2 {
+		return nil, false, ErrIntegrity
+	}
+
+	salt, err := ageEncoding.DecodeString(stanza.Args[0])
+	if err != nil || len(salt) != 16 {
+		return nil, false, ErrIntegrity
+	}
+
+	logN, err := strconv.Atoi(stanza.Args[1])
+	if err != nil || logN <= 0 || logN > ageMaxLogN {
+		return nil, false, ErrIntegrity
+	}
+
+	key, err := ageScryptKey(password, salt, logN)
+	if err != nil {
+		return nil, false, err
+	}
+
+	fileKey, ok := ageOpen(key, stanza.Body)
+	return fileKey, ok, nil
+}
+
+func (stanza *ageStanza) unwrapX25519(identity *Identity) ([]byte, bool) {
+	if len(stanza.Args) != 1 {
+		return nil, false
+	}
+
+	share, err := ageEncoding.DecodeString(stanza.Args[0])
+	if err != nil || len(share) != 32 {
+		return nil, false
+	}
+
+	var ephemeral, shared [32]byte
+	copy(ephemeral[:], share)
+	curve25519.ScalarMult(&shared, &identity.secret, &ephemeral)
+
+	var zero [32]byte
+	if bytes.Equal(shared[:], zero[:]) {
+		return nil, false
+	}
+
+	recipient := identity.Recipient()
+	salt := append(append([]byte{}, share...), recipient.key[:]...)
+	key, err := ageKey(shared[:], salt, "age-encryption.org/v1/X25519", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, false
+	}
+
+	return ageOpen(key, stanza.Body)
+}
+
+func newAgeHeader(password []byte, options Options) (*Header, []byte, error) {
+	fileKey := make([]byte, ageFileKeySize)
+	if _, err := io.ReadFull(rand.Reader, fileKey); err != nil {
+		return nil, nil, err
+	}
+
+	age := &ageHeader{}
+	if len(options.Recipients) == 0 {
+		stanza, err := newAgeScryptStanza(password, fileKey, options.KDFCost)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		age.stanzas = append(age.stanzas, *stanza)
+	}
+
+	for _, recipient := range options.Recipients {
+		stanza, err := newAgeX25519Stanza(recipient, fileKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		age.stanzas = append(age.stanzas, *stanza)
+	}
+
+	return &Header{Format: FormatAge, Compression: CompressionGzip, age: age}, fileKey, nil
+}
+
+func (header *ageHeader) encode(fileKey []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(ageIntro)
+	for _, stanza := range header.stanzas {
+		buffer.WriteString("-> " + stanza.Type)
+		for _, arg := range stanza.Args {
+			buffer.WriteString(" " + arg)
+		}
+		buffer.WriteString("\n")
+
+		// The body is wrapped at 64 columns, and always ends with a
+		// shorter line, which may be empty.
+		body := ageEncoding.EncodeToString(stanza.Body)
+		for len(body) >= ageColumns {
+			buffer.WriteString(body[:ageColumns] + "\n")
+			body = body[ageColumns:]
+		}
+		buffer.WriteString(body + "\n")
+	}
+	buffer.WriteString("---")
+	header.raw = append([]byte{}, buffer.Bytes()...)
+
+	key, err := ageKey(fileKey, nil, "header", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header.raw)
+	header.mac = mac.Sum(nil)
+
+	buffer.WriteString(" " + ageEncoding.EncodeToString(header.mac) + "\n")
+	return buffer.Bytes(), nil
+}
+
+func readAgeLine(reader *bufio.Reader, raw *bytes.Buffer) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", ErrIntegrity
+	}
+
+	if raw.Len()+len(line) > maxHeaderLength {
+		return "", ErrIntegrity
+	}
+
+	raw.WriteString(line)
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+func readAgeHeader(reader *bufio.Reader) (*ageHeader, error) {
+	var raw bytes.Buffer
+	intro, err := readAgeLine(reader, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if intro+"\n" != ageIntro {
+		return nil, fmt.Errorf("unsupported age format \"%s\"", intro)
+	}
+
+	header := &ageHeader{}
+	for {
+		line, err := readAgeLine(reader, &raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(line, "--- ") {
+			mac, err := ageEncoding.DecodeString(line[4:])
+			if err != nil || len(mac) != sha256.Size {
+				return nil, ErrIntegrity
+			}
+
+			// The MAC covers the header up to "---", not the space after it.
+			header.raw = raw.Bytes()[:raw.Len()-len(line)-1+3]
+			header.mac = mac
+			return header, nil
+		}
+
+		if !strings.HasPrefix(line, "-> ") {
+			return nil, ErrIntegrity
+		}
+
+		fields := strings.Split(line[3:], " ")
+		stanza := ageStanza{Type: fields[0], Args: fields[1:]}
+
+		var body strings.Builder
+		for {
+			line, err := readAgeLine(reader, &raw)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(line) > ageColumns {
+				return nil, ErrIntegrity
+			}
+
+			body.WriteString(line)
+			if len(line) < ageColumns {
+				break
+			}
+		}
+
+		if stanza.Body, err = ageEncoding.DecodeString(body.String()); err != nil {
+			return nil, ErrIntegrity
+		}
+
+		header.stanzas = append(header.stanzas, stanza)
+	}
+}
+
+func writeAgePayload(writer io.Writer, header *Header, fileKey []byte) (io.WriteCloser, error) {
+	encoded, err := header.age.encode(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	aead, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write(encoded); err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write(nonce); err != nil {
+		return nil, err
+	}
+
+	return newSegmentWriter(aead, nil, writer), nil
+}
+
+// readAgePayload returns ErrIntegrity if the header MAC does not match fileKey.
+func readAgePayload(reader io.Reader, header *Header, fileKey []byte) (*Decrypter, error) {
+	key, err := ageKey(fileKey, nil, "header", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header.age.raw)
+	if !hmac.Equal(mac.Sum(nil), header.age.mac) {
+		return nil, ErrIntegrity
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(reader, nonce); err != nil {
+		return nil, ErrIntegrity
+	}
+
+	aead, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// age STREAM nonces are an 11-byte counter and a final flag, which
+	// matches the segment layout for counters below 2^64.
+	return &Decrypter{Reader: newSegmentReader(aead, nil, reader)}, nil
+}
+
+func agePayloadAEAD(fileKey, nonce []byte) (cipher.AEAD, error) {
+	key, err := ageKey(fileKey, nonce, "payload", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.New(key)
+}
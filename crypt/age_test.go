@@ -0,0 +1,119 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+)
+
+// Files encrypted by the reference age implementation, filippo.io/age.
+const (
+	ageTestPlaintext = "stash age known answer\n"
+	ageTestIdentity  = "AGE-SECRET-KEY-13HUDD0FTTNLXCFPPHS56GFMWHAJCPWVMA355ATFWZJT24VU9YUCQURXN09"
+	ageTestPassword  = "correct horse"
+
+	ageTestX25519File = "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBIWG90WVhzOGZHQVV5OGtFSnM0Y2Z4MUtEZkRmbUVGclZhekFOMzdWT21zCkRJUzE3dU9zb1pJNzE5Vk92VVE1SWRtcWVCVkhEMkl3L3pud0xKcjQwQ2cKLS0tIC8yVm9DNWlSUWlhS29Lb3BMRFRILzhFTDhLSVprT3NDdFBwSTdzSE1ESk0K8Zibqg4ciT9FWROeMgpP1HnksgoBjENVXoRTgjOQbNfcqoLt27e6iQhhrUgdMUPHSB2+F3jB7A=="
+	ageTestScryptFile = "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IHNjcnlwdCArMmNiczVRUmZaS1NpNDdSQUhmN0xRIDEwCkVMTXEwR2ErbkU1RnM5TCszUHRnMjFJM3d5WWc0eUZtV2FJOEd5TzR0TE0KLS0tIExJd0pQN1l4eEFGL0ViTUV1YzJueXRLZ090bDdUSVBmN3FDdWRRWjZuLzgKtNjVNI85RD8oiIGEBgfhtMGmHPQDx5QAS+PdGKcDrs252dy+cNs2DB+dTFXecJJKS4mxQMJ31g=="
+)
+
+func TestAgeKnownAnswers(t *testing.T) {
+	identity, err := ParseIdentity(ageTestIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, reader, err := ReadHeader(bytes.NewReader(mustDecodeBase64(t, ageTestX25519File)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypter, err := NewIdentityDecrypter(reader, header, []*Identity{identity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plaintext, err := ioutil.ReadAll(decrypter); err != nil || string(plaintext) != ageTestPlaintext {
+		t.Errorf("X25519: got %q, %v", plaintext, err)
+	}
+
+	header, reader, err = ReadHeader(bytes.NewReader(mustDecodeBase64(t, ageTestScryptFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypter, err = NewDecrypter(reader, header, []byte(ageTestPassword), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plaintext, err := ioutil.ReadAll(decrypter); err != nil || string(plaintext) != ageTestPlaintext {
+		t.Errorf("scrypt: got %q, %v", plaintext, err)
+	}
+}
+
+func TestAgeWrongKeys(t *testing.T) {
+	other, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, reader, err := ReadHeader(bytes.NewReader(mustDecodeBase64(t, ageTestX25519File)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewIdentityDecrypter(reader, header, []*Identity{other}); err != ErrNoIdentity {
+		t.Errorf("other identity: got %v, want ErrNoIdentity", err)
+	}
+
+	header, reader, err = ReadHeader(bytes.NewReader(mustDecodeBase64(t, ageTestScryptFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDecrypter(reader, header, []byte("wrong"), nil); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := randomBytes(t, 3*segmentSize+100)
+	ciphertext := encrypt(t, plaintext, Options{Format: FormatAge, Recipients: []*Recipient{identity.Recipient()}})
+	header, reader, err := ReadHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypter, err := NewIdentityDecrypter(reader, header, []*Identity{identity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted, err := ioutil.ReadAll(decrypter); err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decrypted %d bytes, %v", len(decrypted), err)
+	}
+
+	ciphertext = encrypt(t, plaintext, Options{Format: FormatAge})
+	if decrypted, err := decrypt(ciphertext, testPassword); err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("scrypt: decrypted %d bytes, %v", len(decrypted), err)
+	}
+
+	if _, err := decrypt(ciphertext[:len(ciphertext)-1], testPassword); err != ErrIntegrity {
+		t.Errorf("truncated: got %v, want ErrIntegrity", err)
+	}
+}
+
+func mustDecodeBase64(t *testing.T, encoded string) []byte {
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
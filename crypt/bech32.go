@@ -0,0 +1,133 @@
+package crypt
+
+import (
+	"errors"
+	"strings"
+)
+
+// Bech32 (BIP 173) without the 90 character limit, as used by age for
+// encoding keys.
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Generator = []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, value := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(value)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= bech32Generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32ExpandHRP(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+func bech32Checksum(hrp string, data []byte) []byte {
+	values := append(bech32ExpandHRP(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	polymod := bech32Polymod(values) ^ 1
+
+	checksum := make([]byte, 6)
+	for i := range checksum {
+		checksum[i] = byte(polymod>>uint(5*(5-i))) & 31
+	}
+	return checksum
+}
+
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var converted []byte
+	acc, bits := uint32(0), uint(0)
+	maxv := uint32(1)<<to - 1
+
+	for _, value := range data {
+		if uint32(value)>>from != 0 {
+			return nil, errors.New("invalid data range")
+		}
+		acc = acc<<from | uint32(value)
+		bits += from
+		for bits >= to {
+			bits -= to
+			converted = append(converted, byte(acc>>bits&maxv))
+		}
+	}
+
+	if pad {
+		if bits > 0 {
+			converted = append(converted, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errors.New("invalid padding")
+	}
+
+	return converted, nil
+}
+
+func bech32Encode(hrp string, data []byte) (string, error) {
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+
+	lower := strings.ToLower(hrp)
+	var encoded strings.Builder
+	encoded.WriteString(lower)
+	encoded.WriteByte('1')
+	for _, value := range append(values, bech32Checksum(lower, values)...) {
+		encoded.WriteByte(bech32Charset[value])
+	}
+
+	if hrp != lower {
+		return strings.ToUpper(encoded.String()), nil
+	}
+
+	return encoded.String(), nil
+}
+
+func bech32Decode(encoded string) (string, []byte, error) {
+	if strings.ToLower(encoded) != encoded && strings.ToUpper(encoded) != encoded {
+		return "", nil, errors.New("mixed case")
+	}
+
+	encoded = strings.ToLower(encoded)
+	separator := strings.LastIndexByte(encoded, '1')
+	if separator < 1 || separator+7 > len(encoded) {
+		return "", nil, errors.New("invalid separator")
+	}
+
+	hrp := encoded[:separator]
+	values := make([]byte, 0, len(encoded)-separator-1)
+	for i := separator + 1; i < len(encoded); i++ {
+		value := strings.IndexByte(bech32Charset, encoded[i])
+		if value < 0 {
+			return "", nil, errors.New("invalid character")
+		}
+		values = append(values, byte(value))
+	}
+
+	if bech32Polymod(append(bech32ExpandHRP(hrp), values...)) != 1 {
+		return "", nil, errors.New("invalid checksum")
+	}
+
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return hrp, data, nil
+}
@@ -6,71 +6,307 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 
-	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/ed25519"
 )
 
-type nopCloser struct {
-	io.Writer
+type Options struct {
+	Format      string
+	Cipher      string
+	KDFCost     int
+	Compression string
+	Recipients  []*Recipient
+	SigningKey  *SigningKey
+	Metadata    []byte
+
+	// Padding hides the length of the stash. The default, PaddingAuto, pads
+	// small stashes to power-of-two buckets.
+	Padding string
+
+	// KeyFile is combined with the password, so that both are needed.
+	KeyFile []byte
+
+	// Share marks the stash as holding a share of a split stash.
+	Share bool
 }
 
-func (nopCloser) Close() error {
-	return nil
+// Decrypter reads the decrypted payload of a stash.
+type Decrypter struct {
+	io.Reader
+	metadata []byte
 }
 
-type encrypter struct {
-	createStream func() (*cipher.StreamWriter, error)
-	stream       *cipher.StreamWriter
+// Metadata returns the metadata stored with the stash, if any. It is
+// available before any of the payload is read.
+func (decrypter *Decrypter) Metadata() []byte {
+	return decrypter.metadata
 }
 
-type decrypter struct {
-	createStream func() (*cipher.StreamReader, error)
-	stream       *cipher.StreamReader
+type encrypter struct {
+	createStream func() (io.WriteCloser, error)
+	stream       io.WriteCloser
 }
 
-func NewEncrypter(writer io.Writer, password []byte) io.WriteCloser {
-	encrypter := &encrypter{}
+func newAEAD(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case CipherAES128GCM, CipherAES256GCM:
+		if (name == CipherAES128GCM) != (len(key) == 16) {
+			return nil, ErrIntegrity
+		}
 
-	encrypter.createStream = func() (*cipher.StreamWriter, error) {
-		salt := make([]byte, 64)
-		count, err := rand.Read(salt)
+		block, err := aes.NewCipher(key)
 		if err != nil {
 			return nil, err
 		}
 
-		if count != len(salt) {
-			return nil, errors.New("failed to generate salt")
+		return cipher.NewGCM(block)
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, fmt.Errorf("unsupported cipher \"%s\"", name)
+	}
+}
+
+// newBaseHeader returns a header for options without a key.
+func newBaseHeader(options Options) (*Header, error) {
+	name := options.Cipher
+	if name == "" {
+		name = CipherAES256GCM
+	}
+
+	if name != CipherAES256GCM && name != CipherXChaCha20Poly1305 {
+		return nil, fmt.Errorf("unsupported cipher \"%s\"", name)
+	}
+
+	compression := options.Compression
+	if compression == "" {
+		compression = CompressionGzip
+	}
+
+	header := &Header{
+		Format:      FormatStash,
+		Version:     formatVersion,
+		Cipher:      name,
+		Compression: compression,
+	}
+
+	if options.SigningKey != nil {
+		header.Signer = options.SigningKey.Signer().public
+	}
+
+	if err := checkPadding(options.Padding); err != nil {
+		return nil, err
+	}
+
+	header.Metadata = len(options.Metadata) > 0
+	header.Padded = options.Padding != PaddingNone
+	if header.Padded {
+		header.Padding = options.Padding
+		if header.Padding == "" {
+			header.Padding = PaddingAuto
 		}
+	}
 
-		key := pbkdf2.Key(password, salt, 10000, aes.BlockSize, sha256.New)
-		block, err := aes.NewCipher(key)
+	header.Share = options.Share
+	return header, nil
+}
+
+func newHeader(password []byte, options Options) (*Header, []byte, error) {
+	header, err := newBaseHeader(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(options.Recipients) == 0 {
+		kdf, err := newKDF(options.KDFCost)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		iv := make([]byte, aes.BlockSize)
-		count, err = rand.Read(iv)
+		master, err := deriveKey(kdf, withKeyFile(password, options.KeyFile))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		if count != len(iv) {
-			return nil, errors.New("failed to generate IV")
+		header.KDF = kdf
+		header.KeyFile = options.KeyFile != nil
+		return header, master, nil
+	}
+
+	if options.KeyFile != nil {
+		return nil, nil, errors.New("key files are only supported with a password")
+	}
+
+	master := make([]byte, keyLength)
+	if _, err := io.ReadFull(rand.Reader, master); err != nil {
+		return nil, nil, err
+	}
+
+	for _, recipient := range options.Recipients {
+		stanza, err := recipient.wrap(master)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		header.Recipients = append(header.Recipients, *stanza)
+	}
+
+	return header, master, nil
+}
+
+var errHeaderMAC = errors.New("header MAC mismatch")
+
+func writePayload(writer io.Writer, header *Header, master []byte, options Options) (io.WriteCloser, error) {
+	payloadKey, headerKey, err := expandKey(master)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(header.Cipher, payloadKey)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := header.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.New()
+	output := io.MultiWriter(writer, digest)
+
+	if _, err := output.Write(raw); err != nil {
+		return nil, err
+	}
+
+	if _, err := output.Write(header.sign(headerKey)); err != nil {
+		return nil, err
+	}
+
+	if header.Metadata {
+		metadata := options.Metadata
+		if header.Padded {
+			metadata = pad(PaddingBucket, metadata)
 		}
 
-		if _, err := writer.Write(salt); err != nil {
+		if err := writeMetadata(output, header, master, metadata); err != nil {
 			return nil, err
 		}
+	}
+
+	segments := newSegmentWriter(aead, raw, output)
+	if signingKey := options.SigningKey; signingKey != nil {
+		segments.finish = func() error {
+			_, err := writer.Write(signingKey.sign(digest.Sum(nil)))
+			return err
+		}
+	}
+
+	if header.Padded {
+		return newPaddingWriter(options.Padding, segments), nil
+	}
+
+	return segments, nil
+}
+
+// readPayload returns errHeaderMAC if the header MAC does not match master.
+func readPayload(reader io.Reader, header *Header, master []byte) (*Decrypter, error) {
+	payloadKey, headerKey, err := expandKey(master)
+	if err != nil {
+		return nil, err
+	}
+
+	if !header.verify(headerKey) {
+		return nil, errHeaderMAC
+	}
+
+	aead, err := newAEAD(header.Cipher, payloadKey)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.New()
+	digest.Write(header.raw)
+	digest.Write(header.mac)
 
-		if _, err := writer.Write(iv); err != nil {
+	decrypter := &Decrypter{}
+	if header.Metadata {
+		metadata, block, err := readMetadata(reader, header, master)
+		if err != nil {
 			return nil, err
 		}
 
-		return &cipher.StreamWriter{
-			S: cipher.NewOFB(block, iv),
-			W: &nopCloser{writer},
-		}, nil
+		if header.Padded {
+			if metadata, err = unpad(metadata); err != nil {
+				return nil, err
+			}
+		}
+
+		decrypter.metadata = metadata
+		digest.Write(block)
+	}
+
+	signer := header.SignedBy()
+	if signer == nil {
+		if len(header.Signer) != 0 {
+			return nil, ErrIntegrity
+		}
+
+		decrypter.Reader = newSegmentReader(aead, header.raw, reader)
+	} else {
+		verify := func(signature []byte) error {
+			return signer.verify(digest.Sum(nil), signature)
+		}
+
+		decrypter.Reader = newSegmentTrailerReader(aead, header.raw, reader, ed25519.SignatureSize, digest, verify)
+	}
+
+	if header.Padded {
+		decrypter.Reader = newPaddingReader(decrypter.Reader)
+	}
+
+	return decrypter, nil
+}
+
+// NewEncrypter encrypts to options.Recipients if there are any, otherwise
+// with a key derived from password.
+func NewEncrypter(writer io.Writer, password []byte, options Options) io.WriteCloser {
+	encrypter := &encrypter{}
+
+	encrypter.createStream = func() (io.WriteCloser, error) {
+		switch options.Format {
+		case "", FormatStash:
+			header, master, err := newHeader(password, options)
+			if err != nil {
+				return nil, err
+			}
+
+			return writePayload(writer, header, master, options)
+		case FormatAge:
+			if options.SigningKey != nil {
+				return nil, errors.New("signing is not supported with the age format")
+			}
+
+			if options.KeyFile != nil {
+				return nil, errors.New("key files are not supported with the age format")
+			}
+
+			if options.Padding == PaddingPadme || options.Padding == PaddingBucket {
+				return nil, errors.New("padding is not supported with the age format")
+			}
+
+			header, fileKey, err := newAgeHeader(password, options)
+			if err != nil {
+				return nil, err
+			}
+
+			return writeAgePayload(writer, header, fileKey)
+		default:
+			return nil, fmt.Errorf("unsupported format \"%s\"", options.Format)
+		}
 	}
 
 	return encrypter
@@ -93,41 +329,139 @@ func (encrypter *encrypter) Close() error {
 	return encrypter.stream.Close()
 }
 
-func NewDecrypter(reader io.Reader, password []byte) io.Reader {
-	decrypter := &decrypter{}
+// NewSplitEncrypter encrypts with a random key split into count shares, any
+// threshold of which decrypt the stash with NewSplitDecrypter.
+func NewSplitEncrypter(writer io.Writer, threshold, count int, options Options) (io.WriteCloser, [][]byte, error) {
+	if options.Format != "" && options.Format != FormatStash {
+		return nil, nil, errors.New("split stashes are only supported with the stash format")
+	}
 
-	decrypter.createStream = func() (*cipher.StreamReader, error) {
-		salt := make([]byte, 64)
-		if _, err := io.ReadFull(reader, salt); err != nil {
-			return nil, err
-		}
+	header, err := newBaseHeader(options)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		key := pbkdf2.Key(password, salt, 10000, aes.BlockSize, sha256.New)
-		block, err := aes.NewCipher(key)
-		if err != nil {
-			return nil, err
-		}
+	master := make([]byte, keyLength)
+	if _, err := io.ReadFull(rand.Reader, master); err != nil {
+		return nil, nil, err
+	}
 
-		iv := make([]byte, aes.BlockSize)
-		if _, err := io.ReadFull(reader, iv); err != nil {
-			return nil, err
+	shares, err := splitSecret(master, threshold, count)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header.Split = &Split{Threshold: threshold, Shares: count}
+	encrypter := &encrypter{
+		createStream: func() (io.WriteCloser, error) {
+			return writePayload(writer, header, master, options)
+		},
+	}
+
+	return encrypter, shares, nil
+}
+
+// NewSplitDecrypter decrypts a split stash with shares from
+// NewSplitEncrypter. ErrShareMismatch is returned if the shares are from a
+// different stash.
+func NewSplitDecrypter(reader io.Reader, header *Header, shares [][]byte) (*Decrypter, error) {
+	if header.Split == nil {
+		return nil, errors.New("stash is not split")
+	}
+
+	if len(shares) < header.Split.Threshold {
+		return nil, fmt.Errorf("stash needs %d shares, only %d given", header.Split.Threshold, len(shares))
+	}
+
+	master, err := combineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypter, err := readPayload(reader, header, master)
+	if err == errHeaderMAC {
+		return nil, ErrShareMismatch
+	}
+
+	return decrypter, err
+}
+
+// NewDecrypter checks password against the header returned by ReadHeader and
+// decrypts the payload that follows it. ErrIncorrectPassword is returned
+// before any of the payload is read if the password does not match. keyFile
+// is only used if the stash was encrypted with one, see Header.KeyFile.
+func NewDecrypter(reader io.Reader, header *Header, password, keyFile []byte) (*Decrypter, error) {
+	if !header.PasswordProtected() {
+		return nil, errors.New("stash is not password-protected")
+	}
+
+	if header.KeyFile && keyFile == nil {
+		return nil, ErrKeyFileRequired
+	} else if !header.KeyFile {
+		keyFile = nil
+	}
+
+	if header.Format == FormatAge {
+		for _, stanza := range header.age.stanzas {
+			if stanza.Type != "scrypt" {
+				continue
+			}
+
+			fileKey, ok, err := stanza.unwrapScrypt(password)
+			if err != nil {
+				return nil, err
+			} else if !ok {
+				return nil, ErrIncorrectPassword
+			}
+
+			return readAgePayload(reader, header, fileKey)
 		}
+	}
+
+	master, err := deriveKey(header.KDF, withKeyFile(password, keyFile))
+	if err != nil {
+		return nil, err
+	}
 
-		return &cipher.StreamReader{
-			S: cipher.NewOFB(block, iv),
-			R: reader,
-		}, nil
+	decrypter, err := readPayload(reader, header, master)
+	if err == errHeaderMAC {
+		return nil, ErrIncorrectPassword
 	}
 
-	return decrypter
+	return decrypter, err
 }
 
-func (decrypter *decrypter) Read(buf []byte) (int, error) {
-	if decrypter.stream == nil {
-		var err error
-		if decrypter.stream, err = decrypter.createStream(); err != nil {
-			return 0, err
+// NewIdentityDecrypter decrypts the payload with the first identity the
+// stash is encrypted to, or returns ErrNoIdentity.
+func NewIdentityDecrypter(reader io.Reader, header *Header, identities []*Identity) (*Decrypter, error) {
+	if header.Format == FormatAge {
+		for _, identity := range identities {
+			for _, stanza := range header.age.stanzas {
+				if stanza.Type != "X25519" {
+					continue
+				}
+
+				if fileKey, ok := stanza.unwrapX25519(identity); ok {
+					return readAgePayload(reader, header, fileKey)
+				}
+			}
+		}
+
+		return nil, ErrNoIdentity
+	}
+
+	for _, identity := range identities {
+		for i := range header.Recipients {
+			if master, ok := identity.unwrap(&header.Recipients[i]); ok {
+				decrypter, err := readPayload(reader, header, master)
+				if err == errHeaderMAC {
+					return nil, ErrIntegrity
+				}
+
+				return decrypter, err
+			}
 		}
 	}
-	return decrypter.stream.Read(buf)
+
+	return nil, ErrNoIdentity
 }
@@ -0,0 +1,219 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	FormatStash = "stash"
+	FormatAge   = "age"
+
+	CipherAES128GCM         = "aes-128-gcm"
+	CipherAES256GCM         = "aes-256-gcm"
+	CipherXChaCha20Poly1305 = "xchacha20-poly1305"
+
+	KDFPBKDF2SHA256 = "pbkdf2-sha256"
+	KDFArgon2id     = "argon2id"
+
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+const formatVersion = 1
+
+const maxHeaderLength = 64 * 1024
+
+var magic = []byte("STASH")
+
+var ErrIncorrectPassword = errors.New("incorrect password")
+
+var ErrKeyFileRequired = errors.New("stash requires a key file")
+
+type KDF struct {
+	Name       string `json:"name"`
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations,omitempty"`
+	Memory     uint32 `json:"memory,omitempty"`
+	Threads    uint8  `json:"threads,omitempty"`
+	KeyLength  int    `json:"key_length"`
+}
+
+// Split stashes are decrypted with a key recovered from Threshold of Shares
+// other stashes.
+type Split struct {
+	Threshold int `json:"threshold"`
+	Shares    int `json:"shares"`
+}
+
+// Password-protected stashes derive their key with KDF. Otherwise, a random
+// key is wrapped for each of Recipients, or split into shares.
+type Header struct {
+	Format      string   `json:"-"`
+	Version     int      `json:"-"`
+	Cipher      string   `json:"cipher"`
+	KDF         *KDF     `json:"kdf,omitempty"`
+	KeyFile     bool     `json:"key_file,omitempty"`
+	Recipients  []Stanza `json:"recipients,omitempty"`
+	Split       *Split   `json:"split,omitempty"`
+	Share       bool     `json:"share,omitempty"`
+	Signer      []byte   `json:"signer,omitempty"`
+	Metadata    bool     `json:"metadata,omitempty"`
+	Padded      bool     `json:"padded,omitempty"`
+	Compression string   `json:"compression"`
+
+	// Padding is the mode a padded stash was padded with, so that it can be
+	// kept when the stash is encrypted again.
+	Padding string `json:"padding,omitempty"`
+
+	// Everything read or written before the MAC, authenticated alongside
+	// every payload segment.
+	raw []byte
+	mac []byte
+
+	age *ageHeader
+}
+
+// SignedBy returns the key the stash claims to be signed by, or nil if it is
+// unsigned. The claim is authenticated once the stash is unlocked, and the
+// signature itself is checked when the payload has been read to the end.
+func (header *Header) SignedBy() *Signer {
+	if len(header.Signer) != ed25519.PublicKeySize {
+		return nil
+	}
+
+	return &Signer{public: ed25519.PublicKey(header.Signer)}
+}
+
+// PasswordProtected reports whether the stash is decrypted with a password
+// rather than an identity.
+func (header *Header) PasswordProtected() bool {
+	if header.Format == FormatAge {
+		for _, stanza := range header.age.stanzas {
+			if stanza.Type == "scrypt" {
+				return true
+			}
+		}
+		return false
+	}
+
+	return header.KDF != nil
+}
+
+// expandKey splits the stash key into independent keys
+// for the payload and for the header MAC.
+func expandKey(master []byte) ([]byte, []byte, error) {
+	payloadKey := make([]byte, len(master))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("stash payload")), payloadKey); err != nil {
+		return nil, nil, err
+	}
+
+	headerKey := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("stash header")), headerKey); err != nil {
+		return nil, nil, err
+	}
+
+	return payloadKey, headerKey, nil
+}
+
+func (header *Header) sign(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header.raw)
+	header.mac = mac.Sum(nil)
+	return header.mac
+}
+
+// verify checks the header MAC, which only matches if the key was derived
+// from the correct password.
+func (header *Header) verify(key []byte) bool {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header.raw)
+	return hmac.Equal(mac.Sum(nil), header.mac)
+}
+
+func (header *Header) encode() ([]byte, error) {
+	content, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	buffer.Write(magic)
+	buffer.WriteByte(byte(header.Version))
+	binary.Write(&buffer, binary.BigEndian, uint32(len(content)))
+	buffer.Write(content)
+
+	header.raw = buffer.Bytes()
+	return header.raw, nil
+}
+
+// ReadHeader reads the stash or age header from reader. Legacy stashes have no
+// header, in which case the returned header is nil and the returned reader
+// yields the stash from its first byte.
+func ReadHeader(reader io.Reader) (*Header, io.Reader, error) {
+	prefix := make([]byte, len(magic)+1)
+	count, err := io.ReadFull(reader, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+
+	if count == len(prefix) && bytes.Equal(prefix, []byte(ageIntro[:len(prefix)])) {
+		buffered := bufio.NewReader(io.MultiReader(bytes.NewReader(prefix), reader))
+		age, err := readAgeHeader(buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &Header{Format: FormatAge, Compression: CompressionGzip, age: age}, buffered, nil
+	}
+
+	if count < len(prefix) || !bytes.Equal(prefix[:len(magic)], magic) {
+		return nil, io.MultiReader(bytes.NewReader(prefix[:count]), reader), nil
+	}
+
+	version := int(prefix[len(magic)])
+	if version != formatVersion {
+		return nil, nil, fmt.Errorf("unsupported stash format version %d", version)
+	}
+
+	var length uint32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, nil, ErrIntegrity
+	}
+
+	if length > maxHeaderLength {
+		return nil, nil, ErrIntegrity
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return nil, nil, ErrIntegrity
+	}
+
+	header := &Header{Format: FormatStash, Version: version, mac: make([]byte, sha256.Size)}
+	if err := json.Unmarshal(content, header); err != nil {
+		return nil, nil, ErrIntegrity
+	}
+
+	if _, err := io.ReadFull(reader, header.mac); err != nil {
+		return nil, nil, ErrIntegrity
+	}
+
+	var raw bytes.Buffer
+	raw.Write(prefix)
+	binary.Write(&raw, binary.BigEndian, length)
+	raw.Write(content)
+	header.raw = raw.Bytes()
+
+	return header, reader, nil
+}
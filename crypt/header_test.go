@@ -0,0 +1,120 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// headerMACOffset returns the offset of the MAC that follows the header.
+func headerMACOffset(ciphertext []byte) int {
+	length := binary.BigEndian.Uint32(ciphertext[len(magic)+1:])
+	return len(magic) + 1 + 4 + int(length)
+}
+
+func TestTruncatedHeader(t *testing.T) {
+	ciphertext := encrypt(t, []byte("secret"), Options{})
+	for _, length := range []int{len(magic) + 3, headerMACOffset(ciphertext) - 1, headerMACOffset(ciphertext) + 16} {
+		if _, _, err := ReadHeader(io.LimitReader(bytes.NewReader(ciphertext), int64(length))); err != ErrIntegrity {
+			t.Errorf("%d bytes: got %v, want ErrIntegrity", length, err)
+		}
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	ciphertext := encrypt(t, []byte("secret"), Options{})
+	ciphertext[len(magic)]++
+	if _, _, err := ReadHeader(bytes.NewReader(ciphertext)); err == nil {
+		t.Error("read a header of an unknown version")
+	}
+}
+
+func TestLegacyStash(t *testing.T) {
+	// Legacy stashes are a salt and IV followed by AES-128-OFB.
+	plaintext := []byte("legacy secret")
+	salt, iv := randomBytes(t, 64), randomBytes(t, aes.BlockSize)
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(testPassword), salt, 10000, aes.BlockSize, sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := append(append(salt, iv...), make([]byte, len(plaintext))...)
+	cipher.NewOFB(block, iv).XORKeyStream(ciphertext[len(salt)+len(iv):], plaintext)
+
+	header, reader, err := ReadHeader(bytes.NewReader(ciphertext))
+	if err != nil || header != nil {
+		t.Fatalf("got header %v, %v, want none", header, err)
+	}
+
+	decrypted, err := ioutil.ReadAll(NewLegacyDecrypter(reader, []byte(testPassword)))
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("got %q, %v", decrypted, err)
+	}
+}
+
+type unreadable struct{}
+
+func (unreadable) Read([]byte) (int, error) {
+	return 0, errors.New("payload read")
+}
+
+func TestWrongPassword(t *testing.T) {
+	ciphertext := encrypt(t, []byte("secret"), Options{})
+	header, _, err := ReadHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The password is rejected before any of the payload is read.
+	if _, err := NewDecrypter(unreadable{}, header, []byte("wrong"), nil); err != ErrIncorrectPassword {
+		t.Errorf("got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestTamperedHeader(t *testing.T) {
+	plaintext := []byte("secret")
+	ciphertext := encrypt(t, plaintext, Options{})
+	mac := headerMACOffset(ciphertext)
+
+	tamperedMAC := append([]byte{}, ciphertext...)
+	tamperedMAC[mac] ^= 1
+
+	tamperedField := bytes.Replace(ciphertext, []byte(`"compression":"gzip"`), []byte(`"compression":"none"`), 1)
+	if bytes.Equal(tamperedField, ciphertext) {
+		t.Fatal("header has no compression field")
+	}
+
+	// Without the right header MAC, a password cannot be told from a wrong
+	// one.
+	for name, tampered := range map[string][]byte{"mac": tamperedMAC, "field": tamperedField} {
+		if _, err := decrypt(tampered, testPassword); err != ErrIncorrectPassword {
+			t.Errorf("password, tampered %s: got %v, want ErrIncorrectPassword", name, err)
+		}
+	}
+
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext = encrypt(t, plaintext, Options{Recipients: []*Recipient{identity.Recipient()}})
+	tamperedMAC = append([]byte{}, ciphertext...)
+	tamperedMAC[headerMACOffset(ciphertext)] ^= 1
+
+	header, reader, err := ReadHeader(bytes.NewReader(tamperedMAC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewIdentityDecrypter(reader, header, []*Identity{identity}); err != ErrIntegrity {
+		t.Errorf("identity, tampered mac: got %v, want ErrIntegrity", err)
+	}
+}
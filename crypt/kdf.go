@@ -0,0 +1,108 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	DefaultKDFCost = 64
+	MaxKDFCost     = 1024
+
+	argon2Time    = 3
+	argon2Threads = 4
+	keyLength     = 32
+
+	// maxArgon2Time and maxArgon2Threads leave room above what stashes use,
+	// and with MaxKDFCost bound the work and memory a forged header can ask
+	// for.
+	maxArgon2Time    = 10
+	maxArgon2Threads = 16
+
+	// maxPBKDF2Iterations is far above the 10,000 that stashes used, and
+	// bounds the work a forged header can ask for.
+	maxPBKDF2Iterations = 10000000
+)
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, 32)
+	count, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if count != len(salt) {
+		return nil, errors.New("failed to generate salt")
+	}
+
+	return salt, nil
+}
+
+// newKDF returns Argon2id parameters using cost MiB of memory.
+func newKDF(cost int) (*KDF, error) {
+	if cost == 0 {
+		cost = DefaultKDFCost
+	}
+
+	if cost < 1 || cost > MaxKDFCost {
+		return nil, fmt.Errorf("key derivation cost must be between 1 and %d MiB", MaxKDFCost)
+	}
+
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KDF{
+		Name:       KDFArgon2id,
+		Salt:       salt,
+		Iterations: argon2Time,
+		Memory:     uint32(cost * 1024),
+		Threads:    argon2Threads,
+		KeyLength:  keyLength,
+	}, nil
+}
+
+func deriveKey(kdf *KDF, password []byte) ([]byte, error) {
+	if kdf.KeyLength <= 0 || kdf.KeyLength > 64 {
+		return nil, ErrIntegrity
+	}
+
+	// Bound parameters read from untrusted headers.
+	switch kdf.Name {
+	case KDFPBKDF2SHA256:
+		if kdf.Iterations <= 0 || kdf.Iterations > maxPBKDF2Iterations {
+			return nil, ErrIntegrity
+		}
+		return pbkdf2.Key(password, kdf.Salt, kdf.Iterations, kdf.KeyLength, sha256.New), nil
+	case KDFArgon2id:
+		if kdf.Iterations <= 0 || kdf.Iterations > maxArgon2Time || kdf.Threads == 0 || kdf.Threads > maxArgon2Threads {
+			return nil, ErrIntegrity
+		}
+		if kdf.Memory < 8*uint32(kdf.Threads) || kdf.Memory > MaxKDFCost*1024 {
+			return nil, ErrIntegrity
+		}
+		return argon2.IDKey(password, kdf.Salt, uint32(kdf.Iterations), kdf.Memory, kdf.Threads, uint32(kdf.KeyLength)), nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function \"%s\"", kdf.Name)
+	}
+}
+
+// withKeyFile mixes a key file into the password before key derivation, so
+// both are needed to decrypt.
+func withKeyFile(password, keyFile []byte) []byte {
+	if keyFile == nil {
+		return password
+	}
+
+	digest := sha256.Sum256(keyFile)
+	mac := hmac.New(sha256.New, digest[:])
+	mac.Write(password)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,29 @@
+package crypt
+
+import "testing"
+
+func TestForgedKDFParameters(t *testing.T) {
+	valid := KDF{Name: KDFArgon2id, Salt: make([]byte, 32), Iterations: 1, Memory: 64, Threads: 1, KeyLength: keyLength}
+	if _, err := deriveKey(&valid, []byte(testPassword)); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := map[string]KDF{
+		"argon2 memory":     {Name: KDFArgon2id, Iterations: 3, Memory: 4 * 1024 * 1024, Threads: 4, KeyLength: keyLength},
+		"argon2 passes":     {Name: KDFArgon2id, Iterations: 64, Memory: 64, Threads: 1, KeyLength: keyLength},
+		"argon2 threads":    {Name: KDFArgon2id, Iterations: 1, Memory: 64 * 255, Threads: 255, KeyLength: keyLength},
+		"pbkdf2 iterations": {Name: KDFPBKDF2SHA256, Iterations: 1 << 30, KeyLength: keyLength},
+		"key length":        {Name: KDFArgon2id, Iterations: 1, Memory: 64, Threads: 1, KeyLength: 1 << 20},
+	}
+
+	for name, kdf := range forged {
+		if _, err := deriveKey(&kdf, []byte(testPassword)); err != ErrIntegrity {
+			t.Errorf("%s: got %v, want ErrIntegrity", name, err)
+		}
+	}
+
+	stanza := ageStanza{Type: "scrypt", Args: []string{ageEncoding.EncodeToString(make([]byte, 16)), "22"}}
+	if _, _, err := stanza.unwrapScrypt([]byte(testPassword)); err != ErrIntegrity {
+		t.Errorf("scrypt work factor: got %v, want ErrIntegrity", err)
+	}
+}
@@ -0,0 +1,56 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type legacyDecrypter struct {
+	createStream func() (*cipher.StreamReader, error)
+	stream       *cipher.StreamReader
+}
+
+// NewLegacyDecrypter reads headerless stashes: a 64-byte salt and 16-byte IV
+// followed by an unauthenticated AES-128-OFB stream.
+func NewLegacyDecrypter(reader io.Reader, password []byte) *Decrypter {
+	decrypter := &legacyDecrypter{}
+
+	decrypter.createStream = func() (*cipher.StreamReader, error) {
+		salt := make([]byte, 64)
+		if _, err := io.ReadFull(reader, salt); err != nil {
+			return nil, err
+		}
+
+		key := pbkdf2.Key(password, salt, 10000, aes.BlockSize, sha256.New)
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(reader, iv); err != nil {
+			return nil, err
+		}
+
+		return &cipher.StreamReader{
+			S: cipher.NewOFB(block, iv),
+			R: reader,
+		}, nil
+	}
+
+	return &Decrypter{Reader: decrypter}
+}
+
+func (decrypter *legacyDecrypter) Read(buf []byte) (int, error) {
+	if decrypter.stream == nil {
+		var err error
+		if decrypter.stream, err = decrypter.createStream(); err != nil {
+			return 0, err
+		}
+	}
+	return decrypter.stream.Read(buf)
+}
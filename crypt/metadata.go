@@ -0,0 +1,70 @@
+package crypt
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const maxMetadataLength = 16 * 1024 * 1024
+
+// Metadata is sealed as a single block between the header MAC and the
+// payload, so it can be read without reading any of the payload.
+
+func newMetadataAEAD(header *Header, master []byte) (cipher.AEAD, error) {
+	key := make([]byte, len(master))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("stash metadata")), key); err != nil {
+		return nil, err
+	}
+
+	return newAEAD(header.Cipher, key)
+}
+
+func writeMetadata(writer io.Writer, header *Header, master, metadata []byte) error {
+	aead, err := newMetadataAEAD(header, master)
+	if err != nil {
+		return err
+	}
+
+	sealed := aead.Seal(nil, make([]byte, aead.NonceSize()), metadata, header.raw)
+	if err := binary.Write(writer, binary.BigEndian, uint32(len(sealed))); err != nil {
+		return err
+	}
+
+	_, err = writer.Write(sealed)
+	return err
+}
+
+// readMetadata returns the metadata and the block as read, for the signature
+// digest.
+func readMetadata(reader io.Reader, header *Header, master []byte) ([]byte, []byte, error) {
+	aead, err := newMetadataAEAD(header, master)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block := make([]byte, 4)
+	if _, err := io.ReadFull(reader, block); err != nil {
+		return nil, nil, ErrIntegrity
+	}
+
+	length := binary.BigEndian.Uint32(block)
+	if length > maxMetadataLength {
+		return nil, nil, ErrIntegrity
+	}
+
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(reader, sealed); err != nil {
+		return nil, nil, ErrIntegrity
+	}
+
+	metadata, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed, header.raw)
+	if err != nil {
+		return nil, nil, ErrIntegrity
+	}
+
+	return metadata, append(block, sealed...), nil
+}
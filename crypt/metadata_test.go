@@ -0,0 +1,37 @@
+package crypt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	metadata := []byte(`{"message":"hello"}`)
+	plaintext := randomBytes(t, segmentSize+1)
+	ciphertext := encrypt(t, plaintext, Options{Metadata: metadata})
+
+	header, reader, err := ReadHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypter, err := NewDecrypter(reader, header, []byte(testPassword), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decrypter.Metadata(), metadata) {
+		t.Errorf("got metadata %q, want %q", decrypter.Metadata(), metadata)
+	}
+
+	if decrypted, err := decrypt(ciphertext, testPassword); err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decrypted %d bytes, %v", len(decrypted), err)
+	}
+
+	// The metadata block directly follows the header MAC.
+	tampered := append([]byte{}, ciphertext...)
+	tampered[headerMACOffset(ciphertext)+32+4] ^= 1
+	if _, err := decrypt(tampered, testPassword); err != ErrIntegrity {
+		t.Errorf("tampered metadata: got %v, want ErrIntegrity", err)
+	}
+}
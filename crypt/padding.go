@@ -0,0 +1,227 @@
+package crypt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	PaddingAuto   = "auto"
+	PaddingNone   = "none"
+	PaddingPadme  = "padme"
+	PaddingBucket = "bucket"
+
+	paddingTrailerSize = 8
+	minPaddingBucket   = 1024
+	maxAutoPadding     = 1024 * 1024
+)
+
+// Padded plaintext is followed by zeros and a trailer holding the number of
+// zeros, so that the ciphertext only reveals the padded length.
+
+func checkPadding(mode string) error {
+	switch mode {
+	case "", PaddingAuto, PaddingNone, PaddingPadme, PaddingBucket:
+		return nil
+	default:
+		return fmt.Errorf("unsupported padding \"%s\"", mode)
+	}
+}
+
+// paddedLength returns the length to pad length bytes to, including the
+// trailer.
+func paddedLength(mode string, length uint64) uint64 {
+	length += paddingTrailerSize
+
+	switch mode {
+	case PaddingPadme:
+		// PADMÉ leaks O(log log length) bits, at most 12% overhead.
+		if length < 2 {
+			return length
+		}
+
+		exponent := uint(bits.Len64(length) - 1)
+		mantissa := uint(bits.Len(exponent))
+		mask := uint64(1)<<(exponent-mantissa) - 1
+		return (length + mask) &^ mask
+	case PaddingBucket, PaddingAuto, "":
+		if mode != PaddingBucket && length > maxAutoPadding {
+			return length
+		}
+
+		if length < minPaddingBucket {
+			return minPaddingBucket
+		}
+
+		return uint64(1) << uint(bits.Len64(length-1))
+	default:
+		return length
+	}
+}
+
+func pad(mode string, data []byte) []byte {
+	length := paddedLength(mode, uint64(len(data)))
+	padded := make([]byte, length)
+	copy(padded, data)
+	binary.BigEndian.PutUint64(padded[length-paddingTrailerSize:], length-paddingTrailerSize-uint64(len(data)))
+	return padded
+}
+
+func unpad(padded []byte) ([]byte, error) {
+	if len(padded) < paddingTrailerSize {
+		return nil, ErrIntegrity
+	}
+
+	data := padded[:len(padded)-paddingTrailerSize]
+	zeros := binary.BigEndian.Uint64(padded[len(data):])
+	if zeros > uint64(len(data)) {
+		return nil, ErrIntegrity
+	}
+
+	return data[:uint64(len(data))-zeros], nil
+}
+
+type paddingWriter struct {
+	mode   string
+	writer io.WriteCloser
+	length uint64
+}
+
+func newPaddingWriter(mode string, writer io.WriteCloser) *paddingWriter {
+	return &paddingWriter{mode: mode, writer: writer}
+}
+
+func (writer *paddingWriter) Write(buf []byte) (int, error) {
+	count, err := writer.writer.Write(buf)
+	writer.length += uint64(count)
+	return count, err
+}
+
+func (writer *paddingWriter) Close() error {
+	zeros := paddedLength(writer.mode, writer.length) - paddingTrailerSize - writer.length
+
+	trailer := make([]byte, paddingTrailerSize)
+	binary.BigEndian.PutUint64(trailer, zeros)
+
+	buffer := make([]byte, segmentSize)
+	for remaining := zeros; remaining > 0; {
+		count := uint64(len(buffer))
+		if remaining < count {
+			count = remaining
+		}
+
+		if _, err := writer.writer.Write(buffer[:count]); err != nil {
+			return err
+		}
+
+		remaining -= count
+	}
+
+	if _, err := writer.writer.Write(trailer); err != nil {
+		return err
+	}
+
+	return writer.writer.Close()
+}
+
+// paddingReader strips padding while streaming. Runs of zeros are held back
+// as a count until a non-zero byte follows them or the trailer shows how
+// many of them are padding.
+type paddingReader struct {
+	reader io.Reader
+	buffer []byte
+	tail   []byte
+	held   uint64
+	zeros  uint64
+	data   []byte
+	done   bool
+}
+
+func newPaddingReader(reader io.Reader) *paddingReader {
+	return &paddingReader{reader: reader, buffer: make([]byte, segmentSize)}
+}
+
+func (reader *paddingReader) Read(buf []byte) (int, error) {
+	for reader.zeros == 0 && len(reader.data) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+
+		if err := reader.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	if reader.zeros > 0 {
+		count := uint64(len(buf))
+		if reader.zeros < count {
+			count = reader.zeros
+		}
+
+		for i := range buf[:count] {
+			buf[i] = 0
+		}
+
+		reader.zeros -= count
+		return int(count), nil
+	}
+
+	count := copy(buf, reader.data)
+	reader.data = reader.data[count:]
+	return count, nil
+}
+
+func (reader *paddingReader) next() error {
+	count, err := reader.reader.Read(reader.buffer)
+	if count > 0 {
+		// Always keep back enough bytes to hold the trailer.
+		combined := append(reader.tail[:len(reader.tail):len(reader.tail)], reader.buffer[:count]...)
+		split := len(combined) - paddingTrailerSize
+		if split <= 0 {
+			reader.tail = combined
+		} else {
+			reader.tail = combined[split:]
+			reader.release(combined[:split])
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+
+	if err == io.EOF {
+		if len(reader.tail) != paddingTrailerSize {
+			return ErrIntegrity
+		}
+
+		padding := binary.BigEndian.Uint64(reader.tail)
+		if padding > reader.held {
+			return ErrIntegrity
+		}
+
+		reader.zeros += reader.held - padding
+		reader.held = 0
+		reader.done = true
+		return nil
+	}
+
+	return err
+}
+
+func (reader *paddingReader) release(data []byte) {
+	last := len(data) - 1
+	for last >= 0 && data[last] == 0 {
+		last--
+	}
+
+	if last < 0 {
+		reader.held += uint64(len(data))
+		return
+	}
+
+	reader.zeros += reader.held
+	reader.data = data[:last+1]
+	reader.held = uint64(len(data) - last - 1)
+}
@@ -0,0 +1,72 @@
+package crypt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPadmeKnownAnswers(t *testing.T) {
+	// Lengths, including the trailer, padded as in the PADMÉ paper: the low
+	// E - S bits are rounded up, where E = floor(log2 L) and
+	// S = floor(log2 E) + 1.
+	answers := []struct{ length, padded uint64 }{
+		{8, 8},
+		{9, 10},
+		{100, 104},
+		{1000, 1024},
+		{1025, 1088},
+		{65536, 65536},
+		{65537, 67584},
+		{1000000, 1015808},
+	}
+
+	for _, answer := range answers {
+		if padded := paddedLength(PaddingPadme, answer.length-paddingTrailerSize); padded != answer.padded {
+			t.Errorf("PADMÉ of %d: got %d, want %d", answer.length, padded, answer.padded)
+		}
+	}
+}
+
+func TestBucketPadding(t *testing.T) {
+	answers := []struct {
+		mode           string
+		length, padded uint64
+	}{
+		{PaddingBucket, 0, 1024},
+		{PaddingBucket, 1016, 1024},
+		{PaddingBucket, 1017, 2048},
+		{PaddingAuto, 100000, 131072},
+		{PaddingBucket, maxAutoPadding, 2 * maxAutoPadding},
+		{PaddingAuto, maxAutoPadding, maxAutoPadding + paddingTrailerSize},
+	}
+
+	for _, answer := range answers {
+		if padded := paddedLength(answer.mode, answer.length); padded != answer.padded {
+			t.Errorf("%s of %d: got %d, want %d", answer.mode, answer.length, padded, answer.padded)
+		}
+	}
+}
+
+func TestPadRoundTrip(t *testing.T) {
+	for _, mode := range []string{PaddingAuto, PaddingPadme, PaddingBucket} {
+		for _, size := range []int{0, 1, 1000, 5000} {
+			data := randomBytes(t, size)
+			padded := pad(mode, data)
+			if uint64(len(padded)) != paddedLength(mode, uint64(size)) {
+				t.Errorf("%s of %d: padded to %d bytes", mode, size, len(padded))
+			}
+
+			unpadded, err := unpad(padded)
+			if err != nil || !bytes.Equal(unpadded, data) {
+				t.Errorf("%s of %d: unpad failed: %v", mode, size, err)
+			}
+		}
+	}
+
+	// A trailer claiming more zeros than there are is rejected.
+	padded := pad(PaddingBucket, []byte("data"))
+	padded[len(padded)-paddingTrailerSize] = 0xff
+	if _, err := unpad(padded); err != ErrIntegrity {
+		t.Errorf("bad trailer: got %v, want ErrIntegrity", err)
+	}
+}
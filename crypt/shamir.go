@@ -0,0 +1,118 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Shamir's secret sharing over GF(2^8), byte by byte. Each share is its x
+// coordinate followed by the value of every byte's polynomial at x.
+
+const MaxShares = 255
+
+var ErrShareMismatch = errors.New("shares do not belong to this stash")
+
+var gfExp, gfLog [256]byte
+
+func init() {
+	// 3 generates the multiplicative group modulo the AES polynomial.
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		x ^= gfDouble(x)
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func gfDouble(x byte) byte {
+	if x&0x80 != 0 {
+		return x<<1 ^ 0x1b
+	}
+	return x << 1
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])-int(gfLog[b])+255)%255]
+}
+
+func checkSplit(threshold, count int) error {
+	if threshold < 2 || threshold > count || count > MaxShares {
+		return fmt.Errorf("split must be T-of-N shares with 2 <= T <= N <= %d", MaxShares)
+	}
+	return nil
+}
+
+func splitSecret(secret []byte, threshold, count int) ([][]byte, error) {
+	if err := checkSplit(threshold, count); err != nil {
+		return nil, err
+	}
+
+	shares := make([][]byte, count)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for j, value := range secret {
+		coefficients[0] = value
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for _, share := range shares {
+			// Horner's method.
+			x, y := share[0], byte(0)
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coefficients[k]
+			}
+			share[j+1] = y
+		}
+	}
+
+	return shares, nil
+}
+
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, ErrShareMismatch
+	}
+
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != len(shares[0]) || len(share) < 2 || share[0] == 0 || seen[share[0]] {
+			return nil, ErrShareMismatch
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, len(shares[0])-1)
+	for i, share := range shares {
+		// Lagrange basis polynomial for this share, evaluated at zero.
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfDiv(other[0], other[0]^share[0]))
+			}
+		}
+
+		for k := range secret {
+			secret[k] ^= gfMul(basis, share[k+1])
+		}
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,105 @@
+package crypt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestShamirKnownAnswers(t *testing.T) {
+	// Shares of the secret 0x42 on polynomials whose values follow from the
+	// products in FIPS-197: {57}•{83} = {c1}, {57}•{02} = {ae} and
+	// {57}•{04} = {47}.
+	answers := []struct {
+		name   string
+		shares [][]byte
+	}{
+		// f(x) = {42} + {57}x
+		{"2-of-n", [][]byte{{0x01, 0x15}, {0x83, 0x83}}},
+		// f(x) = {42} + {57}x + x²
+		{"3-of-n", [][]byte{{0x01, 0x14}, {0x02, 0xe8}, {0x04, 0x15}}},
+	}
+
+	for _, answer := range answers {
+		secret, err := combineShares(answer.shares)
+		if err != nil || !bytes.Equal(secret, []byte{0x42}) {
+			t.Errorf("%s: got %x, %v, want 42", answer.name, secret, err)
+		}
+	}
+}
+
+func TestShamirRoundTrip(t *testing.T) {
+	secret := randomBytes(t, 32)
+	shares, err := splitSecret(secret, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every 3 of the 5 shares recover the secret.
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				combined, err := combineShares([][]byte{shares[i], shares[j], shares[k]})
+				if err != nil || !bytes.Equal(combined, secret) {
+					t.Errorf("shares %d, %d, %d: recovered %x, %v", i, j, k, combined, err)
+				}
+			}
+		}
+	}
+
+	invalid := map[string][][]byte{
+		"none":      nil,
+		"duplicate": {shares[0], shares[0], shares[1]},
+		"lengths":   {shares[0], shares[1][:16], shares[2]},
+		"zero x":    {append([]byte{0}, shares[0][1:]...), shares[1], shares[2]},
+	}
+
+	for name, shares := range invalid {
+		if _, err := combineShares(shares); err != ErrShareMismatch {
+			t.Errorf("%s: got %v, want ErrShareMismatch", name, err)
+		}
+	}
+}
+
+func TestSplitStash(t *testing.T) {
+	plaintext := []byte("split secret")
+	var ciphertext bytes.Buffer
+	encrypter, shares, err := NewSplitEncrypter(&ciphertext, 2, 3, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypter.Write(plaintext)
+	if err := encrypter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(shares [][]byte) ([]byte, error) {
+		header, reader, err := ReadHeader(bytes.NewReader(ciphertext.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+
+		decrypter, err := NewSplitDecrypter(reader, header, shares)
+		if err != nil {
+			return nil, err
+		}
+
+		var decrypted bytes.Buffer
+		_, err = decrypted.ReadFrom(decrypter)
+		return decrypted.Bytes(), err
+	}
+
+	decrypted, err := open([][]byte{shares[2], shares[0]})
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("got %q, %v", decrypted, err)
+	}
+
+	_, others, err := NewSplitEncrypter(&bytes.Buffer{}, 2, 3, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := open([][]byte{shares[0], others[1]}); err != ErrShareMismatch {
+		t.Errorf("mixed shares: got %v, want ErrShareMismatch", err)
+	}
+}
@@ -0,0 +1,104 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	signerPrefix     = "stashsig"
+	signingKeyPrefix = "STASH-SIGNING-KEY-"
+	signatureContext = "stash signature v1\n"
+)
+
+var ErrSignature = errors.New("stash signature is invalid")
+
+type SigningKey struct {
+	private ed25519.PrivateKey
+}
+
+type Signer struct {
+	public ed25519.PublicKey
+}
+
+func GenerateSigningKey() (*SigningKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{private: private}, nil
+}
+
+// ParseSigningKey reads a signing key file. Empty lines and lines starting
+// with # are ignored.
+func ParseSigningKey(content []byte) (*SigningKey, error) {
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hrp, seed, err := bech32Decode(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key: %s", err)
+		}
+
+		if hrp != strings.ToLower(signingKeyPrefix) || len(seed) != ed25519.SeedSize {
+			return nil, errors.New("invalid signing key: not an Ed25519 signing key")
+		}
+
+		return &SigningKey{private: ed25519.NewKeyFromSeed(seed)}, nil
+	}
+
+	return nil, errors.New("invalid signing key: no key found")
+}
+
+func (key *SigningKey) String() string {
+	encoded, _ := bech32Encode(signingKeyPrefix, key.private.Seed())
+	return encoded
+}
+
+func (key *SigningKey) Signer() *Signer {
+	return &Signer{public: key.private.Public().(ed25519.PublicKey)}
+}
+
+func ParseSigner(encoded string) (*Signer, error) {
+	hrp, public, err := bech32Decode(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer key: %s", err)
+	}
+
+	if hrp != signerPrefix || len(public) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid signer key: not an Ed25519 public key")
+	}
+
+	return &Signer{public: ed25519.PublicKey(public)}, nil
+}
+
+func (signer *Signer) String() string {
+	encoded, _ := bech32Encode(signerPrefix, signer.public)
+	return encoded
+}
+
+// The signature covers a digest of everything preceding it: the header, its
+// MAC, and every payload segment.
+func signatureMessage(digest []byte) []byte {
+	return append([]byte(signatureContext), digest...)
+}
+
+func (key *SigningKey) sign(digest []byte) []byte {
+	return ed25519.Sign(key.private, signatureMessage(digest))
+}
+
+func (signer *Signer) verify(digest, signature []byte) error {
+	if !ed25519.Verify(signer.public, signatureMessage(digest), signature) {
+		return ErrSignature
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package crypt
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// SPAKE2 over P-256, so that a short code shared between two people yields a
+// strong session key. An attacker relaying the exchange gets one guess at the
+// code per session, and nothing observed allows guessing it offline.
+
+var ErrCodeMismatch = errors.New("codes do not match")
+
+var spake2M, spake2N = spake2Point("M"), spake2Point("N")
+
+type point struct {
+	x, y *big.Int
+}
+
+// spake2Point hashes name to a point with no known discrete logarithm, by
+// hashing to candidate x coordinates until one is on the curve.
+func spake2Point(name string) point {
+	params := elliptic.P256().Params()
+	three := big.NewInt(3)
+
+	for counter := byte(0); ; counter++ {
+		digest := sha256.Sum256(append([]byte("stash spake2 "+name), counter))
+		x := new(big.Int).SetBytes(digest[:])
+		if x.Cmp(params.P) >= 0 {
+			continue
+		}
+
+		// y² = x³ - 3x + b
+		y2 := new(big.Int).Exp(x, three, params.P)
+		y2.Sub(y2, new(big.Int).Mul(three, x))
+		y2.Add(y2, params.B)
+		y2.Mod(y2, params.P)
+
+		y := new(big.Int).ModSqrt(y2, params.P)
+		if y == nil {
+			continue
+		}
+
+		if y.Bit(0) == 1 {
+			y.Sub(params.P, y)
+		}
+
+		return point{x, y}
+	}
+}
+
+func spake2Scalar(code []byte) *big.Int {
+	digest := sha512.Sum512(append([]byte("stash spake2 code\n"), code...))
+	return new(big.Int).Mod(new(big.Int).SetBytes(digest[:]), elliptic.P256().Params().N)
+}
+
+func (p point) add(q point) point {
+	x, y := elliptic.P256().Add(p.x, p.y, q.x, q.y)
+	return point{x, y}
+}
+
+func (p point) mul(k *big.Int) point {
+	x, y := elliptic.P256().ScalarMult(p.x, p.y, k.Bytes())
+	return point{x, y}
+}
+
+func (p point) neg() point {
+	return point{p.x, new(big.Int).Sub(elliptic.P256().Params().P, p.y)}
+}
+
+func (p point) bytes() []byte {
+	return elliptic.Marshal(elliptic.P256(), p.x, p.y)
+}
+
+func (p point) infinity() bool {
+	return p.x.Sign() == 0 && p.y.Sign() == 0
+}
+
+func appendField(transcript, field []byte) []byte {
+	length := make([]byte, 8)
+	binary.LittleEndian.PutUint64(length, uint64(len(field)))
+	return append(append(transcript, length...), field...)
+}
+
+func exchange(conn io.ReadWriter, mine, theirs []byte, first bool) error {
+	if first {
+		if _, err := conn.Write(mine); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.ReadFull(conn, theirs); err != nil {
+		return err
+	}
+
+	if !first {
+		if _, err := conn.Write(mine); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handshake runs SPAKE2 over conn with the peer holding the same code and
+// returns the session key. The sender and receiver take the two sides of the
+// exchange. ErrCodeMismatch is returned if the peer used a different code.
+func Handshake(conn io.ReadWriter, code []byte, sender bool) ([]byte, error) {
+	curve := elliptic.P256()
+	params := curve.Params()
+	w := spake2Scalar(code)
+
+	secret, err := rand.Int(rand.Reader, new(big.Int).Sub(params.N, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	secret.Add(secret, big.NewInt(1))
+
+	mine, theirs := spake2M, spake2N
+	if !sender {
+		mine, theirs = spake2N, spake2M
+	}
+
+	gx, gy := curve.ScalarBaseMult(secret.Bytes())
+	share := point{gx, gy}.add(mine.mul(w)).bytes()
+
+	// The sender speaks first at each step, so the exchange also works over
+	// unbuffered connections.
+	peerShare := make([]byte, len(share))
+	if err := exchange(conn, share, peerShare, sender); err != nil {
+		return nil, err
+	}
+
+	px, py := elliptic.Unmarshal(curve, peerShare)
+	if px == nil {
+		return nil, ErrCodeMismatch
+	}
+
+	shared := point{px, py}.add(theirs.mul(w).neg())
+	if shared.infinity() {
+		return nil, ErrCodeMismatch
+	}
+
+	shared = shared.mul(secret)
+	if shared.infinity() {
+		return nil, ErrCodeMismatch
+	}
+
+	senderShare, receiverShare := share, peerShare
+	if !sender {
+		senderShare, receiverShare = peerShare, share
+	}
+
+	var transcript []byte
+	transcript = appendField(transcript, []byte("stash sender"))
+	transcript = appendField(transcript, []byte("stash receiver"))
+	transcript = appendField(transcript, senderShare)
+	transcript = appendField(transcript, receiverShare)
+	transcript = appendField(transcript, shared.bytes())
+	transcript = appendField(transcript, w.Bytes())
+	digest := sha256.Sum256(transcript)
+
+	keys := make([]byte, chacha20poly1305.KeySize+2*sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, digest[:], nil, []byte("stash spake2 keys")), keys); err != nil {
+		return nil, err
+	}
+
+	sessionKey := keys[:chacha20poly1305.KeySize]
+	senderKey := keys[chacha20poly1305.KeySize : chacha20poly1305.KeySize+sha256.Size]
+	receiverKey := keys[chacha20poly1305.KeySize+sha256.Size:]
+
+	confirm := func(key []byte) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(digest[:])
+		return mac.Sum(nil)
+	}
+
+	// Each side proves it derived the same key before any data is sent.
+	myKey, peerKey := senderKey, receiverKey
+	if !sender {
+		myKey, peerKey = receiverKey, senderKey
+	}
+
+	peerConfirm := make([]byte, sha256.Size)
+	if err := exchange(conn, confirm(myKey), peerConfirm, sender); err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(peerConfirm, confirm(peerKey)) {
+		return nil, ErrCodeMismatch
+	}
+
+	return sessionKey, nil
+}
+
+// NewSessionEncrypter encrypts a stream with a key from Handshake.
+func NewSessionEncrypter(writer io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSegmentWriter(aead, nil, writer), nil
+}
+
+// NewSessionDecrypter decrypts a stream written by NewSessionEncrypter.
+func NewSessionDecrypter(reader io.Reader, key []byte) (io.Reader, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSegmentReader(aead, nil, reader), nil
+}
@@ -0,0 +1,200 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+const segmentSize = 64 * 1024
+
+var ErrIntegrity = errors.New("stash is corrupt, truncated, or has been tampered with")
+
+// Plaintext is split into fixed-size segments, each sealed independently.
+// The nonce for a segment holds its index and a flag marking the final
+// segment, so reordering, dropping, or appending segments fails to open.
+// Every segment also authenticates the stash header as additional data.
+type segmentWriter struct {
+	aead    cipher.AEAD
+	data    []byte
+	writer  io.Writer
+	buffer  []byte
+	sealed  []byte
+	nonce   []byte
+	counter uint64
+
+	// Called after the final segment is written, to append a trailer.
+	finish func() error
+}
+
+type segmentReader struct {
+	aead      cipher.AEAD
+	data      []byte
+	reader    *bufio.Reader
+	buffer    []byte
+	plaintext []byte
+	nonce     []byte
+	counter   uint64
+	done      bool
+	err       error
+
+	// Optional trailer of a fixed size following the final segment, passed
+	// to finish along with a digest of every segment.
+	trailer int
+	digest  hash.Hash
+	finish  func(trailer []byte) error
+}
+
+func setNonce(nonce []byte, counter uint64, last bool) {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+func newSegmentWriter(aead cipher.AEAD, data []byte, writer io.Writer) *segmentWriter {
+	return &segmentWriter{
+		aead:   aead,
+		data:   data,
+		writer: writer,
+		buffer: make([]byte, 0, segmentSize),
+		sealed: make([]byte, 0, segmentSize+aead.Overhead()),
+		nonce:  make([]byte, aead.NonceSize()),
+	}
+}
+
+func (writer *segmentWriter) Write(buf []byte) (int, error) {
+	total := 0
+	for len(buf) > 0 {
+		// Only flush a full segment once more data arrives, so that
+		// Close always has a segment to mark as final.
+		if len(writer.buffer) == segmentSize {
+			if err := writer.flush(false); err != nil {
+				return total, err
+			}
+		}
+
+		count := copy(writer.buffer[len(writer.buffer):segmentSize], buf)
+		writer.buffer = writer.buffer[:len(writer.buffer)+count]
+		buf = buf[count:]
+		total += count
+	}
+
+	return total, nil
+}
+
+func (writer *segmentWriter) flush(last bool) error {
+	setNonce(writer.nonce, writer.counter, last)
+	writer.sealed = writer.aead.Seal(writer.sealed[:0], writer.nonce, writer.buffer, writer.data)
+	writer.buffer = writer.buffer[:0]
+	writer.counter++
+
+	_, err := writer.writer.Write(writer.sealed)
+	return err
+}
+
+func (writer *segmentWriter) Close() error {
+	if err := writer.flush(true); err != nil {
+		return err
+	}
+
+	if writer.finish != nil {
+		return writer.finish()
+	}
+
+	return nil
+}
+
+func newSegmentReader(aead cipher.AEAD, data []byte, reader io.Reader) *segmentReader {
+	return newSegmentTrailerReader(aead, data, reader, 0, nil, nil)
+}
+
+func newSegmentTrailerReader(aead cipher.AEAD, data []byte, reader io.Reader, trailer int, digest hash.Hash, finish func([]byte) error) *segmentReader {
+	return &segmentReader{
+		aead:    aead,
+		data:    data,
+		reader:  bufio.NewReaderSize(reader, segmentSize+aead.Overhead()+trailer+1),
+		buffer:  make([]byte, 0, segmentSize),
+		nonce:   make([]byte, aead.NonceSize()),
+		trailer: trailer,
+		digest:  digest,
+		finish:  finish,
+	}
+}
+
+func (reader *segmentReader) Read(buf []byte) (int, error) {
+	for len(reader.plaintext) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+
+		if reader.done {
+			return 0, io.EOF
+		}
+
+		reader.err = reader.next()
+	}
+
+	count := copy(buf, reader.plaintext)
+	reader.plaintext = reader.plaintext[count:]
+	return count, nil
+}
+
+func (reader *segmentReader) next() error {
+	size := segmentSize + reader.aead.Overhead()
+
+	// Peek one byte past a full segment and trailer to learn whether this
+	// is the last segment.
+	chunk, err := reader.reader.Peek(size + reader.trailer + 1)
+	last := false
+	var trailer []byte
+	if err == io.EOF {
+		if len(chunk) < reader.trailer {
+			return ErrIntegrity
+		}
+
+		last = true
+		trailer = append([]byte{}, chunk[len(chunk)-reader.trailer:]...)
+		chunk = chunk[:len(chunk)-reader.trailer]
+	} else if err != nil {
+		return err
+	} else {
+		chunk = chunk[:size]
+	}
+
+	if len(chunk) == 0 {
+		return ErrIntegrity
+	}
+
+	setNonce(reader.nonce, reader.counter, last)
+	plaintext, err := reader.aead.Open(reader.buffer[:0], reader.nonce, chunk, reader.data)
+	if err != nil {
+		return ErrIntegrity
+	}
+
+	if reader.digest != nil {
+		reader.digest.Write(chunk)
+	}
+
+	if _, err := reader.reader.Discard(len(chunk) + len(trailer)); err != nil {
+		return err
+	}
+
+	if last && reader.finish != nil {
+		if err := reader.finish(trailer); err != nil {
+			return err
+		}
+	}
+
+	reader.plaintext = plaintext
+	reader.counter++
+	reader.done = last
+	return nil
+}
@@ -0,0 +1,147 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+const testPassword = "correct horse"
+
+func randomBytes(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func encrypt(t *testing.T, plaintext []byte, options Options) []byte {
+	if options.KDFCost == 0 {
+		options.KDFCost = 1
+	}
+
+	var ciphertext bytes.Buffer
+	encrypter := NewEncrypter(&ciphertext, []byte(testPassword), options)
+	if _, err := encrypter.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encrypter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ciphertext.Bytes()
+}
+
+func decrypt(ciphertext []byte, password string) ([]byte, error) {
+	header, reader, err := ReadHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+
+	decrypter, err := NewDecrypter(reader, header, []byte(password), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(decrypter)
+}
+
+// payloadStart returns the offset of the first segment of an unpadded stash
+// without metadata or signature, whose plaintext is size bytes.
+func payloadStart(ciphertext []byte, size int) int {
+	segments := size/segmentSize + 1
+	last := size % segmentSize
+	if last == 0 {
+		segments, last = segments-1, segmentSize
+	}
+
+	overhead := 16
+	return len(ciphertext) - (segments-1)*(segmentSize+overhead) - (last + overhead)
+}
+
+func TestRoundTrip(t *testing.T) {
+	sizes := []int{1, 100, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 100}
+	variants := map[string]Options{
+		"aes":     {Padding: PaddingNone},
+		"xchacha": {Cipher: CipherXChaCha20Poly1305, Padding: PaddingNone},
+		"padme":   {Padding: PaddingPadme},
+		"bucket":  {Padding: PaddingBucket},
+	}
+
+	for name, options := range variants {
+		for _, size := range sizes {
+			plaintext := randomBytes(t, size)
+			decrypted, err := decrypt(encrypt(t, plaintext, options), testPassword)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %s", name, size, err)
+			}
+
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatalf("%s, %d bytes: decrypted plaintext differs", name, size)
+			}
+		}
+	}
+}
+
+func TestTruncatedStream(t *testing.T) {
+	size := 3*segmentSize + 100
+	ciphertext := encrypt(t, randomBytes(t, size), Options{Padding: PaddingNone})
+	start := payloadStart(ciphertext, size)
+
+	cuts := map[string]int{
+		"last byte":     len(ciphertext) - 1,
+		"last segment":  start + 3*(segmentSize+16),
+		"mid segment":   start + segmentSize/2,
+		"whole payload": start,
+	}
+
+	for name, length := range cuts {
+		if _, err := decrypt(ciphertext[:length], testPassword); err != ErrIntegrity {
+			t.Errorf("%s: got %v, want ErrIntegrity", name, err)
+		}
+	}
+}
+
+func TestReorderedSegments(t *testing.T) {
+	size := 3*segmentSize + 100
+	ciphertext := encrypt(t, randomBytes(t, size), Options{Padding: PaddingNone})
+	start := payloadStart(ciphertext, size)
+	segment := func(i int) []byte {
+		return ciphertext[start+i*(segmentSize+16) : start+(i+1)*(segmentSize+16)]
+	}
+
+	var swapped bytes.Buffer
+	swapped.Write(ciphertext[:start])
+	swapped.Write(segment(1))
+	swapped.Write(segment(0))
+	swapped.Write(ciphertext[start+2*(segmentSize+16):])
+	if _, err := decrypt(swapped.Bytes(), testPassword); err != ErrIntegrity {
+		t.Errorf("swapped segments: got %v, want ErrIntegrity", err)
+	}
+
+	var dropped bytes.Buffer
+	dropped.Write(ciphertext[:start])
+	dropped.Write(segment(0))
+	dropped.Write(ciphertext[start+2*(segmentSize+16):])
+	if _, err := decrypt(dropped.Bytes(), testPassword); err != ErrIntegrity {
+		t.Errorf("dropped segment: got %v, want ErrIntegrity", err)
+	}
+}
+
+func TestTamperedSegment(t *testing.T) {
+	size := 2 * segmentSize
+	ciphertext := encrypt(t, randomBytes(t, size), Options{Padding: PaddingNone})
+	start := payloadStart(ciphertext, size)
+
+	for _, offset := range []int{start, start + segmentSize + 8, len(ciphertext) - 1} {
+		tampered := append([]byte{}, ciphertext...)
+		tampered[offset] ^= 1
+		if _, err := decrypt(tampered, testPassword); err != ErrIntegrity {
+			t.Errorf("byte %d flipped: got %v, want ErrIntegrity", offset, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	StanzaX25519 = "x25519"
+
+	recipientPrefix = "age"
+	identityPrefix  = "AGE-SECRET-KEY-"
+)
+
+var ErrNoIdentity = errors.New("stash is not encrypted to any of your identities")
+
+// Keys use age's Bech32 encoding, so they are checksummed and can be shared
+// with age.
+type Identity struct {
+	secret [32]byte
+}
+
+type Recipient struct {
+	key [32]byte
+}
+
+// Stanza holds the stash key wrapped for a single recipient.
+type Stanza struct {
+	Type      string `json:"type"`
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+	Key       []byte `json:"key"`
+}
+
+func GenerateIdentity() (*Identity, error) {
+	identity := &Identity{}
+	if _, err := io.ReadFull(rand.Reader, identity.secret[:]); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+func ParseIdentity(encoded string) (*Identity, error) {
+	hrp, data, err := bech32Decode(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity: %s", err)
+	}
+
+	if hrp != strings.ToLower(identityPrefix) || len(data) != 32 {
+		return nil, errors.New("invalid identity: not an X25519 secret key")
+	}
+
+	identity := &Identity{}
+	copy(identity.secret[:], data)
+	return identity, nil
+}
+
+// ParseIdentities reads identities from an identity file, one per line.
+// Empty lines and lines starting with # are ignored.
+func ParseIdentities(content []byte) ([]*Identity, error) {
+	var identities []*Identity
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		identity, err := ParseIdentity(line)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
+
+func (identity *Identity) String() string {
+	encoded, _ := bech32Encode(identityPrefix, identity.secret[:])
+	return encoded
+}
+
+func (identity *Identity) Recipient() *Recipient {
+	recipient := &Recipient{}
+	curve25519.ScalarBaseMult(&recipient.key, &identity.secret)
+	return recipient
+}
+
+func ParseRecipient(encoded string) (*Recipient, error) {
+	hrp, data, err := bech32Decode(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err)
+	}
+
+	if hrp != recipientPrefix || len(data) != 32 {
+		return nil, errors.New("invalid public key: not an X25519 public key")
+	}
+
+	recipient := &Recipient{}
+	copy(recipient.key[:], data)
+	return recipient, nil
+}
+
+func (recipient *Recipient) String() string {
+	encoded, _ := bech32Encode(recipientPrefix, recipient.key[:])
+	return encoded
+}
+
+func wrapKey(shared, ephemeral, recipient *[32]byte) ([]byte, error) {
+	var zero [32]byte
+	if bytes.Equal(shared[:], zero[:]) {
+		return nil, errors.New("invalid X25519 shared secret")
+	}
+
+	salt := append(append([]byte{}, ephemeral[:]...), recipient[:]...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared[:], salt, []byte("stash x25519")), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (recipient *Recipient) wrap(fileKey []byte) (*Stanza, error) {
+	var ephemeral, ephemeralPublic, shared [32]byte
+	if _, err := io.ReadFull(rand.Reader, ephemeral[:]); err != nil {
+		return nil, err
+	}
+
+	curve25519.ScalarBaseMult(&ephemeralPublic, &ephemeral)
+	curve25519.ScalarMult(&shared, &ephemeral, &recipient.key)
+
+	key, err := wrapKey(&shared, &ephemeralPublic, &recipient.key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stanza{
+		Type:      StanzaX25519,
+		Ephemeral: ephemeralPublic[:],
+		Key:       aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil),
+	}, nil
+}
+
+// unwrap returns the stash key if stanza was wrapped for identity.
+func (identity *Identity) unwrap(stanza *Stanza) ([]byte, bool) {
+	if stanza.Type != StanzaX25519 || len(stanza.Ephemeral) != 32 {
+		return nil, false
+	}
+
+	var ephemeral, shared [32]byte
+	copy(ephemeral[:], stanza.Ephemeral)
+	curve25519.ScalarMult(&shared, &identity.secret, &ephemeral)
+
+	key, err := wrapKey(&shared, &ephemeral, &identity.Recipient().key)
+	if err != nil {
+		return nil, false
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, false
+	}
+
+	fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), stanza.Key, nil)
+	if err != nil {
+		return nil, false
+	}
+
+	return fileKey, true
+}
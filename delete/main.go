@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/flowup/cloudfunc/api"
+	"github.com/schmich/stash/owner"
+)
+
+type DeleteRequest struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+type DeleteResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+func remove(id string, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	obj := client.Bucket("stash-215008").Object(id)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := owner.Check(attrs.Metadata["owner"], token); err != nil {
+		return err
+	}
+
+	// Only delete the stash as it was checked.
+	return obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx)
+}
+
+func run(function *api.CloudFunc) error {
+	req, err := function.GetRequest()
+	if err != nil {
+		return err
+	}
+
+	var input DeleteRequest
+	if err = req.BindBody(&input); err != nil {
+		return err
+	}
+
+	return remove(input.ID, input.Token)
+}
+
+func main() {
+	function := api.NewCloudFunc()
+	if err := run(function); err == nil {
+		function.SendResponse(&DeleteResponse{})
+	} else {
+		function.SendResponse(&DeleteResponse{Error: err.Error()})
+	}
+}
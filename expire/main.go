@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/flowup/cloudfunc/api"
+	"github.com/schmich/stash/owner"
+)
+
+type ExpireRequest struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+
+	// Expires is when the stash now expires, in RFC 3339 format, or empty
+	// if it is kept until deleted.
+	Expires string `json:"expires,omitempty"`
+}
+
+type ExpireResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+func expire(id string, token string, expires string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	obj := client.Bucket("stash-215008").Object(id)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := owner.Check(attrs.Metadata["owner"], token); err != nil {
+		return err
+	}
+
+	// An empty value removes the expiry from the metadata.
+	update := storage.ObjectAttrsToUpdate{Metadata: map[string]string{"expires": expires}}
+	_, err = obj.If(storage.Conditions{MetagenerationMatch: attrs.Metageneration}).Update(ctx, update)
+	return err
+}
+
+func run(function *api.CloudFunc) error {
+	req, err := function.GetRequest()
+	if err != nil {
+		return err
+	}
+
+	var input ExpireRequest
+	if err = req.BindBody(&input); err != nil {
+		return err
+	}
+
+	if input.Expires != "" {
+		if _, err := time.Parse(time.RFC3339, input.Expires); err != nil {
+			return err
+		}
+	}
+
+	return expire(input.ID, input.Token, input.Expires)
+}
+
+func main() {
+	function := api.NewCloudFunc()
+	if err := run(function); err == nil {
+		function.SendResponse(&ExpireResponse{})
+	} else {
+		function.SendResponse(&ExpireResponse{Error: err.Error()})
+	}
+}
@@ -1,40 +1,45 @@
 module github.com/schmich/stash
 
+go 1.24
+
 require (
 	cloud.google.com/go v0.27.0
+	github.com/flowup/cloudfunc v0.0.0-20170925142805-12ec42c93271
+	github.com/howeyc/gopass v0.0.0-20170109162249-bf9dde6d0d2c
+	github.com/jawher/mow.cli v1.0.4
+	github.com/mattn/go-isatty v0.0.4
+	github.com/mitchellh/go-homedir v1.0.0
+	github.com/pkg/errors v0.8.0
+	github.com/sirupsen/logrus v1.0.6
+	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793
+	golang.org/x/oauth2 v0.0.0-20180821212333-d2e6202438be
+	google.golang.org/api v0.0.0-20180906000440-49a9310a9145
+)
+
+require (
 	contrib.go.opencensus.io/exporter/stackdriver v0.6.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/ddliu/go-httpclient v0.5.1
-	github.com/flowup/cloudfunc v0.0.0-20170925142805-12ec42c93271
 	github.com/fsnotify/fsnotify v1.4.7 // indirect
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
 	github.com/golang/protobuf v1.2.0 // indirect
 	github.com/google/go-cmp v0.2.0 // indirect
 	github.com/google/martian v2.0.0-beta.2+incompatible // indirect
 	github.com/googleapis/gax-go v2.0.0+incompatible // indirect
-	github.com/howeyc/gopass v0.0.0-20170109162249-bf9dde6d0d2c
 	github.com/hpcloud/tail v1.0.0 // indirect
-	github.com/jawher/mow.cli v1.0.4
-	github.com/mattn/go-isatty v0.0.4
-	github.com/mitchellh/go-homedir v1.0.0
 	github.com/onsi/ginkgo v1.6.0 // indirect
 	github.com/onsi/gomega v1.4.1 // indirect
-	github.com/pkg/errors v0.8.0
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/sirupsen/logrus v1.0.6
 	github.com/stretchr/testify v1.2.2 // indirect
 	go.opencensus.io v0.15.0 // indirect
-	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793
 	golang.org/x/net v0.0.0-20180826012351-8a410e7b638d // indirect
-	golang.org/x/oauth2 v0.0.0-20180821212333-d2e6202438be // indirect
 	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f // indirect
 	golang.org/x/sys v0.0.0-20180905080454-ebe1bf3edb33 // indirect
 	golang.org/x/text v0.3.0 // indirect
-	google.golang.org/api v0.0.0-20180906000440-49a9310a9145 // indirect
 	google.golang.org/appengine v1.1.0 // indirect
 	google.golang.org/genproto v0.0.0-20180831171423-11092d34479b // indirect
 	google.golang.org/grpc v1.14.0 // indirect
 	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
 	gopkg.in/fsnotify.v1 v1.4.7 // indirect
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
 	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
@@ -0,0 +1,40 @@
+package owner
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+)
+
+// An owner token is the secret, returned to whoever uploads a stash, that is
+// required to replace or delete it, or change its expiry. Storage keeps
+// only its hash.
+
+// ErrMismatch is the error modifying a stash without its owner token.
+var ErrMismatch = errors.New("owner token does not match")
+
+func NewToken() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(random), nil
+}
+
+func Hash(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// Check verifies token against the hash kept for a stash. A stash kept
+// without one, from before owner tokens, cannot be modified.
+func Check(hash, token string) error {
+	if hash == "" || token == "" || subtle.ConstantTimeCompare([]byte(hash), []byte(Hash(token))) != 1 {
+		return ErrMismatch
+	}
+
+	return nil
+}
@@ -4,19 +4,38 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"io"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/flowup/cloudfunc/api"
+	"github.com/schmich/stash/signer"
 )
 
 type PasteRequest struct {
-	ID string `json:"id"`
+	ID     string `json:"id"`
+	Stream bool   `json:"stream,omitempty"`
 }
 
 type PasteResponse struct {
-	Payload string `json:"payload,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Payload string            `json:"payload,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+var errExpired = errors.New("stash expired")
+
+// checkExpiry fails for a stash whose metadata says it has expired. The
+// sweep function purges it.
+func checkExpiry(attrs *storage.ObjectAttrs) error {
+	expires, err := time.Parse(time.RFC3339, attrs.Metadata["expires"])
+	if err == nil && !time.Now().Before(expires) {
+		return errExpired
+	}
+
+	return nil
 }
 
 func retrieve(id string) (string, error) {
@@ -29,7 +48,16 @@ func retrieve(id string) (string, error) {
 	bucket := client.Bucket("stash-215008")
 	obj := bucket.Object(id)
 
-	reader, err := obj.NewReader(ctx)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkExpiry(attrs); err != nil {
+		return "", err
+	}
+
+	reader, err := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).NewReader(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -51,25 +79,63 @@ func retrieve(id string) (string, error) {
 	return encoded.String(), nil
 }
 
-func run(function *api.CloudFunc) (string, error) {
+// signDownload returns a signed URL for downloading the stash directly from
+// storage.
+func signDownload(id string) (*PasteResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Report a missing stash here rather than as a failed download.
+	attrs, err := client.Bucket("stash-215008").Object(id).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkExpiry(attrs); err != nil {
+		return nil, err
+	}
+
+	url, headers, err := signer.SignedURL(ctx, "stash-215008", id, "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasteResponse{URL: url, Headers: headers}, nil
+}
+
+func run(function *api.CloudFunc) (*PasteResponse, error) {
 	req, err := function.GetRequest()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var input PasteRequest
 	if err = req.BindBody(&input); err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if input.Stream {
+		return signDownload(input.ID)
+	}
+
+	payload, err := retrieve(input.ID)
+	if err != nil {
+		return nil, err
 	}
 
-	return retrieve(input.ID)
+	return &PasteResponse{Payload: payload}, nil
 }
 
 func main() {
 	function := api.NewCloudFunc()
-	payload, err := run(function)
+	response, err := run(function)
 	if err == nil {
-		function.SendResponse(&PasteResponse{Payload: payload})
+		function.SendResponse(response)
 	} else {
 		function.SendResponse(&PasteResponse{Error: err.Error()})
 	}
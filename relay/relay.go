@@ -0,0 +1,243 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The relay pairs a sender and a receiver by nameplate and then copies bytes
+// between them. It only ever sees ciphertext: the code that encrypts the
+// transfer is never sent to it.
+//
+// A client sends "stash relay v1 <role> <nameplate>\n" and is answered with
+// "wait\n" if it is first to arrive, then "ok\n" once it is paired, or
+// "error <message>\n".
+
+const DefaultAddress = "localhost:4151"
+
+const (
+	RoleSend    = "send"
+	RoleReceive = "receive"
+
+	helloPrefix = "stash relay v1 "
+	maxLine     = 256
+)
+
+var ErrNameplateInUse = errors.New("nameplate is in use")
+
+type waiter struct {
+	conn   net.Conn
+	role   string
+	paired chan net.Conn
+}
+
+type Relay struct {
+	mutex   sync.Mutex
+	waiting map[string]*waiter
+}
+
+func New() *Relay {
+	return &Relay{waiting: make(map[string]*waiter)}
+}
+
+func (relay *Relay) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go relay.handle(conn)
+	}
+}
+
+func readLine(conn net.Conn) (string, error) {
+	// Read a byte at a time so nothing after the line is consumed.
+	var line []byte
+	buf := make([]byte, 1)
+	for len(line) < maxLine {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return "", err
+		}
+
+		if buf[0] == '\n' {
+			return string(line), nil
+		}
+
+		line = append(line, buf[0])
+	}
+
+	return "", errors.New("line too long")
+}
+
+func (relay *Relay) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	hello, err := readLine(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(hello, helloPrefix))
+	if !strings.HasPrefix(hello, helloPrefix) || len(fields) != 2 || (fields[0] != RoleSend && fields[0] != RoleReceive) {
+		fmt.Fprintf(conn, "error invalid request\n")
+		conn.Close()
+		return
+	}
+
+	role, nameplate := fields[0], fields[1]
+
+	relay.mutex.Lock()
+	peer := relay.waiting[nameplate]
+	if peer != nil && peer.role == role {
+		relay.mutex.Unlock()
+		fmt.Fprintf(conn, "error %s\n", ErrNameplateInUse)
+		conn.Close()
+		return
+	}
+
+	if peer != nil {
+		delete(relay.waiting, nameplate)
+		relay.mutex.Unlock()
+		peer.paired <- conn
+		return
+	}
+
+	self := &waiter{conn: conn, role: role, paired: make(chan net.Conn, 1)}
+	relay.waiting[nameplate] = self
+	relay.mutex.Unlock()
+
+	if _, err := io.WriteString(conn, "wait\n"); err != nil {
+		relay.abandon(nameplate, self)
+		return
+	}
+
+	// Watch for the waiting client going away, so its nameplate is freed.
+	closed := make(chan struct{})
+	go func() {
+		conn.Read(make([]byte, 1))
+		close(closed)
+	}()
+
+	select {
+	case other := <-self.paired:
+		conn.SetReadDeadline(time.Now())
+		<-closed
+		conn.SetReadDeadline(time.Time{})
+		splice(conn, other)
+	case <-closed:
+		relay.abandon(nameplate, self)
+	}
+}
+
+func (relay *Relay) abandon(nameplate string, self *waiter) {
+	relay.mutex.Lock()
+	if relay.waiting[nameplate] == self {
+		delete(relay.waiting, nameplate)
+		relay.mutex.Unlock()
+		self.conn.Close()
+		return
+	}
+	relay.mutex.Unlock()
+
+	// A peer arrived as the client left.
+	other := <-self.paired
+	other.Close()
+	self.conn.Close()
+}
+
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+func splice(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+
+	for _, conn := range []net.Conn{a, b} {
+		if _, err := io.WriteString(conn, "ok\n"); err != nil {
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(b, a)
+		closeWrite(b)
+		close(done)
+	}()
+
+	io.Copy(a, b)
+	closeWrite(a)
+	<-done
+}
+
+// Conn is a connection to a peer through the relay.
+type Conn struct {
+	net.Conn
+	paired bool
+}
+
+// Dial claims nameplate on the relay for role. It returns once the relay has
+// accepted the nameplate, which may be before a peer has joined.
+func Dial(address, role, nameplate string) (*Conn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s%s %s\n", helloPrefix, role, nameplate); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	relayConn := &Conn{Conn: conn}
+	if err := relayConn.expect(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return relayConn, nil
+}
+
+func (conn *Conn) expect() error {
+	line, err := readLine(conn.Conn)
+	if err != nil {
+		return fmt.Errorf("relay: %s", err)
+	}
+
+	switch {
+	case line == "ok":
+		conn.paired = true
+		return nil
+	case line == "wait":
+		return nil
+	case line == "error "+ErrNameplateInUse.Error():
+		return ErrNameplateInUse
+	case strings.HasPrefix(line, "error "):
+		return fmt.Errorf("relay: %s", strings.TrimPrefix(line, "error "))
+	default:
+		return fmt.Errorf("relay: unexpected response \"%s\"", line)
+	}
+}
+
+// Wait blocks until a peer has joined.
+func (conn *Conn) Wait() error {
+	for !conn.paired {
+		if err := conn.expect(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
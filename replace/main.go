@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/flowup/cloudfunc/api"
+	"github.com/schmich/stash/owner"
+	"github.com/schmich/stash/signer"
+)
+
+type ReplaceRequest struct {
+	ID      string `json:"id"`
+	Token   string `json:"token"`
+	Payload string `json:"payload"`
+	Stream  bool   `json:"stream,omitempty"`
+}
+
+type ReplaceResponse struct {
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+func replace(id string, token string, encodedPayload string) error {
+	// Cancelling the context abandons a partial write.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	bucket := client.Bucket("stash-215008")
+	obj := bucket.Object(id)
+
+	// Only overwrite the stash as it exists now, never create one.
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := owner.Check(attrs.Metadata["owner"], token); err != nil {
+		return err
+	}
+
+	writer := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).NewWriter(ctx)
+	writer.Metadata = attrs.Metadata
+	reader := base64.NewDecoder(base64.StdEncoding, strings.NewReader(encodedPayload))
+	if _, err := io.Copy(writer, reader); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// signReplace returns a signed URL for uploading the replacement directly
+// to storage. An upload that is never completed leaves the stash as it was.
+func signReplace(id string, token string) (*ReplaceResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := client.Bucket("stash-215008").Object(id).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := owner.Check(attrs.Metadata["owner"], token); err != nil {
+		return nil, err
+	}
+
+	// The replacement keeps the stash's owner and expiry.
+	conditions := map[string]string{
+		"x-goog-if-generation-match": strconv.FormatInt(attrs.Generation, 10),
+		"x-goog-meta-owner":          attrs.Metadata["owner"],
+	}
+
+	if expires, ok := attrs.Metadata["expires"]; ok {
+		conditions["x-goog-meta-expires"] = expires
+	}
+
+	url, headers, err := signer.SignedURL(ctx, "stash-215008", id, "PUT", conditions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReplaceResponse{URL: url, Headers: headers}, nil
+}
+
+func run(function *api.CloudFunc) (*ReplaceResponse, error) {
+	req, err := function.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	var input ReplaceRequest
+	if err = req.BindBody(&input); err != nil {
+		return nil, err
+	}
+
+	if input.Stream {
+		return signReplace(input.ID, input.Token)
+	}
+
+	return &ReplaceResponse{}, replace(input.ID, input.Token, input.Payload)
+}
+
+func main() {
+	function := api.NewCloudFunc()
+	response, err := run(function)
+	if err == nil {
+		function.SendResponse(response)
+	} else {
+		function.SendResponse(&ReplaceResponse{Error: err.Error()})
+	}
+}
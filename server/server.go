@@ -0,0 +1,738 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schmich/stash/storage"
+)
+
+// The server keeps stashes in any storage.Client. It speaks the JSON API of
+// the Cloud Functions, where payloads are base64 in the request and
+// response, and a raw API that streams them:
+//
+//   PUT  /stashes                      upload: {"id": ..., "token": ...}
+//   GET  /stashes/{id}                 download, honoring "Range: bytes=N-"
+//   PUT  /stashes/{id}                 replace
+//   DELETE /stashes/{id}               delete
+//   PUT  /stashes/{id}/expires         change the expiry to X-Stash-Expires,
+//                                      or remove it if that is absent
+//   GET  /stashes/{id}/stat            describe: {"size": ..., "created": ...}
+//   GET  /stashes                      list: {"ids": [...]}, if allowed
+//   POST /sessions                     start a resumable upload:
+//                                      {"session": ..., "token": ...}
+//   GET  /sessions/{session}           {"offset": ...}
+//   PUT  /sessions/{session}           store the chunk at the offset in
+//                                      Content-Range, verified by X-Content-Sha256
+//   POST /sessions/{session}?size=N    finish the upload: {"id": ...}
+//   DELETE /sessions/{session}         abort the upload
+//
+// Uploads and sessions take an expiry in the X-Stash-Expires header, and
+// copy in the JSON API in "expires", both in RFC 3339 format. In the raw API,
+// they also take a download limit in X-Stash-Max-Downloads, and an expired or
+// consumed stash is answered with 410 Gone. A download counts against the
+// limit as soon as it is served, and one of a limited stash cannot be resumed
+// with a Range, which is answered with 416.
+//
+// Replacing, deleting or changing the expiry of a stash takes the owner token
+// returned when it was uploaded, in the X-Stash-Token header or the JSON
+// "token". A wrong one is answered with 403 Forbidden.
+
+// maxJSONLength bounds requests of the JSON API, which are held in memory.
+const maxJSONLength = 64 * 1024 * 1024
+
+type CopyRequest struct {
+	Payload string `json:"payload"`
+	Expires string `json:"expires,omitempty"`
+}
+
+type CopyResponse struct {
+	ID    string `json:"id,omitempty"`
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type ReplaceRequest struct {
+	ID      string `json:"id"`
+	Token   string `json:"token"`
+	Payload string `json:"payload"`
+}
+
+type ReplaceResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+type PasteRequest struct {
+	ID string `json:"id"`
+}
+
+type PasteResponse struct {
+	Payload string `json:"payload,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type DeleteRequest struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+type DeleteResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+type ExpireRequest struct {
+	ID      string `json:"id"`
+	Token   string `json:"token"`
+	Expires string `json:"expires,omitempty"`
+}
+
+type ExpireResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+type StatRequest struct {
+	ID string `json:"id"`
+}
+
+type StatResponse struct {
+	*storage.StashInfo
+	Error string `json:"error,omitempty"`
+}
+
+type ListResponse struct {
+	IDs   []string `json:"ids"`
+	Error string   `json:"error,omitempty"`
+}
+
+type StashResponse struct {
+	ID    string `json:"id,omitempty"`
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type SessionResponse struct {
+	Session string `json:"session,omitempty"`
+	Token   string `json:"token,omitempty"`
+	Offset  int64  `json:"offset"`
+	Error   string `json:"error,omitempty"`
+}
+
+type Server struct {
+	// AllowList lets anyone list the IDs of the stashes. Their contents stay
+	// encrypted and deleting them still takes owner tokens, but the IDs let
+	// anyone see their sizes with stat.
+	AllowList bool
+
+	// MaxStashSize bounds the size in bytes of the stashes uploaded or
+	// replaced, if set. A larger one is answered with 413 Request Entity Too
+	// Large.
+	MaxStashSize int64
+
+	client storage.Client
+	mux    *http.ServeMux
+}
+
+func New(client storage.Client) *Server {
+	server := &Server{client: client, mux: http.NewServeMux()}
+	server.mux.HandleFunc("POST /copy", server.copy)
+	server.mux.HandleFunc("POST /paste", server.paste)
+	server.mux.HandleFunc("POST /replace", server.replace)
+	server.mux.HandleFunc("POST /delete", server.delete)
+	server.mux.HandleFunc("POST /expire", server.expire)
+	server.mux.HandleFunc("POST /stat", server.stat)
+	server.mux.HandleFunc("PUT /stashes", server.upload)
+	server.mux.HandleFunc("GET /stashes", server.list)
+	server.mux.HandleFunc("GET /stashes/{id}", server.download)
+	server.mux.HandleFunc("PUT /stashes/{id}", server.upload)
+	server.mux.HandleFunc("DELETE /stashes/{id}", server.deleteStash)
+	server.mux.HandleFunc("PUT /stashes/{id}/expires", server.expireStash)
+	server.mux.HandleFunc("GET /stashes/{id}/stat", server.statStash)
+	server.mux.HandleFunc("POST /sessions", server.startSession)
+	server.mux.HandleFunc("GET /sessions/{session}", server.sessionOffset)
+	server.mux.HandleFunc("PUT /sessions/{session}", server.uploadChunk)
+	server.mux.HandleFunc("POST /sessions/{session}", server.finishSession)
+	server.mux.HandleFunc("DELETE /sessions/{session}", server.abortSession)
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+func respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// status returns the status for a failure of the storage.
+func status(err error) int {
+	if storage.IsNotFound(err) {
+		return http.StatusNotFound
+	}
+
+	if err == storage.ErrExpired || err == storage.ErrConsumed {
+		return http.StatusGone
+	}
+
+	if err == storage.ErrNotOwner {
+		return http.StatusForbidden
+	}
+
+	if err == storage.ErrLimitedResume {
+		return http.StatusRequestedRangeNotSatisfiable
+	}
+
+	if storage.IsTransient(err) {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+// message describes a failure of the storage without revealing its paths.
+func message(err error) string {
+	if storage.IsNotFound(err) {
+		return "stash not found"
+	}
+
+	return err.Error()
+}
+
+func parseExpires(value string) (storage.UploadOptions, error) {
+	var options storage.UploadOptions
+	if value == "" {
+		return options, nil
+	}
+
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return options, fmt.Errorf("invalid expiry \"%s\"", value)
+	}
+
+	options.Expires = expires
+	return options, nil
+}
+
+// parseOptions reads the upload options in the headers of a raw upload.
+func parseOptions(r *http.Request) (storage.UploadOptions, error) {
+	options, err := parseExpires(r.Header.Get(storage.ExpiresHeader))
+	if err != nil {
+		return options, err
+	}
+
+	if value := r.Header.Get(storage.MaxDownloadsHeader); value != "" {
+		if options.MaxDownloads, err = strconv.Atoi(value); err != nil || options.MaxDownloads < 1 {
+			return options, fmt.Errorf("invalid download limit \"%s\"", value)
+		}
+	}
+
+	return options, nil
+}
+
+// tooLarge reports whether a stash of size bytes is over MaxStashSize.
+func (server *Server) tooLarge(size int64) bool {
+	return server.MaxStashSize > 0 && size > server.MaxStashSize
+}
+
+func (server *Server) tooLargeMessage() string {
+	return fmt.Sprintf("stash is larger than the %d bytes allowed", server.MaxStashSize)
+}
+
+// payloadSize returns the size of the base64 payload of a JSON request.
+func payloadSize(payload string) int64 {
+	return int64(len(strings.TrimRight(payload, "="))) * 3 / 4
+}
+
+func readJSON(r *http.Request, request interface{}) error {
+	return json.NewDecoder(io.LimitReader(r.Body, maxJSONLength)).Decode(request)
+}
+
+// store copies reader to uploader, made with the context that cancel ends.
+// A failed copy, e.g. of an upload the client broke off, cancels it before
+// closing the uploader, so that the storage discards what it was sent.
+func (server *Server) store(cancel context.CancelFunc, uploader storage.Uploader, reader io.Reader) error {
+	defer cancel()
+	if _, err := io.Copy(uploader, reader); err != nil {
+		cancel()
+		uploader.Close()
+		return err
+	}
+
+	return uploader.Close()
+}
+
+func (server *Server) copy(w http.ResponseWriter, r *http.Request) {
+	var request CopyRequest
+	if err := readJSON(r, &request); err != nil {
+		respond(w, http.StatusOK, &CopyResponse{Error: err.Error()})
+		return
+	}
+
+	options, err := parseExpires(request.Expires)
+	if err != nil {
+		respond(w, http.StatusOK, &CopyResponse{Error: err.Error()})
+		return
+	}
+
+	if server.tooLarge(payloadSize(request.Payload)) {
+		respond(w, http.StatusOK, &CopyResponse{Error: server.tooLargeMessage()})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	uploader := server.client.Upload(ctx, options)
+	payload := base64.NewDecoder(base64.StdEncoding, strings.NewReader(request.Payload))
+	if err := server.store(cancel, uploader, payload); err != nil {
+		respond(w, http.StatusOK, &CopyResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &CopyResponse{ID: uploader.GetID(), Token: uploader.GetToken()})
+}
+
+func (server *Server) replace(w http.ResponseWriter, r *http.Request) {
+	var request ReplaceRequest
+	if err := readJSON(r, &request); err != nil {
+		respond(w, http.StatusOK, &ReplaceResponse{Error: err.Error()})
+		return
+	}
+
+	if server.tooLarge(payloadSize(request.Payload)) {
+		respond(w, http.StatusOK, &ReplaceResponse{Error: server.tooLargeMessage()})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	uploader := server.client.Replace(ctx, request.ID, request.Token)
+	payload := base64.NewDecoder(base64.StdEncoding, strings.NewReader(request.Payload))
+	if err := server.store(cancel, uploader, payload); err != nil {
+		respond(w, http.StatusOK, &ReplaceResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &ReplaceResponse{})
+}
+
+func (server *Server) paste(w http.ResponseWriter, r *http.Request) {
+	var request PasteRequest
+	if err := readJSON(r, &request); err != nil {
+		respond(w, http.StatusOK, &PasteResponse{Error: err.Error()})
+		return
+	}
+
+	downloader := server.client.Download(r.Context(), request.ID)
+	defer downloader.Close()
+
+	var encoded bytes.Buffer
+	encoder := base64.NewEncoder(base64.StdEncoding, &encoded)
+	if _, err := io.Copy(encoder, downloader); err != nil {
+		respond(w, http.StatusOK, &PasteResponse{Error: message(err)})
+		return
+	}
+
+	encoder.Close()
+	respond(w, http.StatusOK, &PasteResponse{Payload: encoded.String()})
+}
+
+func (server *Server) manager() (storage.Manager, error) {
+	manager, ok := server.client.(storage.Manager)
+	if !ok {
+		return nil, errors.New("storage does not support managing stashes")
+	}
+
+	return manager, nil
+}
+
+func (server *Server) delete(w http.ResponseWriter, r *http.Request) {
+	var request DeleteRequest
+	if err := readJSON(r, &request); err != nil {
+		respond(w, http.StatusOK, &DeleteResponse{Error: err.Error()})
+		return
+	}
+
+	manager, err := server.manager()
+	if err == nil {
+		err = manager.Delete(r.Context(), request.ID, request.Token)
+	}
+
+	if err != nil {
+		respond(w, http.StatusOK, &DeleteResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &DeleteResponse{})
+}
+
+func (server *Server) expire(w http.ResponseWriter, r *http.Request) {
+	var request ExpireRequest
+	if err := readJSON(r, &request); err != nil {
+		respond(w, http.StatusOK, &ExpireResponse{Error: err.Error()})
+		return
+	}
+
+	options, err := parseExpires(request.Expires)
+	if err != nil {
+		respond(w, http.StatusOK, &ExpireResponse{Error: err.Error()})
+		return
+	}
+
+	manager, err := server.manager()
+	if err == nil {
+		err = manager.SetExpires(r.Context(), request.ID, request.Token, options.Expires)
+	}
+
+	if err != nil {
+		respond(w, http.StatusOK, &ExpireResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &ExpireResponse{})
+}
+
+func (server *Server) stat(w http.ResponseWriter, r *http.Request) {
+	var request StatRequest
+	if err := readJSON(r, &request); err != nil {
+		respond(w, http.StatusOK, &StatResponse{Error: err.Error()})
+		return
+	}
+
+	manager, err := server.manager()
+	if err != nil {
+		respond(w, http.StatusOK, &StatResponse{Error: err.Error()})
+		return
+	}
+
+	info, err := manager.Stat(r.Context(), request.ID)
+	if err != nil {
+		respond(w, http.StatusOK, &StatResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &StatResponse{StashInfo: info})
+}
+
+func (server *Server) upload(w http.ResponseWriter, r *http.Request) {
+	options, err := parseOptions(r)
+	if err != nil {
+		respond(w, http.StatusBadRequest, &StashResponse{Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	var uploader storage.Uploader
+	if id := r.PathValue("id"); id != "" {
+		uploader = server.client.Replace(ctx, id, r.Header.Get(storage.TokenHeader))
+	} else {
+		uploader = server.client.Upload(ctx, options)
+	}
+
+	body := r.Body
+	if server.MaxStashSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, server.MaxStashSize)
+	}
+
+	if err := server.store(cancel, uploader, body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respond(w, http.StatusRequestEntityTooLarge, &StashResponse{Error: server.tooLargeMessage()})
+			return
+		}
+
+		respond(w, status(err), &StashResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &StashResponse{ID: uploader.GetID(), Token: uploader.GetToken()})
+}
+
+func (server *Server) download(w http.ResponseWriter, r *http.Request) {
+	var offset int64
+	if value := r.Header.Get("Range"); value != "" {
+		if _, err := fmt.Sscanf(value, "bytes=%d-", &offset); err != nil || offset < 0 || value != fmt.Sprintf("bytes=%d-", offset) {
+			respond(w, http.StatusRequestedRangeNotSatisfiable, &StashResponse{Error: "only ranges of the form bytes=N- are supported"})
+			return
+		}
+	}
+
+	id := r.PathValue("id")
+	var downloader io.ReadCloser
+	if resumable, ok := server.client.(storage.ResumableClient); ok {
+		downloader = resumable.DownloadFrom(r.Context(), id, offset)
+	} else {
+		downloader = server.client.Download(r.Context(), id)
+		if _, err := io.CopyN(ioutil.Discard, downloader, offset); err != nil && err != io.EOF {
+			downloader.Close()
+			respond(w, status(err), &StashResponse{Error: message(err)})
+			return
+		}
+	}
+	defer downloader.Close()
+
+	// Read before answering, so that a missing stash is reported as such.
+	buf := make([]byte, 32*1024)
+	count, err := downloader.Read(buf)
+	if count == 0 && err != nil && err != io.EOF {
+		respond(w, status(err), &StashResponse{Error: message(err)})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if offset > 0 {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	w.Write(buf[:count])
+	io.CopyBuffer(w, downloader, buf)
+}
+
+func (server *Server) deleteStash(w http.ResponseWriter, r *http.Request) {
+	manager, err := server.manager()
+	if err != nil {
+		respond(w, http.StatusNotImplemented, &StashResponse{Error: err.Error()})
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := manager.Delete(r.Context(), id, r.Header.Get(storage.TokenHeader)); err != nil {
+		respond(w, status(err), &StashResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &StashResponse{ID: id})
+}
+
+func (server *Server) expireStash(w http.ResponseWriter, r *http.Request) {
+	manager, err := server.manager()
+	if err != nil {
+		respond(w, http.StatusNotImplemented, &StashResponse{Error: err.Error()})
+		return
+	}
+
+	options, err := parseExpires(r.Header.Get(storage.ExpiresHeader))
+	if err != nil {
+		respond(w, http.StatusBadRequest, &StashResponse{Error: err.Error()})
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := manager.SetExpires(r.Context(), id, r.Header.Get(storage.TokenHeader), options.Expires); err != nil {
+		respond(w, status(err), &StashResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &StashResponse{ID: id})
+}
+
+func (server *Server) statStash(w http.ResponseWriter, r *http.Request) {
+	manager, err := server.manager()
+	if err != nil {
+		respond(w, http.StatusNotImplemented, &StatResponse{Error: err.Error()})
+		return
+	}
+
+	info, err := manager.Stat(r.Context(), r.PathValue("id"))
+	if err != nil {
+		respond(w, status(err), &StatResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &StatResponse{StashInfo: info})
+}
+
+func (server *Server) list(w http.ResponseWriter, r *http.Request) {
+	if !server.AllowList {
+		respond(w, http.StatusForbidden, &ListResponse{Error: "listing stashes is not allowed"})
+		return
+	}
+
+	manager, err := server.manager()
+	if err != nil {
+		respond(w, http.StatusNotImplemented, &ListResponse{Error: err.Error()})
+		return
+	}
+
+	ids, err := manager.List(r.Context())
+	if err != nil {
+		respond(w, status(err), &ListResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &ListResponse{IDs: ids})
+}
+
+func (server *Server) resumable(w http.ResponseWriter) storage.ResumableClient {
+	resumable, ok := server.client.(storage.ResumableClient)
+	if !ok {
+		respond(w, http.StatusNotImplemented, &SessionResponse{Error: "storage does not support resumable uploads"})
+	}
+
+	return resumable
+}
+
+// session returns the storage's session for the one in the request path.
+func session(r *http.Request) (string, error) {
+	session, err := base64.RawURLEncoding.DecodeString(r.PathValue("session"))
+	if err != nil {
+		return "", errors.New("invalid upload session")
+	}
+
+	return string(session), nil
+}
+
+func (server *Server) startSession(w http.ResponseWriter, r *http.Request) {
+	resumable := server.resumable(w)
+	if resumable == nil {
+		return
+	}
+
+	options, err := parseOptions(r)
+	if err != nil {
+		respond(w, http.StatusBadRequest, &SessionResponse{Error: err.Error()})
+		return
+	}
+
+	session, token, err := resumable.StartSession(r.Context(), options)
+	if err != nil {
+		respond(w, status(err), &SessionResponse{Error: message(err)})
+		return
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(session))
+	respond(w, http.StatusOK, &SessionResponse{Session: encoded, Token: token})
+}
+
+func (server *Server) sessionOffset(w http.ResponseWriter, r *http.Request) {
+	resumable := server.resumable(w)
+	if resumable == nil {
+		return
+	}
+
+	session, err := session(r)
+	if err != nil {
+		respond(w, http.StatusBadRequest, &SessionResponse{Error: err.Error()})
+		return
+	}
+
+	offset, err := resumable.SessionOffset(r.Context(), session)
+	if err != nil {
+		respond(w, status(err), &SessionResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &SessionResponse{Offset: offset})
+}
+
+func (server *Server) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	resumable := server.resumable(w)
+	if resumable == nil {
+		return
+	}
+
+	session, err := session(r)
+	if err != nil {
+		respond(w, http.StatusBadRequest, &SessionResponse{Error: err.Error()})
+		return
+	}
+
+	var offset, end int64
+	contentRange := r.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/*", &offset, &end); err != nil || offset < 0 || end < offset || end-offset >= storage.ChunkSize {
+		respond(w, http.StatusBadRequest, &SessionResponse{Error: "invalid Content-Range"})
+		return
+	}
+
+	if server.tooLarge(end + 1) {
+		respond(w, http.StatusRequestEntityTooLarge, &SessionResponse{Error: server.tooLargeMessage()})
+		return
+	}
+
+	checksum, err := hex.DecodeString(r.Header.Get("X-Content-Sha256"))
+	if err != nil || len(checksum) != sha256.Size {
+		respond(w, http.StatusBadRequest, &SessionResponse{Error: "invalid X-Content-Sha256"})
+		return
+	}
+
+	chunk := make([]byte, end-offset+1)
+	if _, err := io.ReadFull(r.Body, chunk); err != nil {
+		respond(w, http.StatusBadRequest, &SessionResponse{Error: err.Error()})
+		return
+	}
+
+	digest := sha256.Sum256(chunk)
+	if !bytes.Equal(digest[:], checksum) {
+		respond(w, http.StatusBadRequest, &SessionResponse{Error: "chunk checksum mismatch"})
+		return
+	}
+
+	if err := resumable.UploadChunk(r.Context(), session, offset, chunk, checksum); err != nil {
+		respond(w, status(err), &SessionResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &SessionResponse{Offset: end + 1})
+}
+
+func (server *Server) finishSession(w http.ResponseWriter, r *http.Request) {
+	resumable := server.resumable(w)
+	if resumable == nil {
+		return
+	}
+
+	session, err := session(r)
+	if err != nil {
+		respond(w, http.StatusBadRequest, &StashResponse{Error: err.Error()})
+		return
+	}
+
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil {
+		respond(w, http.StatusBadRequest, &StashResponse{Error: "invalid size"})
+		return
+	}
+
+	if server.tooLarge(size) {
+		respond(w, http.StatusRequestEntityTooLarge, &StashResponse{Error: server.tooLargeMessage()})
+		return
+	}
+
+	id, err := resumable.FinishSession(r.Context(), session, size)
+	if err != nil {
+		respond(w, status(err), &StashResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &StashResponse{ID: id})
+}
+
+func (server *Server) abortSession(w http.ResponseWriter, r *http.Request) {
+	resumable := server.resumable(w)
+	if resumable == nil {
+		return
+	}
+
+	session, err := session(r)
+	if err != nil {
+		respond(w, http.StatusBadRequest, &SessionResponse{Error: err.Error()})
+		return
+	}
+
+	if err := resumable.AbortSession(r.Context(), session); err != nil {
+		respond(w, status(err), &SessionResponse{Error: message(err)})
+		return
+	}
+
+	respond(w, http.StatusOK, &SessionResponse{})
+}
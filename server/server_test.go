@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schmich/stash/storage"
+)
+
+// serve runs a server over in-memory storage and returns a client of its raw
+// API.
+func serve(t *testing.T) (*httptest.Server, storage.ResumableClient) {
+	return serveWith(t, New(storage.NewInMemoryClient()))
+}
+
+func serveWith(t *testing.T, handler *Server) (*httptest.Server, storage.ResumableClient) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server, storage.NewHTTPClient(server.URL)
+}
+
+func upload(t *testing.T, client storage.Client, payload string, options storage.UploadOptions) storage.Uploader {
+	uploader := client.Upload(context.Background(), options)
+	if _, err := uploader.Write([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := uploader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return uploader
+}
+
+func download(client storage.ResumableClient, id string, offset int64) (string, error) {
+	downloader := client.DownloadFrom(context.Background(), id, offset)
+	defer downloader.Close()
+	content, err := ioutil.ReadAll(downloader)
+	return string(content), err
+}
+
+// post sends request to the JSON API and decodes its response.
+func post(t *testing.T, server *httptest.Server, path string, request, response interface{}) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	server, client := serve(t)
+	id := upload(t, client, "secret", storage.UploadOptions{MaxDownloads: 2}).GetID()
+
+	// A ranged download would read the stash without counting.
+	if _, err := download(client, id, 1); err != storage.ErrLimitedResume {
+		t.Errorf("ranged download: got %v, want ErrLimitedResume", err)
+	}
+
+	if content, err := download(client, id, 0); err != nil || content != "secret" {
+		t.Errorf("raw download: got %q, %v", content, err)
+	}
+
+	var response PasteResponse
+	post(t, server, "/paste", &PasteRequest{ID: id}, &response)
+	if payload, _ := base64.StdEncoding.DecodeString(response.Payload); string(payload) != "secret" {
+		t.Errorf("JSON paste: got %q, %q", payload, response.Error)
+	}
+
+	if _, err := download(client, id, 0); err != storage.ErrConsumed {
+		t.Errorf("third download: got %v, want ErrConsumed", err)
+	}
+
+	response = PasteResponse{}
+	post(t, server, "/paste", &PasteRequest{ID: id}, &response)
+	if response.Error != storage.ErrConsumed.Error() {
+		t.Errorf("third JSON paste: got %q", response.Error)
+	}
+}
+
+func TestNoDownloadAcknowledgement(t *testing.T) {
+	server, client := serve(t)
+	id := upload(t, client, "secret", storage.UploadOptions{MaxDownloads: 1}).GetID()
+
+	// Nobody can use up a stash without downloading it.
+	res, err := http.Post(server.URL+"/stashes/"+id+"/downloads", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if content, err := download(client, id, 0); err != nil || content != "secret" {
+		t.Errorf("got %q, %v", content, err)
+	}
+}
+
+func TestRawRoutes(t *testing.T) {
+	ctx := context.Background()
+	_, client := serve(t)
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	stash := upload(t, client, "secret", storage.UploadOptions{Expires: expires})
+	id, token := stash.GetID(), stash.GetToken()
+
+	if content, err := download(client, id, 0); err != nil || content != "secret" {
+		t.Errorf("download: got %q, %v", content, err)
+	}
+
+	if content, err := download(client, id, 3); err != nil || content != "ret" {
+		t.Errorf("ranged download: got %q, %v", content, err)
+	}
+
+	if _, err := download(client, "missing stash", 0); !storage.IsNotFound(err) {
+		t.Errorf("missing stash: got %v, want not found", err)
+	}
+
+	manager := client.(storage.Manager)
+	info, err := manager.Stat(ctx, id)
+	if err != nil || info.Size != 6 || !info.Expires.Equal(expires) {
+		t.Errorf("stat: %+v, %v", info, err)
+	}
+
+	if _, err := manager.List(ctx); err == nil {
+		t.Error("listed stashes without AllowList")
+	}
+
+	replacer := client.Replace(ctx, id, "wrong")
+	replacer.Write([]byte("forged"))
+	if err := replacer.Close(); err != storage.ErrNotOwner {
+		t.Errorf("replace with another token: got %v, want ErrNotOwner", err)
+	}
+
+	replacer = client.Replace(ctx, id, token)
+	replacer.Write([]byte("rekeyed"))
+	if err := replacer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, err := download(client, id, 0); err != nil || content != "rekeyed" {
+		t.Errorf("replaced stash: got %q, %v", content, err)
+	}
+
+	if err := manager.SetExpires(ctx, id, token, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := download(client, id, 0); err != storage.ErrExpired {
+		t.Errorf("expired stash: got %v, want ErrExpired", err)
+	}
+
+	if err := manager.Delete(ctx, id, "wrong"); err != storage.ErrNotOwner {
+		t.Errorf("delete with another token: got %v, want ErrNotOwner", err)
+	}
+
+	if err := manager.Delete(ctx, id, token); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := manager.Stat(ctx, id); !storage.IsNotFound(err) {
+		t.Errorf("deleted stash: got %v, want not found", err)
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	handler := New(storage.NewInMemoryClient())
+	handler.AllowList = true
+	_, client := serveWith(t, handler)
+	id := upload(t, client, "secret", storage.UploadOptions{}).GetID()
+
+	if ids, err := client.(storage.Manager).List(context.Background()); err != nil || len(ids) != 1 || ids[0] != id {
+		t.Errorf("got %v, %v", ids, err)
+	}
+}
+
+func TestSessionRoutes(t *testing.T) {
+	ctx := context.Background()
+	_, client := serve(t)
+	session, token, err := client.StartSession(ctx, storage.UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := storage.ResumeUpload(ctx, client, session, strings.NewReader("chunked"), 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content, err := download(client, id, 0); err != nil || content != "chunked" {
+		t.Errorf("got %q, %v", content, err)
+	}
+
+	if err := client.(storage.Manager).Delete(ctx, id, token); err != nil {
+		t.Errorf("delete with the session's token: %s", err)
+	}
+
+	session, _, err = client.StartSession(ctx, storage.UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.AbortSession(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SessionOffset(ctx, session); err == nil {
+		t.Error("aborted session still open")
+	}
+}
+
+func TestJSONRoutes(t *testing.T) {
+	server, _ := serve(t)
+	payload := base64.StdEncoding.EncodeToString([]byte("secret"))
+	var copied CopyResponse
+	post(t, server, "/copy", &CopyRequest{Payload: payload}, &copied)
+	if copied.Error != "" {
+		t.Fatal(copied.Error)
+	}
+
+	var replaced ReplaceResponse
+	post(t, server, "/replace", &ReplaceRequest{ID: copied.ID, Token: "wrong", Payload: payload}, &replaced)
+	if replaced.Error != storage.ErrNotOwner.Error() {
+		t.Errorf("replace with another token: got %q", replaced.Error)
+	}
+
+	var stat StatResponse
+	post(t, server, "/stat", &StatRequest{ID: copied.ID}, &stat)
+	if stat.Error != "" || stat.StashInfo == nil || stat.Size != 6 {
+		t.Errorf("stat: %+v", stat)
+	}
+
+	var pasted PasteResponse
+	post(t, server, "/paste", &PasteRequest{ID: copied.ID}, &pasted)
+	if pasted.Payload != payload {
+		t.Errorf("paste: got %q, %q", pasted.Payload, pasted.Error)
+	}
+
+	var deleted DeleteResponse
+	post(t, server, "/delete", &DeleteRequest{ID: copied.ID, Token: copied.Token}, &deleted)
+	if deleted.Error != "" {
+		t.Errorf("delete: %s", deleted.Error)
+	}
+
+	pasted = PasteResponse{}
+	post(t, server, "/paste", &PasteRequest{ID: copied.ID}, &pasted)
+	if pasted.Error != "stash not found" {
+		t.Errorf("deleted stash: got %q", pasted.Error)
+	}
+}
+
+func TestMaxStashSize(t *testing.T) {
+	handler := New(storage.NewInMemoryClient())
+	handler.MaxStashSize = 4
+	server, client := serveWith(t, handler)
+
+	put := func(path string, body string, headers map[string]string) int {
+		req, err := http.NewRequest("PUT", server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := put("/stashes", "small", nil); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("raw upload: got %d, want 413", status)
+	}
+
+	if status := put("/stashes", "tiny", nil); status != http.StatusOK {
+		t.Errorf("raw upload within the limit: got %d", status)
+	}
+
+	session, _, err := client.StartSession(context.Background(), storage.UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := sha256.Sum256([]byte("small"))
+	headers := map[string]string{"Content-Range": "bytes 0-4/*", "X-Content-Sha256": hex.EncodeToString(checksum[:])}
+	if status := put("/sessions/"+session, "small", headers); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("session chunk: got %d, want 413", status)
+	}
+
+	var copied CopyResponse
+	post(t, server, "/copy", &CopyRequest{Payload: base64.StdEncoding.EncodeToString([]byte("small"))}, &copied)
+	if copied.Error == "" {
+		t.Error("JSON copy over the limit succeeded")
+	}
+}
@@ -0,0 +1,74 @@
+package signer
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iamcredentials/v1"
+)
+
+// Expiry bounds when a signed request may start, not how long it may run.
+const Expiry = 15 * time.Minute
+
+const ContentType = "application/octet-stream"
+
+// SignedURL returns a URL granting method on an object in bucket, signed as
+// the function's service account without needing its private key. Requests
+// must send the returned headers.
+func SignedURL(ctx context.Context, bucket, object, method string, headers map[string]string) (string, map[string]string, error) {
+	account, err := metadata.Get("instance/service-accounts/default/email")
+	if err != nil {
+		return "", nil, err
+	}
+
+	client, err := google.DefaultClient(ctx, iamcredentials.CloudPlatformScope)
+	if err != nil {
+		return "", nil, err
+	}
+
+	service, err := iamcredentials.New(client)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sign := func(content []byte) ([]byte, error) {
+		name := fmt.Sprintf("projects/-/serviceAccounts/%s", account)
+		request := &iamcredentials.SignBlobRequest{Payload: base64.StdEncoding.EncodeToString(content)}
+		response, err := service.Projects.ServiceAccounts.SignBlob(name, request).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+
+		return base64.StdEncoding.DecodeString(response.SignedBlob)
+	}
+
+	options := &storage.SignedURLOptions{
+		GoogleAccessID: account,
+		SignBytes:      sign,
+		Method:         method,
+		Expires:        time.Now().Add(Expiry),
+	}
+
+	required := make(map[string]string)
+	if method == "PUT" || method == "POST" {
+		options.ContentType = ContentType
+		required["Content-Type"] = ContentType
+	}
+
+	for name, value := range headers {
+		options.Headers = append(options.Headers, name+":"+value)
+		required[name] = value
+	}
+
+	url, err := storage.SignedURL(bucket, object, options)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return url, required, nil
+}
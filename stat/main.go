@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/flowup/cloudfunc/api"
+)
+
+type StatRequest struct {
+	ID string `json:"id"`
+}
+
+type StatResponse struct {
+	ID      string    `json:"id,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	Created time.Time `json:"created,omitzero"`
+	Expires time.Time `json:"expires,omitzero"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func stat(id string) (*StatResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := client.Bucket("stash-215008").Object(id).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// An unparsable expiry is left zero, as paste ignores it.
+	expires, _ := time.Parse(time.RFC3339, attrs.Metadata["expires"])
+	return &StatResponse{ID: id, Size: attrs.Size, Created: attrs.Created, Expires: expires}, nil
+}
+
+func run(function *api.CloudFunc) (*StatResponse, error) {
+	req, err := function.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	var input StatRequest
+	if err = req.BindBody(&input); err != nil {
+		return nil, err
+	}
+
+	return stat(input.ID)
+}
+
+func main() {
+	function := api.NewCloudFunc()
+	response, err := run(function)
+	if err == nil {
+		function.SendResponse(response)
+	} else {
+		function.SendResponse(&StatResponse{Error: err.Error()})
+	}
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DefaultBackend is the hosted storage behind Cloud Functions.
+const DefaultBackend = "gcp://us-central1-stash-215008.cloudfunctions.net"
+
+// An Opener returns the client for a backend URL of its scheme.
+type Opener func(backend *url.URL) (Client, error)
+
+var openers = make(map[string]Opener)
+
+// Register makes a backend available by URL scheme, e.g. "file" for
+// file:///var/stash.
+func Register(scheme string, open Opener) {
+	if _, ok := openers[scheme]; ok {
+		panic("storage: backend registered twice: " + scheme)
+	}
+
+	openers[scheme] = open
+}
+
+// Open returns the client for backend, a URL whose scheme selects the kind
+// of storage.
+func Open(backend string) (Client, error) {
+	location, err := url.Parse(backend)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend \"%s\": %s", backend, err)
+	}
+
+	open, ok := openers[strings.ToLower(location.Scheme)]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend \"%s\", expected a URL with scheme %s", backend, strings.Join(schemes(), ", "))
+	}
+
+	return open(location)
+}
+
+func schemes() []string {
+	var names []string
+	for scheme := range openers {
+		names = append(names, scheme+"://")
+	}
+
+	sort.Strings(names)
+	return names
+}
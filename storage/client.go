@@ -1,15 +1,127 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"io"
+	"os"
+	"time"
+
+	"github.com/schmich/stash/identifier"
+	"github.com/schmich/stash/owner"
 )
 
+// ErrExpired is the error reading a stash past its expiry.
+var ErrExpired = errors.New("stash expired")
+
+// ErrConsumed is the error reading a stash that has been downloaded as many
+// times as it allows.
+var ErrConsumed = errors.New("stash already consumed")
+
+// ErrNotOwner is the error modifying a stash without its owner token.
+var ErrNotOwner = owner.ErrMismatch
+
+// ErrLimitedResume is the error resuming a download of a stash with a
+// download limit part way, which would read it without counting.
+var ErrLimitedResume = errors.New("downloads of a stash with a download limit cannot be resumed")
+
+// errIDsTaken is the error uploading a stash when every ID tried is taken.
+var errIDsTaken = errors.New("no unused stash ID found, try again")
+
+// IDs are short enough to collide, so uploads that find the one picked by
+// newID taken try up to maxIDAttempts others.
+const maxIDAttempts = 16
+
+var newID = identifier.New
+
+// errDownloadLimit is the error uploading a stash with a download limit to
+// storage that cannot enforce one.
+var errDownloadLimit = errors.New("this storage cannot limit downloads")
+
+// UploadOptions apply to a new stash.
+type UploadOptions struct {
+	// Expires is when the stash expires, if set. An expired stash cannot be
+	// downloaded and is eventually purged.
+	Expires time.Time
+
+	// MaxDownloads is how many times the stash can be downloaded, if set.
+	// A download counts as soon as it starts, and the one that reaches the
+	// limit deletes the stash.
+	MaxDownloads int
+}
+
+// IsExpired reports whether expires is set and past.
+func IsExpired(expires time.Time) bool {
+	return !expires.IsZero() && !time.Now().Before(expires)
+}
+
+// IsNotFound reports whether err is the error reading a stash that does not
+// exist.
+func IsNotFound(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// Client keeps stashes. Transfers stop when their context is done, and an
+// uploader closed after its context is done discards the upload, so
+// cancelling the context and closing the uploader aborts it.
 type Client interface {
-	Upload() Uploader
-	Download(string) io.ReadCloser
+	Upload(context.Context, UploadOptions) Uploader
+
+	// Replace overwrites the existing stash with the given ID and owner
+	// token once the uploader is closed. The stash keeps its upload options
+	// and token.
+	Replace(ctx context.Context, id string, token string) Uploader
+
+	// Download reads the stash with the given ID. A stash with a download
+	// limit counts the download before any of it is read, under a lock or
+	// transaction so that concurrent downloads each count, and fails with
+	// ErrConsumed once the limit is used up.
+	Download(context.Context, string) io.ReadCloser
 }
 
 type Uploader interface {
 	io.WriteCloser
 	GetID() string
-}
\ No newline at end of file
+
+	// GetToken returns the owner token of a new stash, once it is closed.
+	GetToken() string
+}
+
+// StashInfo describes a stash without downloading it.
+type StashInfo struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+
+	// Created is when the stash was uploaded, or last replaced.
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"`
+
+	// MaxDownloads is the stash's download limit, if set, of which
+	// Downloads have been used.
+	MaxDownloads int `json:"max_downloads,omitempty"`
+	Downloads    int `json:"downloads,omitempty"`
+}
+
+// Manager is a client that manages stashes by ID.
+type Manager interface {
+	// Delete removes the stash with the given ID and owner token.
+	Delete(ctx context.Context, id string, token string) error
+
+	// SetExpires changes when the stash with the given ID and owner token
+	// expires. The zero time keeps it until it is deleted.
+	SetExpires(ctx context.Context, id string, token string, expires time.Time) error
+
+	// Stat describes a stash. A consumed stash, whose payload is gone, fails
+	// with ErrConsumed.
+	Stat(context.Context, string) (*StashInfo, error)
+
+	// List returns the IDs of the stashes in storage.
+	List(context.Context) ([]string, error)
+}
+
+// Sweeper is a client that purges expired stashes on request, rather than
+// leaving it to the storage itself.
+type Sweeper interface {
+	// Sweep purges expired stashes and returns how many there were.
+	Sweep() (int, error)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+// clients returns the backends that keep stashes locally, empty.
+func clients(t *testing.T) map[string]ResumableClient {
+	return map[string]ResumableClient{
+		"file": NewFilesystemClient(t.TempDir()),
+		"mem":  NewInMemoryClient(),
+	}
+}
+
+func upload(t *testing.T, client Client, payload string, options UploadOptions) Uploader {
+	uploader := client.Upload(context.Background(), options)
+	if _, err := uploader.Write([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := uploader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return uploader
+}
+
+func read(downloader io.ReadCloser) (string, error) {
+	defer downloader.Close()
+	content, err := ioutil.ReadAll(downloader)
+	return string(content), err
+}
+
+func TestDownloadLimit(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		id := upload(t, client, "secret", UploadOptions{MaxDownloads: 2}).GetID()
+		for i := 0; i < 2; i++ {
+			if content, err := read(client.Download(ctx, id)); err != nil || content != "secret" {
+				t.Errorf("%s: download %d: got %q, %v", name, i+1, content, err)
+			}
+		}
+
+		if _, err := read(client.Download(ctx, id)); err != ErrConsumed {
+			t.Errorf("%s: download 3: got %v, want ErrConsumed", name, err)
+		}
+
+		if _, err := client.(Manager).Stat(ctx, id); err != ErrConsumed {
+			t.Errorf("%s: stat: got %v, want ErrConsumed", name, err)
+		}
+	}
+}
+
+func TestDownloadCountedBeforeRead(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		id := upload(t, client, "secret", UploadOptions{MaxDownloads: 1}).GetID()
+
+		// A download that is opened and abandoned still counts.
+		downloader := client.Download(ctx, id)
+		buf := make([]byte, 1)
+		if _, err := downloader.Read(buf); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if _, err := read(client.Download(ctx, id)); err != ErrConsumed {
+			t.Errorf("%s: second download: got %v, want ErrConsumed", name, err)
+		}
+
+		// The download that claimed the stash reads all of it.
+		if content, err := read(downloader); err != nil || content != "ecret" {
+			t.Errorf("%s: rest of first download: got %q, %v", name, content, err)
+		}
+	}
+}
+
+func TestConcurrentBurn(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		id := upload(t, client, "secret", UploadOptions{MaxDownloads: 1}).GetID()
+
+		var wait sync.WaitGroup
+		results := make(chan error, 8)
+		for i := 0; i < cap(results); i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				content, err := read(client.Download(ctx, id))
+				if err == nil && content != "secret" {
+					t.Errorf("%s: got %q", name, content)
+				}
+				results <- err
+			}()
+		}
+
+		wait.Wait()
+		close(results)
+
+		downloads := 0
+		for err := range results {
+			if err == nil {
+				downloads++
+			} else if err != ErrConsumed {
+				t.Errorf("%s: got %v, want ErrConsumed", name, err)
+			}
+		}
+
+		if downloads != 1 {
+			t.Errorf("%s: burn stash downloaded %d times", name, downloads)
+		}
+	}
+}
+
+func TestLimitedResume(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		limited := upload(t, client, "secret", UploadOptions{MaxDownloads: 1}).GetID()
+		if _, err := read(client.DownloadFrom(ctx, limited, 1)); err != ErrLimitedResume {
+			t.Errorf("%s: resumed limited download: got %v, want ErrLimitedResume", name, err)
+		}
+
+		// The refused download did not count.
+		if content, err := read(client.Download(ctx, limited)); err != nil || content != "secret" {
+			t.Errorf("%s: download: got %q, %v", name, content, err)
+		}
+
+		unlimited := upload(t, client, "secret", UploadOptions{}).GetID()
+		for i := 0; i < 3; i++ {
+			if content, err := read(client.DownloadFrom(ctx, unlimited, 2)); err != nil || content != "cret" {
+				t.Errorf("%s: resumed download: got %q, %v", name, content, err)
+			}
+		}
+	}
+}
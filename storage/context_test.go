@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCancelledUpload(t *testing.T) {
+	for name, client := range clients(t) {
+		stash := upload(t, client, "original", UploadOptions{})
+
+		// Cancelling before Close discards the upload, or the replacement.
+		ctx, cancel := context.WithCancel(context.Background())
+		uploader := client.Upload(ctx, UploadOptions{})
+		uploader.Write([]byte("partial"))
+		replacer := client.Replace(ctx, stash.GetID(), stash.GetToken())
+		replacer.Write([]byte("partial"))
+		cancel()
+
+		if err := uploader.Close(); err != context.Canceled {
+			t.Errorf("%s: upload: got %v, want context.Canceled", name, err)
+		}
+
+		if err := replacer.Close(); err != context.Canceled {
+			t.Errorf("%s: replace: got %v, want context.Canceled", name, err)
+		}
+
+		if ids, err := client.(Manager).List(context.Background()); err != nil || len(ids) != 1 || ids[0] != stash.GetID() {
+			t.Errorf("%s: got %v, %v", name, ids, err)
+		}
+
+		if content, err := read(client.Download(context.Background(), stash.GetID())); err != nil || content != "original" {
+			t.Errorf("%s: replaced stash: got %q, %v", name, content, err)
+		}
+	}
+
+	// Nothing is left behind in the directory, either.
+	directory := t.TempDir()
+	client := NewFilesystemClient(directory)
+	ctx, cancel := context.WithCancel(context.Background())
+	uploader := client.Upload(ctx, UploadOptions{})
+	uploader.Write([]byte("partial"))
+	cancel()
+	uploader.Close()
+
+	if files, err := ioutil.ReadDir(directory); err != nil || len(files) != 0 {
+		t.Errorf("cancelled upload left %d files, %v", len(files), err)
+	}
+}
+
+func TestCancelledDownload(t *testing.T) {
+	for name, client := range clients(t) {
+		id := upload(t, client, "secret", UploadOptions{}).GetID()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := read(client.Download(ctx, id)); err != context.Canceled {
+			t.Errorf("%s: got %v, want context.Canceled", name, err)
+		}
+
+		// A download stops at the first read after it is cancelled.
+		ctx, cancel = context.WithCancel(context.Background())
+		downloader := client.Download(ctx, id)
+		buf := make([]byte, 2)
+		if _, err := downloader.Read(buf); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		cancel()
+		if _, err := read(downloader); err != context.Canceled {
+			t.Errorf("%s: after cancelling: got %v, want context.Canceled", name, err)
+		}
+	}
+}
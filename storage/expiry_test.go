@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		manager := client.(Manager)
+		expired := upload(t, client, "expired", UploadOptions{Expires: time.Now().Add(-time.Minute)})
+		later := upload(t, client, "later", UploadOptions{Expires: time.Now().Add(time.Hour)})
+		forever := upload(t, client, "forever", UploadOptions{})
+
+		if _, err := read(client.Download(ctx, expired.GetID())); err != ErrExpired {
+			t.Errorf("%s: expired stash: got %v, want ErrExpired", name, err)
+		}
+
+		if _, err := read(client.DownloadFrom(ctx, expired.GetID(), 2)); err != ErrExpired {
+			t.Errorf("%s: ranged download of expired stash: got %v, want ErrExpired", name, err)
+		}
+
+		if content, err := read(client.Download(ctx, later.GetID())); err != nil || content != "later" {
+			t.Errorf("%s: unexpired stash: got %q, %v", name, content, err)
+		}
+
+		// The owner moves the expiry, or removes it.
+		if err := manager.SetExpires(ctx, forever.GetID(), forever.GetToken(), time.Now().Add(-time.Second)); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if err := manager.SetExpires(ctx, later.GetID(), later.GetToken(), time.Time{}); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if info, err := manager.Stat(ctx, later.GetID()); err != nil || !info.Expires.IsZero() {
+			t.Errorf("%s: stat after removing expiry: %+v, %v", name, info, err)
+		}
+
+		count, err := client.(Sweeper).Sweep()
+		if err != nil || count != 2 {
+			t.Errorf("%s: swept %d, %v, want 2", name, count, err)
+		}
+
+		for _, id := range []string{expired.GetID(), forever.GetID()} {
+			if _, err := manager.Stat(ctx, id); !IsNotFound(err) {
+				t.Errorf("%s: swept stash %s: got %v, want not found", name, id, err)
+			}
+		}
+
+		if ids, err := manager.List(ctx); err != nil || len(ids) != 1 || ids[0] != later.GetID() {
+			t.Errorf("%s: after sweep: got %v, %v", name, ids, err)
+		}
+
+		if count, err := client.(Sweeper).Sweep(); err != nil || count != 0 {
+			t.Errorf("%s: swept again %d, %v", name, count, err)
+		}
+	}
+}
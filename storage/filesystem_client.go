@@ -1,12 +1,23 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/schmich/stash/identifier"
+	"github.com/schmich/stash/owner"
 )
 
 type filesystemClient struct {
@@ -14,17 +25,56 @@ type filesystemClient struct {
 }
 
 type filesystemUploader struct {
+	ctx    context.Context
 	writer io.WriteCloser
 	err    error
 	id     string
+	token  string
+
+	// The temporary file written, and the path it is renamed to on Close.
+	tempPath string
+	path     string
+
+	// Set for a new stash, whose metadata goes if the upload is discarded.
+	newStash bool
 }
 
 type filesystemDownloader struct {
+	ctx    context.Context
 	reader io.ReadCloser
 	err    error
 }
 
-func NewFilesystemClient(directory string) Client {
+// filesystemMetadata is kept beside a stash with its owner token's hash and
+// upload options, in a hidden file named for it.
+type filesystemMetadata struct {
+	Owner        string    `json:"owner"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads,omitempty"`
+}
+
+// The download count of a stash is updated under a lock file, so that
+// concurrent downloads, even by other processes, each count. A lock older
+// than staleLockAge is left by a process that died holding it.
+const (
+	staleLockAge = 30 * time.Second
+	lockTimeout  = 10 * time.Second
+)
+
+func init() {
+	// file:///var/stash is absolute, file://stash relative.
+	Register("file", func(backend *url.URL) (Client, error) {
+		directory := backend.Host + backend.Path
+		if directory == "" {
+			return nil, errors.New("file backend needs a directory, e.g. file:///var/stash")
+		}
+
+		return NewFilesystemClient(filepath.FromSlash(directory)), nil
+	})
+}
+
+func NewFilesystemClient(directory string) ResumableClient {
 	return &filesystemClient{directory: directory}
 }
 
@@ -45,34 +95,202 @@ func (client *filesystemClient) ensureStorageExists() error {
 	return nil
 }
 
-func (client *filesystemClient) Upload() Uploader {
+func (client *filesystemClient) Upload(ctx context.Context, options UploadOptions) Uploader {
 	err := client.ensureStorageExists()
 	if err != nil {
 		return &filesystemUploader{err: err}
 	}
 
-	id, err := identifier.New()
+	token, err := owner.NewToken()
+	if err != nil {
+		return &filesystemUploader{err: err}
+	}
+
+	// The stash appears only once complete, so a cancelled upload leaves
+	// nothing to download.
+	metadata := newMetadata(options, token)
+	id, err := client.reserve(func(path string) error {
+		return createMetadata(path, metadata)
+	})
 	if err != nil {
 		return &filesystemUploader{err: err}
 	}
 
 	path := filepath.Join(client.directory, id)
-	file, err := os.Create(path)
+
+	file, err := ioutil.TempFile(client.directory, "."+id+".")
 	if err != nil {
+		os.Remove(metadataPath(path))
 		return &filesystemUploader{err: err}
 	}
 
-	return &filesystemUploader{writer: file, id: id}
+	return &filesystemUploader{ctx: ctx, writer: file, id: id, token: token, tempPath: file.Name(), path: path, newStash: true}
 }
 
-func (client *filesystemClient) Download(id string) io.ReadCloser {
-	path := filepath.Join(client.directory, id)
-	file, err := os.Open(path)
+func metadataPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".meta")
+}
+
+// newMetadata records the owner and options of a new stash.
+func newMetadata(options UploadOptions, token string) *filesystemMetadata {
+	return &filesystemMetadata{
+		Owner:        owner.Hash(token),
+		Expires:      options.Expires.UTC(),
+		MaxDownloads: options.MaxDownloads,
+	}
+}
+
+// reserve picks an unused ID and claims it with create, which is given the
+// stash's path and fails with an error satisfying os.IsExist when the ID is
+// taken. Another is tried then, so a new stash never replaces one.
+func (client *filesystemClient) reserve(create func(path string) error) (string, error) {
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		id, err := newID()
+		if err != nil {
+			return "", err
+		}
+
+		path := filepath.Join(client.directory, id)
+		if err := create(path); os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		// Stashes from before metadata have none to collide with.
+		if _, err := os.Stat(path); err == nil {
+			os.Remove(metadataPath(path))
+			continue
+		}
+
+		return id, nil
+	}
+
+	return "", errIDsTaken
+}
+
+// createMetadata stores the metadata of the new stash at path, unless the
+// stash already has some.
+func createMetadata(path string, metadata *filesystemMetadata) error {
+	return storeMetadata(path, metadata, os.Link)
+}
+
+// saveMetadata replaces the metadata of the stash at path in one step, so
+// that it is never read half written.
+func saveMetadata(path string, metadata *filesystemMetadata) error {
+	return storeMetadata(path, metadata, os.Rename)
+}
+
+// storeMetadata writes the metadata to a temporary file and moves it in
+// place with move.
+func storeMetadata(path string, metadata *filesystemMetadata, move func(string, string) error) error {
+	content, err := json.Marshal(metadata)
 	if err != nil {
-		return &filesystemDownloader{err: err}
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = move(file.Name(), metadataPath(path))
 	}
 
-	return &filesystemDownloader{reader: file}
+	// A link leaves the temporary file behind.
+	os.Remove(file.Name())
+	return err
+}
+
+// consumed reports whether the stash has been downloaded as many times as it
+// allows. Its metadata is kept to tell it from a stash that never existed.
+func (metadata *filesystemMetadata) consumed() bool {
+	return metadata.MaxDownloads > 0 && metadata.Downloads >= metadata.MaxDownloads
+}
+
+// lock takes the lock file of the stash at path and returns the function
+// that releases it.
+func lock(path string) (func(), error) {
+	lockPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".lock")
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(lockPath)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, &transientError{fmt.Errorf("stash is locked: \"%s\"", lockPath)}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readMetadata(path string) (*filesystemMetadata, error) {
+	content, err := ioutil.ReadFile(metadataPath(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &filesystemMetadata{}, nil
+		}
+
+		return nil, err
+	}
+
+	var metadata filesystemMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, err
+	}
+
+	return &metadata, nil
+}
+
+// stashPath keeps IDs, which may come from the network, inside the
+// directory.
+func (client *filesystemClient) stashPath(id string) (string, error) {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("invalid stash ID \"%s\"", id)
+	}
+
+	return filepath.Join(client.directory, id), nil
+}
+
+func (client *filesystemClient) Replace(ctx context.Context, id string, token string) Uploader {
+	path, err := client.stashPath(id)
+	if err != nil {
+		return &filesystemUploader{err: err}
+	}
+
+	if _, err := client.checkOwner(path, token); err != nil {
+		return &filesystemUploader{err: err}
+	}
+
+	file, err := ioutil.TempFile(client.directory, "."+id+".")
+	if err != nil {
+		return &filesystemUploader{err: err}
+	}
+
+	return &filesystemUploader{ctx: ctx, writer: file, id: id, tempPath: file.Name(), path: path}
+}
+
+func (client *filesystemClient) Download(ctx context.Context, id string) io.ReadCloser {
+	return client.DownloadFrom(ctx, id, 0)
 }
 
 func (uploader *filesystemUploader) Write(buf []byte) (int, error) {
@@ -80,6 +298,11 @@ func (uploader *filesystemUploader) Write(buf []byte) (int, error) {
 		return 0, uploader.err
 	}
 
+	if err := uploader.ctx.Err(); err != nil {
+		uploader.discard(err)
+		return 0, err
+	}
+
 	return uploader.writer.Write(buf)
 }
 
@@ -88,18 +311,74 @@ func (uploader *filesystemUploader) Close() error {
 		return uploader.err
 	}
 
-	return uploader.writer.Close()
+	if err := uploader.ctx.Err(); err != nil {
+		uploader.discard(err)
+		return err
+	}
+
+	if err := uploader.writer.Close(); err != nil {
+		uploader.discard(err)
+		return err
+	}
+
+	if err := os.Rename(uploader.tempPath, uploader.path); err != nil {
+		uploader.discard(err)
+		return err
+	}
+
+	return nil
+}
+
+// discard removes what the upload has written, and fails it with err.
+func (uploader *filesystemUploader) discard(err error) {
+	uploader.err = err
+	uploader.writer.Close()
+	os.Remove(uploader.tempPath)
+	if uploader.newStash {
+		os.Remove(metadataPath(uploader.path))
+	}
 }
 
 func (uploader *filesystemUploader) GetID() string {
 	return uploader.id
 }
 
+func (uploader *filesystemUploader) GetToken() string {
+	return uploader.token
+}
+
+// checkOwner returns the metadata of the stash at path, if token is its
+// owner's.
+func (client *filesystemClient) checkOwner(path string, token string) (*filesystemMetadata, error) {
+	metadata, err := readMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.consumed() {
+		return nil, ErrConsumed
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	if err := owner.Check(metadata.Owner, token); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
 func (downloader *filesystemDownloader) Read(buf []byte) (int, error) {
 	if downloader.err != nil {
 		return 0, downloader.err
 	}
 
+	if err := downloader.ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	return downloader.reader.Read(buf)
 }
 
@@ -110,3 +389,389 @@ func (downloader *filesystemDownloader) Close() error {
 
 	return downloader.reader.Close()
 }
+
+func (client *filesystemClient) sessionPath(session string) (string, error) {
+	if _, err := hex.DecodeString(session); err != nil || session == "" {
+		return "", fmt.Errorf("invalid upload session \"%s\"", session)
+	}
+
+	return filepath.Join(client.directory, ".upload-"+session), nil
+}
+
+func (client *filesystemClient) StartSession(ctx context.Context, options UploadOptions) (string, string, error) {
+	if err := client.ensureStorageExists(); err != nil {
+		return "", "", err
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+
+	token, err := owner.NewToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	session := hex.EncodeToString(random)
+	path, err := client.sessionPath(session)
+	if err != nil {
+		return "", "", err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := file.Close(); err != nil {
+		return "", "", err
+	}
+
+	return session, token, saveMetadata(path, newMetadata(options, token))
+}
+
+func (client *filesystemClient) SessionOffset(ctx context.Context, session string) (int64, error) {
+	path, err := client.sessionPath(session)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+func (client *filesystemClient) UploadChunk(ctx context.Context, session string, offset int64, chunk []byte, checksum []byte) error {
+	path, err := client.sessionPath(session)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if offset > info.Size() {
+		return fmt.Errorf("chunk at %d is beyond the %d bytes uploaded", offset, info.Size())
+	}
+
+	// A chunk sent again replaces whatever followed it.
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+
+	if _, err := file.WriteAt(chunk, offset); err != nil {
+		return err
+	}
+
+	written := make([]byte, len(chunk))
+	if _, err := file.ReadAt(written, offset); err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(written)
+	if !bytes.Equal(digest[:], checksum) {
+		file.Truncate(offset)
+		return errors.New("chunk checksum mismatch")
+	}
+
+	return nil
+}
+
+func (client *filesystemClient) FinishSession(ctx context.Context, session string, size int64) (string, error) {
+	offset, err := client.SessionOffset(ctx, session)
+	if err != nil {
+		return "", err
+	}
+
+	if offset != size {
+		return "", fmt.Errorf("upload session has %d bytes, expected %d", offset, size)
+	}
+
+	// The metadata goes first, so the stash never appears without it.
+	path, _ := client.sessionPath(session)
+	id, err := client.reserve(func(stashPath string) error {
+		return os.Link(metadataPath(path), metadataPath(stashPath))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	stashPath := filepath.Join(client.directory, id)
+	if err := os.Rename(path, stashPath); err != nil {
+		os.Remove(metadataPath(stashPath))
+		return "", err
+	}
+
+	os.Remove(metadataPath(path))
+	return id, nil
+}
+
+func (client *filesystemClient) AbortSession(ctx context.Context, session string) error {
+	path, err := client.sessionPath(session)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	if err := os.Remove(metadataPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (client *filesystemClient) DownloadFrom(ctx context.Context, id string, offset int64) io.ReadCloser {
+	if err := ctx.Err(); err != nil {
+		return &filesystemDownloader{err: err}
+	}
+
+	path, err := client.stashPath(id)
+	if err != nil {
+		return &filesystemDownloader{err: err}
+	}
+
+	metadata, err := readMetadata(path)
+	if err != nil {
+		return &filesystemDownloader{err: err}
+	}
+
+	if IsExpired(metadata.Expires) {
+		return &filesystemDownloader{err: ErrExpired}
+	}
+
+	if metadata.MaxDownloads > 0 {
+		return client.claimDownload(ctx, path, offset)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return &filesystemDownloader{err: err}
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return &filesystemDownloader{err: err}
+	}
+
+	return &filesystemDownloader{ctx: ctx, reader: file}
+}
+
+// claimDownload opens the stash at path, which has a download limit, and
+// counts the download before any of it is read. The download that reaches
+// the limit removes the stash, which stays readable through the open file.
+// Its metadata is kept to tell it from a stash that never existed.
+func (client *filesystemClient) claimDownload(ctx context.Context, path string, offset int64) io.ReadCloser {
+	if offset > 0 {
+		return &filesystemDownloader{err: ErrLimitedResume}
+	}
+
+	unlock, err := lock(path)
+	if err != nil {
+		return &filesystemDownloader{err: err}
+	}
+	defer unlock()
+
+	metadata, err := readMetadata(path)
+	if err != nil {
+		return &filesystemDownloader{err: err}
+	}
+
+	if metadata.consumed() {
+		return &filesystemDownloader{err: ErrConsumed}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return &filesystemDownloader{err: err}
+	}
+
+	metadata.Downloads++
+	if err := saveMetadata(path, metadata); err != nil {
+		file.Close()
+		return &filesystemDownloader{err: err}
+	}
+
+	if metadata.consumed() {
+		// On Windows, this fails while the file is open, and Sweep removes
+		// it later.
+		os.Remove(path)
+	}
+
+	return &filesystemDownloader{ctx: ctx, reader: file}
+}
+
+func (client *filesystemClient) Delete(ctx context.Context, id string, token string) error {
+	path, err := client.stashPath(id)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// A consumed stash leaves only its metadata, which still names its owner.
+	metadata, err := readMetadata(path)
+	if err != nil {
+		return err
+	}
+
+	if !metadata.consumed() {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+
+	if err := owner.Check(metadata.Owner, token); err != nil {
+		return err
+	}
+
+	stashErr := os.Remove(path)
+	metadataErr := os.Remove(metadataPath(path))
+	if stashErr != nil && !(os.IsNotExist(stashErr) && metadataErr == nil) {
+		return stashErr
+	}
+
+	if metadataErr != nil && !os.IsNotExist(metadataErr) {
+		return metadataErr
+	}
+
+	return nil
+}
+
+func (client *filesystemClient) SetExpires(ctx context.Context, id string, token string, expires time.Time) error {
+	path, err := client.stashPath(id)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	metadata, err := client.checkOwner(path, token)
+	if err != nil {
+		return err
+	}
+
+	metadata.Expires = expires.UTC()
+	return saveMetadata(path, metadata)
+}
+
+func (client *filesystemClient) Stat(ctx context.Context, id string) (*StashInfo, error) {
+	path, err := client.stashPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := readMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.consumed() {
+		return nil, ErrConsumed
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StashInfo{
+		ID:           id,
+		Size:         info.Size(),
+		Created:      info.ModTime(),
+		Expires:      metadata.Expires,
+		MaxDownloads: metadata.MaxDownloads,
+		Downloads:    metadata.Downloads,
+	}, nil
+}
+
+// List returns the stashes, which are the files that are not hidden.
+func (client *filesystemClient) List(ctx context.Context) ([]string, error) {
+	files, err := ioutil.ReadDir(client.directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var ids []string
+	for _, file := range files {
+		if file.Mode().IsRegular() && !strings.HasPrefix(file.Name(), ".") {
+			ids = append(ids, file.Name())
+		}
+	}
+
+	return ids, nil
+}
+
+// Sweep removes the expired stashes, and uploads, that have metadata, and
+// the consumed stashes that their last download failed to remove.
+func (client *filesystemClient) Sweep() (int, error) {
+	files, err := ioutil.ReadDir(client.directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	count := 0
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".meta") {
+			continue
+		}
+
+		path := filepath.Join(client.directory, strings.TrimSuffix(name[1:], ".meta"))
+		metadata, err := readMetadata(path)
+		if err != nil {
+			return count, err
+		}
+
+		if !IsExpired(metadata.Expires) {
+			if metadata.consumed() {
+				// On Windows, this fails while the download has it open.
+				os.Remove(path)
+			}
+
+			continue
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return count, err
+		}
+
+		if err := os.Remove(metadataPath(path)); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
@@ -2,31 +2,86 @@ package storage
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
-
-	"github.com/ddliu/go-httpclient"
+	"time"
 )
 
+// The functions only sign URLs; stash contents are streamed directly to and
+// from storage, so memory use does not grow with the size of the stash.
+
 type CopyRequest struct {
-	Payload string `json:"payload"`
+	Stream    bool   `json:"stream"`
+	Resumable bool   `json:"resumable,omitempty"`
+	Expires   string `json:"expires,omitempty"`
 }
 
 type CopyResponse struct {
-	ID    string `json:"id,omitempty"`
-	Error string `json:"error,omitempty"`
+	ID      string            `json:"id,omitempty"`
+	Token   string            `json:"token,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+type ReplaceRequest struct {
+	ID     string `json:"id"`
+	Token  string `json:"token"`
+	Stream bool   `json:"stream"`
+}
+
+type ReplaceResponse struct {
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Error   string            `json:"error,omitempty"`
 }
 
 type PasteRequest struct {
-	ID string `json:"id"`
+	ID     string `json:"id"`
+	Stream bool   `json:"stream"`
 }
 
 type PasteResponse struct {
-	Payload string `json:"payload,omitempty"`
-	Error   string `json:"error,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+type DeleteRequest struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+type DeleteResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+type ExpireRequest struct {
+	ID      string `json:"id"`
+	Token   string `json:"token"`
+	Expires string `json:"expires,omitempty"`
+}
+
+type ExpireResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+type StatRequest struct {
+	ID string `json:"id"`
+}
+
+type StatResponse struct {
+	StashInfo
+	Error string `json:"error,omitempty"`
 }
 
 type gcpClient struct {
@@ -34,105 +89,480 @@ type gcpClient struct {
 }
 
 type gcpUploader struct {
-	buffer   bytes.Buffer
-	writer   io.WriteCloser
+	ctx      context.Context
+	writer   *io.PipeWriter
+	done     chan struct{}
+	err      error
 	endpoint string
 	id       string
+	token    string
+	replace  bool
+	options  UploadOptions
 }
 
 type gcpDownloader struct {
-	reader   io.Reader
+	ctx      context.Context
+	body     io.ReadCloser
 	endpoint string
 	id       string
+	offset   int64
 }
 
-func NewGCPClient(endpoint string) Client {
-	return &gcpClient{endpoint: endpoint}
+func init() {
+	Register("gcp", func(backend *url.URL) (Client, error) {
+		return NewGCPClient("https://" + backend.Host + backend.Path), nil
+	})
 }
 
-func (client *gcpClient) Upload() Uploader {
-	uploader := &gcpUploader{endpoint: client.endpoint}
-	uploader.writer = base64.NewEncoder(base64.StdEncoding, &uploader.buffer)
-	return uploader
+func NewGCPClient(endpoint string) ResumableClient {
+	return &gcpClient{endpoint: endpoint}
 }
 
-func (uploader *gcpUploader) GetID() string {
-	return uploader.id
+func (client *gcpClient) Upload(ctx context.Context, options UploadOptions) Uploader {
+	if options.MaxDownloads > 0 {
+		return &gcpUploader{err: errDownloadLimit}
+	}
+
+	return &gcpUploader{ctx: ctx, endpoint: client.endpoint, options: options}
 }
 
-func (uploader *gcpUploader) Write(buf []byte) (int, error) {
-	return uploader.writer.Write(buf)
+func (client *gcpClient) Replace(ctx context.Context, id string, token string) Uploader {
+	return &gcpUploader{ctx: ctx, endpoint: client.endpoint, id: id, token: token, replace: true}
 }
 
-func (uploader *gcpUploader) Close() error {
-	if err := uploader.writer.Close(); err != nil {
+// call posts request to the function at url and decodes its answer into
+// response.
+func call(ctx context.Context, url string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
 		return err
 	}
 
-	payload := uploader.buffer.String()
-	request := CopyRequest{Payload: payload}
-	res, err := httpclient.
-		WithHeader("Content-Type", "application/json").
-		PostJson(uploader.endpoint+"/copy", request)
-
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 
-	body, err := res.ReadAll()
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	var response CopyResponse
-	if err = json.Unmarshal(body, &response); err != nil {
+	return json.NewDecoder(res.Body).Decode(response)
+}
+
+// functionError returns the error a function answered with.
+func functionError(message string) error {
+	switch message {
+	case ErrExpired.Error():
+		return ErrExpired
+	case ErrConsumed.Error():
+		return ErrConsumed
+	case ErrNotOwner.Error():
+		return ErrNotOwner
+	case "storage: object doesn't exist", "stash not found":
+		return fmt.Errorf("%s: %w", message, os.ErrNotExist)
+	}
+
+	return errors.New(message)
+}
+
+func newCopyRequest(resumable bool, options UploadOptions) *CopyRequest {
+	return &CopyRequest{Stream: true, Resumable: resumable, Expires: formatExpires(options.Expires)}
+}
+
+// formatExpires formats an expiry for the functions; zero means never.
+func formatExpires(expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+
+	return expires.UTC().Format(time.RFC3339)
+}
+
+func checkStatus(res *http.Response, expected ...int) error {
+	if len(expected) == 0 {
+		expected = []int{http.StatusOK}
+	}
+
+	for _, status := range expected {
+		if res.StatusCode == status {
+			return nil
+		}
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	err := fmt.Errorf("storage request failed: %s %s", res.Status, body)
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests {
+		return &transientError{err}
+	}
+
+	return err
+}
+
+func (uploader *gcpUploader) GetID() string {
+	return uploader.id
+}
+
+func (uploader *gcpUploader) GetToken() string {
+	return uploader.token
+}
+
+// start gets a signed URL and begins a chunked upload to it, fed by Write.
+func (uploader *gcpUploader) start() error {
+	if uploader.err != nil {
+		return uploader.err
+	}
+
+	var url string
+	var headers map[string]string
+	if uploader.replace {
+		var response ReplaceResponse
+		if err := call(uploader.ctx, uploader.endpoint+"/replace", ReplaceRequest{ID: uploader.id, Token: uploader.token, Stream: true}, &response); err != nil {
+			return err
+		}
+
+		if response.Error != "" {
+			return functionError(response.Error)
+		}
+
+		url, headers = response.URL, response.Headers
+	} else {
+		var response CopyResponse
+		if err := call(uploader.ctx, uploader.endpoint+"/copy", newCopyRequest(false, uploader.options), &response); err != nil {
+			return err
+		}
+
+		if response.Error != "" {
+			return functionError(response.Error)
+		}
+
+		uploader.id, uploader.token = response.ID, response.Token
+		url, headers = response.URL, response.Headers
+	}
+
+	reader, writer := io.Pipe()
+	req, err := http.NewRequestWithContext(uploader.ctx, "PUT", url, reader)
+	if err != nil {
 		return err
 	}
 
-	if response.Error != "" {
-		return errors.New(response.Error)
+	for name, value := range headers {
+		req.Header.Set(name, value)
 	}
 
-	uploader.id = response.ID
+	uploader.writer = writer
+	uploader.done = make(chan struct{})
+	go func() {
+		defer close(uploader.done)
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			err = checkStatus(res)
+			res.Body.Close()
+		}
+
+		// Unblock Write if the upload ends early.
+		reader.CloseWithError(err)
+		uploader.err = err
+	}()
+
 	return nil
 }
 
-func (client *gcpClient) Download(id string) io.ReadCloser {
-	return &gcpDownloader{endpoint: client.endpoint, id: id}
+func (uploader *gcpUploader) Write(buf []byte) (int, error) {
+	if uploader.writer == nil {
+		if err := uploader.start(); err != nil {
+			return 0, err
+		}
+	}
+
+	count, err := uploader.writer.Write(buf)
+	if err == io.ErrClosedPipe {
+		<-uploader.done
+		if uploader.err != nil {
+			err = uploader.err
+		}
+	}
+
+	return count, err
+}
+
+// Close ends the upload, or, once its context is done, breaks it off before
+// storage creates the stash.
+func (uploader *gcpUploader) Close() error {
+	// An upload refused before it started has no context.
+	if uploader.writer == nil && uploader.err != nil {
+		return uploader.err
+	}
+
+	if err := uploader.ctx.Err(); err != nil {
+		if uploader.writer != nil {
+			uploader.writer.CloseWithError(err)
+			<-uploader.done
+		}
+
+		return err
+	}
+
+	if uploader.writer == nil {
+		if err := uploader.start(); err != nil {
+			return err
+		}
+	}
+
+	uploader.writer.Close()
+	<-uploader.done
+	return uploader.err
+}
+
+func (client *gcpClient) Download(ctx context.Context, id string) io.ReadCloser {
+	return &gcpDownloader{ctx: ctx, endpoint: client.endpoint, id: id}
 }
 
 func (downloader *gcpDownloader) Read(buf []byte) (int, error) {
-	if downloader.reader == nil {
-		request := PasteRequest{ID: downloader.id}
-		res, err := httpclient.
-			WithHeader("Content-Type", "application/json").
-			PostJson(downloader.endpoint+"/paste", request)
-
-		if err != nil {
+	if downloader.body == nil {
+		var response PasteResponse
+		if err := call(downloader.ctx, downloader.endpoint+"/paste", PasteRequest{ID: downloader.id, Stream: true}, &response); err != nil {
 			return 0, err
 		}
 
-		body, err := res.ReadAll()
+		if response.Error != "" {
+			return 0, functionError(response.Error)
+		}
+
+		req, err := http.NewRequestWithContext(downloader.ctx, "GET", response.URL, nil)
 		if err != nil {
 			return 0, err
 		}
 
-		var response PasteResponse
-		err = json.Unmarshal(body, &response)
+		for name, value := range response.Headers {
+			req.Header.Set(name, value)
+		}
+
+		if downloader.offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", downloader.offset))
+		}
+
+		res, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return 0, err
 		}
 
-		if response.Error != "" {
-			return 0, errors.New(response.Error)
+		if err := checkStatus(res, http.StatusOK, http.StatusPartialContent); err != nil {
+			res.Body.Close()
+			return 0, err
 		}
 
-		downloader.reader = base64.NewDecoder(base64.StdEncoding, strings.NewReader(response.Payload))
+		downloader.body = res.Body
 	}
 
-	return downloader.reader.Read(buf)
+	return downloader.body.Read(buf)
 }
 
 func (downloader *gcpDownloader) Close() error {
+	if downloader.body == nil {
+		return nil
+	}
+
+	return downloader.body.Close()
+}
+
+func (client *gcpClient) DownloadFrom(ctx context.Context, id string, offset int64) io.ReadCloser {
+	return &gcpDownloader{ctx: ctx, endpoint: client.endpoint, id: id, offset: offset}
+}
+
+// A session's upload is the URI of a GCS resumable upload, which needs no
+// further signing.
+
+func (client *gcpClient) StartSession(ctx context.Context, options UploadOptions) (string, string, error) {
+	if options.MaxDownloads > 0 {
+		return "", "", errDownloadLimit
+	}
+
+	var response CopyResponse
+	if err := call(ctx, client.endpoint+"/copy", newCopyRequest(true, options), &response); err != nil {
+		return "", "", err
+	}
+
+	if response.Error != "" {
+		return "", "", functionError(response.Error)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", response.URL, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	for name, value := range response.Headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	if err := checkStatus(res, http.StatusCreated); err != nil {
+		return "", "", err
+	}
+
+	location := res.Header.Get("Location")
+	if location == "" {
+		return "", "", errors.New("storage did not return an upload session")
+	}
+
+	return newSession(response.ID, location), response.Token, nil
+}
+
+// putSession sends a request to the resumable upload at location and returns how
+// many bytes it has stored, or errSessionFinished.
+func putSession(ctx context.Context, location string, contentRange string, body []byte) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", location, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Range", contentRange)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusCreated {
+		return 0, errSessionFinished
+	}
+
+	if err := checkStatus(res, http.StatusPermanentRedirect); err != nil {
+		return 0, err
+	}
+
+	// The range stored, e.g. "bytes=0-1048575", is absent when it is empty.
+	stored := res.Header.Get("Range")
+	if stored == "" {
+		return 0, nil
+	}
+
+	end, err := strconv.ParseInt(stored[strings.LastIndex(stored, "-")+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid range \"%s\" from storage", stored)
+	}
+
+	return end + 1, nil
+}
+
+func (client *gcpClient) SessionOffset(ctx context.Context, session string) (int64, error) {
+	_, location, err := parseSession(session)
+	if err != nil {
+		return 0, err
+	}
+
+	return putSession(ctx, location, "bytes */*", nil)
+}
+
+// UploadChunk checks that GCS stored the whole chunk. GCS does not take
+// checksums for individual chunks; corruption is caught when the stash is
+// authenticated on paste.
+func (client *gcpClient) UploadChunk(ctx context.Context, session string, offset int64, chunk []byte, checksum []byte) error {
+	_, location, err := parseSession(session)
+	if err != nil {
+		return err
+	}
+
+	end := offset + int64(len(chunk))
+	stored, err := putSession(ctx, location, fmt.Sprintf("bytes %d-%d/*", offset, end-1), chunk)
+	if err != nil {
+		return err
+	}
+
+	if stored != end {
+		return &transientError{fmt.Errorf("storage kept %d bytes of chunk ending at %d", stored, end)}
+	}
+
+	return nil
+}
+
+func (client *gcpClient) FinishSession(ctx context.Context, session string, size int64) (string, error) {
+	id, location, err := parseSession(session)
+	if err != nil {
+		return "", err
+	}
+
+	stored, err := putSession(ctx, location, fmt.Sprintf("bytes */%d", size), nil)
+	if err == errSessionFinished {
+		return id, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("upload session has %d bytes, expected %d", stored, size)
+}
+
+// AbortSession cancels the resumable upload, which GCS answers with 499.
+func (client *gcpClient) AbortSession(ctx context.Context, session string) error {
+	_, location, err := parseSession(session)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", location, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return checkStatus(res, 499, http.StatusNoContent)
+}
+
+func (client *gcpClient) Delete(ctx context.Context, id string, token string) error {
+	var response DeleteResponse
+	if err := call(ctx, client.endpoint+"/delete", DeleteRequest{ID: id, Token: token}, &response); err != nil {
+		return err
+	}
+
+	if response.Error != "" {
+		return functionError(response.Error)
+	}
+
+	return nil
+}
+
+func (client *gcpClient) SetExpires(ctx context.Context, id string, token string, expires time.Time) error {
+	request := ExpireRequest{ID: id, Token: token, Expires: formatExpires(expires)}
+	var response ExpireResponse
+	if err := call(ctx, client.endpoint+"/expire", request, &response); err != nil {
+		return err
+	}
+
+	if response.Error != "" {
+		return functionError(response.Error)
+	}
+
 	return nil
 }
+
+func (client *gcpClient) Stat(ctx context.Context, id string) (*StashInfo, error) {
+	var response StatResponse
+	if err := call(ctx, client.endpoint+"/stat", StatRequest{ID: id}, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Error != "" {
+		return nil, functionError(response.Error)
+	}
+
+	return &response.StashInfo, nil
+}
+
+// List is not offered by the functions, which serve everyone's stashes.
+func (client *gcpClient) List(ctx context.Context) ([]string, error) {
+	return nil, errors.New("this storage does not list stashes")
+}
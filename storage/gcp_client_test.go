@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGCPRefusesDownloadLimit(t *testing.T) {
+	client := NewGCPClient("http://127.0.0.1:0")
+	uploader := client.Upload(context.Background(), UploadOptions{MaxDownloads: 1})
+	if _, err := uploader.Write([]byte("secret")); err != errDownloadLimit {
+		t.Errorf("write: got %v, want errDownloadLimit", err)
+	}
+
+	if err := uploader.Close(); err != errDownloadLimit {
+		t.Errorf("close: got %v, want errDownloadLimit", err)
+	}
+}
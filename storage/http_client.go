@@ -0,0 +1,431 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExpiresHeader carries UploadOptions.Expires to a stash server, in RFC 3339
+// format.
+const ExpiresHeader = "X-Stash-Expires"
+
+// TokenHeader carries the owner token of the stash being modified.
+const TokenHeader = "X-Stash-Token"
+
+// MaxDownloadsHeader carries UploadOptions.MaxDownloads to a stash server.
+const MaxDownloadsHeader = "X-Stash-Max-Downloads"
+
+// httpClient talks to the raw API of a stash server, which streams stashes
+// in request and response bodies.
+type httpClient struct {
+	endpoint string
+}
+
+type httpResponse struct {
+	ID      string   `json:"id,omitempty"`
+	Session string   `json:"session,omitempty"`
+	Offset  int64    `json:"offset"`
+	Token   string   `json:"token,omitempty"`
+	IDs     []string `json:"ids,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type httpUploader struct {
+	ctx     context.Context
+	writer  *io.PipeWriter
+	done    chan struct{}
+	err     error
+	client  *httpClient
+	id      string
+	token   string
+	replace bool
+	options UploadOptions
+}
+
+type httpDownloader struct {
+	ctx    context.Context
+	body   io.ReadCloser
+	client *httpClient
+	id     string
+	offset int64
+}
+
+func init() {
+	for _, scheme := range []string{"http", "https"} {
+		Register(scheme, func(backend *url.URL) (Client, error) {
+			return NewHTTPClient(backend.String()), nil
+		})
+	}
+}
+
+func NewHTTPClient(endpoint string) ResumableClient {
+	return &httpClient{endpoint: strings.TrimRight(endpoint, "/")}
+}
+
+func (client *httpClient) stashURL(id string) string {
+	return client.endpoint + "/stashes/" + url.PathEscape(id)
+}
+
+func (client *httpClient) sessionURL(session string) string {
+	return client.endpoint + "/sessions/" + url.PathEscape(session)
+}
+
+// serverError returns the error the server answered with, unless res has
+// the expected status.
+func serverError(res *http.Response, expected int) error {
+	if res.StatusCode == expected {
+		return nil
+	}
+
+	var response httpResponse
+	if json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&response) != nil || response.Error == "" {
+		if res.StatusCode == http.StatusGone {
+			return ErrExpired
+		}
+
+		return checkStatus(res, expected)
+	}
+
+	switch res.StatusCode {
+	case http.StatusGone:
+		if response.Error == ErrConsumed.Error() {
+			return ErrConsumed
+		}
+
+		return ErrExpired
+	case http.StatusForbidden:
+		if response.Error == ErrNotOwner.Error() {
+			return ErrNotOwner
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		if response.Error == ErrLimitedResume.Error() {
+			return ErrLimitedResume
+		}
+	case http.StatusNotFound:
+		return fmt.Errorf("stash server: %s: %w", response.Error, os.ErrNotExist)
+	case http.StatusServiceUnavailable:
+		return &transientError{fmt.Errorf("stash server: %s", response.Error)}
+	}
+
+	return fmt.Errorf("stash server: %s", response.Error)
+}
+
+// do sends req and decodes the server's answer.
+func (client *httpClient) do(req *http.Request) (*httpResponse, error) {
+	var response httpResponse
+	if err := client.doJSON(req, &response); err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+func (client *httpClient) doJSON(req *http.Request, response interface{}) error {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := serverError(res, http.StatusOK); err != nil {
+		return err
+	}
+
+	return json.NewDecoder(res.Body).Decode(response)
+}
+
+func (client *httpClient) Upload(ctx context.Context, options UploadOptions) Uploader {
+	return &httpUploader{ctx: ctx, client: client, options: options}
+}
+
+func setOptions(req *http.Request, options UploadOptions) {
+	if !options.Expires.IsZero() {
+		req.Header.Set(ExpiresHeader, options.Expires.UTC().Format(time.RFC3339))
+	}
+
+	if options.MaxDownloads > 0 {
+		req.Header.Set(MaxDownloadsHeader, strconv.Itoa(options.MaxDownloads))
+	}
+}
+
+func (client *httpClient) Replace(ctx context.Context, id string, token string) Uploader {
+	return &httpUploader{ctx: ctx, client: client, id: id, token: token, replace: true}
+}
+
+func (uploader *httpUploader) GetID() string {
+	return uploader.id
+}
+
+func (uploader *httpUploader) GetToken() string {
+	return uploader.token
+}
+
+// start begins a chunked upload to the server, fed by Write.
+func (uploader *httpUploader) start() error {
+	url := uploader.client.endpoint + "/stashes"
+	if uploader.replace {
+		url = uploader.client.stashURL(uploader.id)
+	}
+
+	reader, writer := io.Pipe()
+	req, err := http.NewRequestWithContext(uploader.ctx, "PUT", url, reader)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if uploader.replace {
+		req.Header.Set(TokenHeader, uploader.token)
+	} else {
+		setOptions(req, uploader.options)
+	}
+
+	uploader.writer = writer
+	uploader.done = make(chan struct{})
+	go func() {
+		defer close(uploader.done)
+		response, err := uploader.client.do(req)
+		if err == nil && !uploader.replace {
+			uploader.id, uploader.token = response.ID, response.Token
+		}
+
+		// Unblock Write if the upload ends early.
+		reader.CloseWithError(err)
+		uploader.err = err
+	}()
+
+	return nil
+}
+
+func (uploader *httpUploader) Write(buf []byte) (int, error) {
+	if uploader.writer == nil {
+		if err := uploader.start(); err != nil {
+			return 0, err
+		}
+	}
+
+	count, err := uploader.writer.Write(buf)
+	if err == io.ErrClosedPipe {
+		<-uploader.done
+		if uploader.err != nil {
+			err = uploader.err
+		}
+	}
+
+	return count, err
+}
+
+// Close ends the upload, or, once its context is done, breaks it off so that
+// the server discards it.
+func (uploader *httpUploader) Close() error {
+	if err := uploader.ctx.Err(); err != nil {
+		if uploader.writer != nil {
+			uploader.writer.CloseWithError(err)
+			<-uploader.done
+		}
+
+		return err
+	}
+
+	if uploader.writer == nil {
+		if err := uploader.start(); err != nil {
+			return err
+		}
+	}
+
+	uploader.writer.Close()
+	<-uploader.done
+	return uploader.err
+}
+
+func (client *httpClient) Download(ctx context.Context, id string) io.ReadCloser {
+	return &httpDownloader{ctx: ctx, client: client, id: id}
+}
+
+func (client *httpClient) DownloadFrom(ctx context.Context, id string, offset int64) io.ReadCloser {
+	return &httpDownloader{ctx: ctx, client: client, id: id, offset: offset}
+}
+
+func (downloader *httpDownloader) Read(buf []byte) (int, error) {
+	if downloader.body == nil {
+		req, err := http.NewRequestWithContext(downloader.ctx, "GET", downloader.client.stashURL(downloader.id), nil)
+		if err != nil {
+			return 0, err
+		}
+
+		expected := http.StatusOK
+		if downloader.offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", downloader.offset))
+			expected = http.StatusPartialContent
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := serverError(res, expected); err != nil {
+			res.Body.Close()
+			return 0, err
+		}
+
+		downloader.body = res.Body
+	}
+
+	return downloader.body.Read(buf)
+}
+
+func (downloader *httpDownloader) Close() error {
+	if downloader.body == nil {
+		return nil
+	}
+
+	return downloader.body.Close()
+}
+
+// Sessions are the server's opaque tokens.
+
+func (client *httpClient) StartSession(ctx context.Context, options UploadOptions) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", client.endpoint+"/sessions", nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	setOptions(req, options)
+	response, err := client.do(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	if response.Session == "" {
+		return "", "", errors.New("stash server did not return an upload session")
+	}
+
+	return response.Session, response.Token, nil
+}
+
+func (client *httpClient) SessionOffset(ctx context.Context, session string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", client.sessionURL(session), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := client.do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	return response.Offset, nil
+}
+
+func (client *httpClient) UploadChunk(ctx context.Context, session string, offset int64, chunk []byte, checksum []byte) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", client.sessionURL(session), bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+
+	end := offset + int64(len(chunk))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, end-1))
+	req.Header.Set("X-Content-Sha256", hex.EncodeToString(checksum))
+	response, err := client.do(req)
+	if err != nil {
+		return err
+	}
+
+	if response.Offset != end {
+		return &transientError{fmt.Errorf("stash server kept %d bytes of chunk ending at %d", response.Offset, end)}
+	}
+
+	return nil
+}
+
+func (client *httpClient) FinishSession(ctx context.Context, session string, size int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s?size=%d", client.sessionURL(session), size), nil)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := client.do(req)
+	if err != nil {
+		return "", err
+	}
+
+	return response.ID, nil
+}
+
+func (client *httpClient) AbortSession(ctx context.Context, session string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", client.sessionURL(session), nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.do(req)
+	return err
+}
+
+func (client *httpClient) Delete(ctx context.Context, id string, token string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", client.stashURL(id), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(TokenHeader, token)
+	_, err = client.do(req)
+	return err
+}
+
+func (client *httpClient) SetExpires(ctx context.Context, id string, token string, expires time.Time) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", client.stashURL(id)+"/expires", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(TokenHeader, token)
+	setOptions(req, UploadOptions{Expires: expires})
+	_, err = client.do(req)
+	return err
+}
+
+func (client *httpClient) Stat(ctx context.Context, id string) (*StashInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", client.stashURL(id)+"/stat", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var info StashInfo
+	if err := client.doJSON(req, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func (client *httpClient) List(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", client.endpoint+"/stashes", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.IDs, nil
+}
@@ -2,47 +2,159 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
 
-	"github.com/schmich/stash/identifier"
+	"github.com/schmich/stash/owner"
 )
 
 type inMemoryClient struct {
-	storage map[string][]byte
+	mutex   sync.Mutex
+	storage map[string]*inMemoryStash
+	uploads map[string]*inMemoryStash
 }
 
-func NewInMemoryClient() Client {
-	return &inMemoryClient{storage: make(map[string][]byte)}
+type inMemoryStash struct {
+	payload      []byte
+	owner        string
+	created      time.Time
+	expires      time.Time
+	maxDownloads int
+	downloads    int
+}
+
+// consumed reports whether the stash has been downloaded as many times as it
+// allows. Its payload is gone, but it is kept to tell it from a stash that
+// never existed.
+func (stash *inMemoryStash) consumed() bool {
+	return stash.maxDownloads > 0 && stash.downloads >= stash.maxDownloads
+}
+
+func init() {
+	Register("mem", func(*url.URL) (Client, error) {
+		return NewInMemoryClient(), nil
+	})
+}
+
+func NewInMemoryClient() ResumableClient {
+	return &inMemoryClient{storage: make(map[string]*inMemoryStash), uploads: make(map[string]*inMemoryStash)}
 }
 
 type inMemoryUploader struct {
-	client *inMemoryClient
-	buffer bytes.Buffer
-	id     string
+	ctx     context.Context
+	client  *inMemoryClient
+	buffer  bytes.Buffer
+	id      string
+	token   string
+	replace bool
+	options UploadOptions
 }
 
 type inMemoryDownloader struct {
+	ctx    context.Context
 	buffer *bytes.Buffer
 	err    error
 }
 
-func (client *inMemoryClient) Upload() Uploader {
-	return &inMemoryUploader{client: client}
+func (client *inMemoryClient) Upload(ctx context.Context, options UploadOptions) Uploader {
+	return &inMemoryUploader{ctx: ctx, client: client, options: options}
 }
 
 func (uploader *inMemoryUploader) Write(buf []byte) (int, error) {
+	if err := uploader.ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	return uploader.buffer.Write(buf)
 }
 
+func (client *inMemoryClient) Replace(ctx context.Context, id string, token string) Uploader {
+	return &inMemoryUploader{ctx: ctx, client: client, id: id, token: token, replace: true}
+}
+
+// ownedStash returns the stash with the given ID, if token is its owner's.
+// The client must be locked.
+func (client *inMemoryClient) ownedStash(id string, token string) (*inMemoryStash, error) {
+	stash, ok := client.storage[id]
+	if !ok {
+		return nil, fmt.Errorf("payload not found for \"%s\": %w", id, os.ErrNotExist)
+	}
+
+	if err := owner.Check(stash.owner, token); err != nil {
+		return nil, err
+	}
+
+	return stash, nil
+}
+
+// unusedID returns an ID that no stash has. The client must be locked.
+func (client *inMemoryClient) unusedID() (string, error) {
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		id, err := newID()
+		if err != nil {
+			return "", err
+		}
+
+		if _, taken := client.storage[id]; !taken {
+			return id, nil
+		}
+	}
+
+	return "", errIDsTaken
+}
+
 func (uploader *inMemoryUploader) Close() error {
+	// Nothing is stored until now, so an aborted upload is simply dropped.
+	if err := uploader.ctx.Err(); err != nil {
+		return err
+	}
+
+	uploader.client.mutex.Lock()
+	defer uploader.client.mutex.Unlock()
+
+	if uploader.replace {
+		stash, err := uploader.client.ownedStash(uploader.id, uploader.token)
+		if err != nil {
+			return err
+		}
+
+		if stash.consumed() {
+			return ErrConsumed
+		}
+
+		stash.payload = uploader.buffer.Bytes()
+		stash.created = time.Now()
+		return nil
+	}
+
 	var err error
-	uploader.id, err = identifier.New()
+	uploader.id, err = uploader.client.unusedID()
 	if err != nil {
 		return err
 	}
 
-	uploader.client.storage[uploader.id] = uploader.buffer.Bytes()
+	uploader.token, err = owner.NewToken()
+	if err != nil {
+		return err
+	}
+
+	uploader.client.storage[uploader.id] = &inMemoryStash{
+		payload:      uploader.buffer.Bytes(),
+		owner:        owner.Hash(uploader.token),
+		created:      time.Now(),
+		expires:      uploader.options.Expires,
+		maxDownloads: uploader.options.MaxDownloads,
+	}
 	return nil
 }
 
@@ -50,13 +162,53 @@ func (uploader *inMemoryUploader) GetID() string {
 	return uploader.id
 }
 
-func (client *inMemoryClient) Download(id string) io.ReadCloser {
-	if payload, ok := client.storage[id]; ok {
-		return &inMemoryDownloader{buffer: bytes.NewBuffer(payload)}
+func (uploader *inMemoryUploader) GetToken() string {
+	return uploader.token
+}
+
+func (client *inMemoryClient) Download(ctx context.Context, id string) io.ReadCloser {
+	return client.DownloadFrom(ctx, id, 0)
+}
+
+func (client *inMemoryClient) DownloadFrom(ctx context.Context, id string, offset int64) io.ReadCloser {
+	if err := ctx.Err(); err != nil {
+		return &inMemoryDownloader{err: err}
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if stash, ok := client.storage[id]; ok {
+		if IsExpired(stash.expires) {
+			return &inMemoryDownloader{err: ErrExpired}
+		}
+
+		if stash.consumed() {
+			return &inMemoryDownloader{err: ErrConsumed}
+		}
+
+		// The download counts before any of it is read, and the one that
+		// reaches the limit drops the payload.
+		payload := stash.payload
+		if stash.maxDownloads > 0 {
+			if offset > 0 {
+				return &inMemoryDownloader{err: ErrLimitedResume}
+			}
+
+			if stash.downloads++; stash.consumed() {
+				stash.payload = nil
+			}
+		}
+
+		if offset > int64(len(payload)) {
+			offset = int64(len(payload))
+		}
+
+		return &inMemoryDownloader{ctx: ctx, buffer: bytes.NewBuffer(payload[offset:])}
 	}
 
 	return &inMemoryDownloader{
-		err: fmt.Errorf("payload not found for \"%s\"", id),
+		err: fmt.Errorf("payload not found for \"%s\": %w", id, os.ErrNotExist),
 	}
 }
 
@@ -65,9 +217,185 @@ func (downloader *inMemoryDownloader) Read(buf []byte) (int, error) {
 		return 0, downloader.err
 	}
 
+	if err := downloader.ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	return downloader.buffer.Read(buf)
 }
 
 func (downloader *inMemoryDownloader) Close() error {
 	return downloader.err
 }
+
+func (client *inMemoryClient) StartSession(ctx context.Context, options UploadOptions) (string, string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+
+	token, err := owner.NewToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	session := hex.EncodeToString(random)
+	client.uploads[session] = &inMemoryStash{owner: owner.Hash(token), expires: options.Expires, maxDownloads: options.MaxDownloads}
+	return session, token, nil
+}
+
+func (client *inMemoryClient) SessionOffset(ctx context.Context, session string) (int64, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	upload, ok := client.uploads[session]
+	if !ok {
+		return 0, fmt.Errorf("upload session not found: \"%s\"", session)
+	}
+
+	return int64(len(upload.payload)), nil
+}
+
+func (client *inMemoryClient) UploadChunk(ctx context.Context, session string, offset int64, chunk []byte, checksum []byte) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	upload, ok := client.uploads[session]
+	if !ok {
+		return fmt.Errorf("upload session not found: \"%s\"", session)
+	}
+
+	if offset > int64(len(upload.payload)) {
+		return fmt.Errorf("chunk at %d is beyond the %d bytes uploaded", offset, len(upload.payload))
+	}
+
+	digest := sha256.Sum256(chunk)
+	if !bytes.Equal(digest[:], checksum) {
+		return errors.New("chunk checksum mismatch")
+	}
+
+	// A chunk sent again replaces whatever followed it.
+	upload.payload = append(upload.payload[:offset:offset], chunk...)
+	return nil
+}
+
+func (client *inMemoryClient) FinishSession(ctx context.Context, session string, size int64) (string, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	upload, ok := client.uploads[session]
+	if !ok {
+		return "", fmt.Errorf("upload session not found: \"%s\"", session)
+	}
+
+	if int64(len(upload.payload)) != size {
+		return "", fmt.Errorf("upload session has %d bytes, expected %d", len(upload.payload), size)
+	}
+
+	id, err := client.unusedID()
+	if err != nil {
+		return "", err
+	}
+
+	delete(client.uploads, session)
+	upload.created = time.Now()
+	client.storage[id] = upload
+	return id, nil
+}
+
+func (client *inMemoryClient) AbortSession(ctx context.Context, session string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if _, ok := client.uploads[session]; !ok {
+		return fmt.Errorf("upload session not found: \"%s\"", session)
+	}
+
+	delete(client.uploads, session)
+	return nil
+}
+
+func (client *inMemoryClient) Delete(ctx context.Context, id string, token string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if _, err := client.ownedStash(id, token); err != nil {
+		return err
+	}
+
+	delete(client.storage, id)
+	return nil
+}
+
+func (client *inMemoryClient) SetExpires(ctx context.Context, id string, token string, expires time.Time) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	stash, err := client.ownedStash(id, token)
+	if err != nil {
+		return err
+	}
+
+	if stash.consumed() {
+		return ErrConsumed
+	}
+
+	stash.expires = expires
+	return nil
+}
+
+func (client *inMemoryClient) Stat(ctx context.Context, id string) (*StashInfo, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	stash, ok := client.storage[id]
+	if !ok {
+		return nil, fmt.Errorf("payload not found for \"%s\": %w", id, os.ErrNotExist)
+	}
+
+	if stash.consumed() {
+		return nil, ErrConsumed
+	}
+
+	return &StashInfo{
+		ID:           id,
+		Size:         int64(len(stash.payload)),
+		Created:      stash.created,
+		Expires:      stash.expires,
+		MaxDownloads: stash.maxDownloads,
+		Downloads:    stash.downloads,
+	}, nil
+}
+
+func (client *inMemoryClient) List(ctx context.Context) ([]string, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	var ids []string
+	for id, stash := range client.storage {
+		if !stash.consumed() {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (client *inMemoryClient) Sweep() (int, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	count := 0
+	for id, stash := range client.storage {
+		if IsExpired(stash.expires) {
+			delete(client.storage, id)
+			count++
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		manager := client.(Manager)
+		before := time.Now().Add(-time.Second)
+		expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		id := upload(t, client, "secret", UploadOptions{Expires: expires, MaxDownloads: 2}).GetID()
+
+		info, err := manager.Stat(ctx, id)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if info.ID != id || info.Size != 6 || info.Created.Before(before) || !info.Expires.Equal(expires) || info.MaxDownloads != 2 || info.Downloads != 0 {
+			t.Errorf("%s: got %+v", name, info)
+		}
+
+		read(client.Download(ctx, id))
+		if info, err := manager.Stat(ctx, id); err != nil || info.Downloads != 1 {
+			t.Errorf("%s: after a download: %+v, %v", name, info, err)
+		}
+
+		if _, err := manager.Stat(ctx, "missing stash"); !IsNotFound(err) {
+			t.Errorf("%s: missing stash: got %v, want not found", name, err)
+		}
+
+		if _, err := manager.Stat(ctx, "../escape"); err == nil {
+			t.Errorf("%s: stat of a path outside the storage succeeded", name)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		manager := client.(Manager)
+		if ids, err := manager.List(ctx); err != nil || len(ids) != 0 {
+			t.Errorf("%s: empty storage: got %v, %v", name, ids, err)
+		}
+
+		first := upload(t, client, "first", UploadOptions{}).GetID()
+		second := upload(t, client, "second", UploadOptions{}).GetID()
+		consumed := upload(t, client, "consumed", UploadOptions{MaxDownloads: 1}).GetID()
+		read(client.Download(ctx, consumed))
+
+		// Neither unfinished uploads nor consumed stashes are listed.
+		if _, _, err := client.StartSession(ctx, UploadOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err := manager.List(ctx)
+		if err != nil || len(ids) != 2 {
+			t.Fatalf("%s: got %v, %v", name, ids, err)
+		}
+
+		expected := []string{first, second}
+		sort.Strings(expected)
+		if ids[0] != expected[0] || ids[1] != expected[1] {
+			t.Errorf("%s: got %v, want %v", name, ids, expected)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		manager := client.(Manager)
+		stash := upload(t, client, "secret", UploadOptions{})
+		kept := upload(t, client, "kept", UploadOptions{}).GetID()
+		if err := manager.Delete(ctx, stash.GetID(), stash.GetToken()); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if _, err := read(client.Download(ctx, stash.GetID())); !IsNotFound(err) {
+			t.Errorf("%s: deleted stash: got %v, want not found", name, err)
+		}
+
+		if err := manager.Delete(ctx, stash.GetID(), stash.GetToken()); !IsNotFound(err) {
+			t.Errorf("%s: deleting again: got %v, want not found", name, err)
+		}
+
+		if ids, err := manager.List(ctx); err != nil || len(ids) != 1 || ids[0] != kept {
+			t.Errorf("%s: after delete: got %v, %v", name, ids, err)
+		}
+
+		// The owner of a consumed stash still deletes what is left of it.
+		consumed := upload(t, client, "consumed", UploadOptions{MaxDownloads: 1})
+		read(client.Download(ctx, consumed.GetID()))
+		if err := manager.Delete(ctx, consumed.GetID(), consumed.GetToken()); err != nil {
+			t.Errorf("%s: delete consumed stash: %s", name, err)
+		}
+
+		if _, err := read(client.Download(ctx, consumed.GetID())); !IsNotFound(err) {
+			t.Errorf("%s: deleted consumed stash: got %v, want not found", name, err)
+		}
+	}
+}
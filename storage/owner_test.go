@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+// pickIDs makes newID return ids in turn, for the rest of the test.
+func pickIDs(t *testing.T, ids ...string) {
+	original := newID
+	t.Cleanup(func() { newID = original })
+	newID = func() (string, error) {
+		id := ids[0]
+		if len(ids) > 1 {
+			ids = ids[1:]
+		}
+
+		return id, nil
+	}
+}
+
+func TestIDCollision(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		pickIDs(t, "quiet river", "quiet river", "quiet river", "amber hill", "amber hill", "green field")
+		first := upload(t, client, "first", UploadOptions{})
+		second := upload(t, client, "second", UploadOptions{})
+		if first.GetID() != "quiet river" || second.GetID() != "amber hill" {
+			t.Fatalf("%s: uploaded as %q and %q", name, first.GetID(), second.GetID())
+		}
+
+		session, _, err := client.StartSession(ctx, UploadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunk := []byte("third")
+		checksum := sha256.Sum256(chunk)
+		if err := client.UploadChunk(ctx, session, 0, chunk, checksum[:]); err != nil {
+			t.Fatal(err)
+		}
+
+		third, err := client.FinishSession(ctx, session, int64(len(chunk)))
+		if err != nil || third != "green field" {
+			t.Fatalf("%s: session finished as %q, %v", name, third, err)
+		}
+
+		for _, stash := range []struct{ id, content string }{{"quiet river", "first"}, {"amber hill", "second"}, {"green field", "third"}} {
+			if content, err := read(client.Download(ctx, stash.id)); err != nil || content != stash.content {
+				t.Errorf("%s: %s: got %q, %v", name, stash.id, content, err)
+			}
+		}
+
+		// The later uploads did not take over the first stash.
+		if err := client.(Manager).Delete(ctx, first.GetID(), second.GetToken()); err != ErrNotOwner {
+			t.Errorf("%s: delete with another stash's token: got %v, want ErrNotOwner", name, err)
+		}
+
+		pickIDs(t, "quiet river")
+		if err := client.Upload(ctx, UploadOptions{}).Close(); err != errIDsTaken {
+			t.Errorf("%s: got %v, want errIDsTaken", name, err)
+		}
+	}
+}
+
+func TestOwnerToken(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		stash := upload(t, client, "secret", UploadOptions{Expires: expires, MaxDownloads: 3})
+		id, token := stash.GetID(), stash.GetToken()
+		manager := client.(Manager)
+
+		replacer := client.Replace(ctx, id, "wrong")
+		replacer.Write([]byte("forged"))
+		if err := replacer.Close(); err != ErrNotOwner {
+			t.Errorf("%s: replace: got %v, want ErrNotOwner", name, err)
+		}
+
+		if err := manager.SetExpires(ctx, id, "wrong", time.Time{}); err != ErrNotOwner {
+			t.Errorf("%s: set expiry: got %v, want ErrNotOwner", name, err)
+		}
+
+		if err := manager.Delete(ctx, id, "wrong"); err != ErrNotOwner {
+			t.Errorf("%s: delete: got %v, want ErrNotOwner", name, err)
+		}
+
+		// The owner replaces the stash, which keeps its options.
+		replacer = client.Replace(ctx, id, token)
+		replacer.Write([]byte("rekeyed"))
+		if err := replacer.Close(); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		info, err := manager.Stat(ctx, id)
+		if err != nil || !info.Expires.Equal(expires) || info.MaxDownloads != 3 || info.Size != int64(len("rekeyed")) {
+			t.Errorf("%s: replaced stash: %+v, %v", name, info, err)
+		}
+
+		if err := manager.Delete(ctx, id, token); err != nil {
+			t.Errorf("%s: delete: %s", name, err)
+		}
+
+		if _, err := manager.Stat(ctx, id); !IsNotFound(err) {
+			t.Errorf("%s: deleted stash: got %v, want not found", name, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ChunkSize is the size of each chunk of a resumable upload. GCS requires a
+// multiple of 256 KiB.
+const ChunkSize = 8 * 1024 * 1024
+
+const (
+	maxAttempts = 5
+	retryDelay  = time.Second
+)
+
+var errSessionFinished = errors.New("upload session is already finished")
+
+// ResumableClient stores stashes in chunks, so that an interrupted transfer
+// continues from where it stopped instead of starting over.
+type ResumableClient interface {
+	Client
+
+	// StartSession begins a chunked upload and returns its session ID and
+	// the owner token of the stash.
+	StartSession(ctx context.Context, options UploadOptions) (string, string, error)
+
+	// SessionOffset returns how many bytes of the session are stored.
+	SessionOffset(ctx context.Context, session string) (int64, error)
+
+	// UploadChunk stores chunk at offset, which must not be beyond the
+	// session's current offset. The chunk is verified against its SHA-256
+	// checksum.
+	UploadChunk(ctx context.Context, session string, offset int64, chunk []byte, checksum []byte) error
+
+	// FinishSession stores the size bytes uploaded as a new stash and
+	// returns its ID.
+	FinishSession(ctx context.Context, session string, size int64) (string, error)
+
+	// AbortSession discards the session and what it has stored.
+	AbortSession(ctx context.Context, session string) error
+
+	// DownloadFrom reads the stash with the given ID from offset on. It
+	// counts a download from the start like Download, and fails with
+	// ErrLimitedResume for a later offset of a stash with a download limit.
+	DownloadFrom(ctx context.Context, id string, offset int64) io.ReadCloser
+}
+
+// newSession identifies the upload of a stash with the given ID by the
+// backend's upload handle, which holds no spaces, followed by the ID.
+func newSession(id, upload string) string {
+	return upload + " " + id
+}
+
+func parseSession(session string) (string, string, error) {
+	parts := strings.SplitN(session, " ", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid upload session \"%s\"", session)
+	}
+
+	return parts[1], parts[0], nil
+}
+
+type transientError struct {
+	err error
+}
+
+func (err *transientError) Error() string {
+	return err.err.Error()
+}
+
+// IsTransient reports whether an operation failing with err is worth
+// retrying, e.g. after a dropped connection, but not after it was cancelled
+// or timed out.
+func IsTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	switch err.(type) {
+	case *transientError, net.Error:
+		return true
+	}
+
+	return err == io.ErrUnexpectedEOF
+}
+
+func retry(ctx context.Context, operation func() error) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		// Storage that is local may not notice ctx itself.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := operation()
+		if err == nil || attempt == maxAttempts || !IsTransient(err) {
+			return err
+		}
+
+		log.Debugf("Retry in %s: %s", delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+// ResumeUpload uploads what the session is missing of the size bytes in
+// reader and finishes it. After a transient failure it asks the session how
+// much is stored and continues from there. progress, if given, is called
+// with the offset after each chunk.
+func ResumeUpload(ctx context.Context, client ResumableClient, session string, reader io.ReaderAt, size int64, progress func(int64)) (string, error) {
+	chunk := make([]byte, ChunkSize)
+	var offset int64
+	for offset < size {
+		err := retry(ctx, func() error {
+			var err error
+			if offset, err = client.SessionOffset(ctx, session); err != nil || offset >= size {
+				return err
+			}
+
+			count := size - offset
+			if count > ChunkSize {
+				count = ChunkSize
+			}
+
+			if _, err := reader.ReadAt(chunk[:count], offset); err != nil {
+				return err
+			}
+
+			checksum := sha256.Sum256(chunk[:count])
+			if err := client.UploadChunk(ctx, session, offset, chunk[:count], checksum[:]); err != nil {
+				return err
+			}
+
+			offset += count
+			return nil
+		})
+
+		if err == errSessionFinished {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		if offset > size {
+			return "", fmt.Errorf("upload session has %d bytes, expected %d", offset, size)
+		}
+
+		if progress != nil {
+			progress(offset)
+		}
+	}
+
+	var id string
+	err := retry(ctx, func() (err error) {
+		id, err = client.FinishSession(ctx, session, size)
+		return
+	})
+
+	return id, err
+}
+
+type resumingReader struct {
+	ctx    context.Context
+	client ResumableClient
+	id     string
+	reader io.ReadCloser
+	offset int64
+}
+
+// NewResumingReader reads the stash with the given ID, reconnecting where
+// it left off when the transfer is interrupted.
+func NewResumingReader(ctx context.Context, client ResumableClient, id string) io.ReadCloser {
+	return &resumingReader{ctx: ctx, client: client, id: id}
+}
+
+func (reader *resumingReader) reconnect() {
+	reader.reader.Close()
+	reader.reader = nil
+}
+
+func (reader *resumingReader) Read(buf []byte) (int, error) {
+	var count int
+	var readErr error
+	err := retry(reader.ctx, func() error {
+		if reader.reader == nil {
+			reader.reader = reader.client.DownloadFrom(reader.ctx, reader.id, reader.offset)
+		}
+
+		count, readErr = reader.reader.Read(buf)
+		reader.offset += int64(count)
+		if count == 0 && IsTransient(readErr) {
+			reader.reconnect()
+			return readErr
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Return what was read now and reconnect on the next read.
+	if IsTransient(readErr) {
+		reader.reconnect()
+		readErr = nil
+	}
+
+	return count, readErr
+}
+
+func (reader *resumingReader) Close() error {
+	if reader.reader == nil {
+		return nil
+	}
+
+	return reader.reader.Close()
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"testing"
+)
+
+func TestResumeUpload(t *testing.T) {
+	ctx := context.Background()
+	payload := make([]byte, ChunkSize+100)
+	rand.Read(payload)
+	for name, client := range clients(t) {
+		session, token, err := client.StartSession(ctx, UploadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A session interrupted after its first chunk continues from there.
+		checksum := sha256.Sum256(payload[:ChunkSize])
+		if err := client.UploadChunk(ctx, session, 0, payload[:ChunkSize], checksum[:]); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		var offsets []int64
+		id, err := ResumeUpload(ctx, client, session, bytes.NewReader(payload), int64(len(payload)), func(offset int64) {
+			offsets = append(offsets, offset)
+		})
+
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if len(offsets) != 1 || offsets[0] != int64(len(payload)) {
+			t.Errorf("%s: uploaded to offsets %v, want only the last chunk", name, offsets)
+		}
+
+		if content, err := read(client.Download(ctx, id)); err != nil || content != string(payload) {
+			t.Errorf("%s: downloaded %d bytes, %v", name, len(content), err)
+		}
+
+		if err := client.(Manager).Delete(ctx, id, token); err != nil {
+			t.Errorf("%s: delete with the session's token: %s", name, err)
+		}
+	}
+}
+
+func TestUploadChunk(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		session, _, err := client.StartSession(ctx, UploadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunk := func(offset int64, content string) error {
+			checksum := sha256.Sum256([]byte(content))
+			return client.UploadChunk(ctx, session, offset, []byte(content), checksum[:])
+		}
+
+		if err := chunk(0, "hello"); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if err := chunk(6, "gap"); err == nil {
+			t.Errorf("%s: stored a chunk beyond the session's offset", name)
+		}
+
+		if err := client.UploadChunk(ctx, session, 5, []byte("corrupt"), make([]byte, sha256.Size)); err == nil {
+			t.Errorf("%s: stored a chunk that does not match its checksum", name)
+		}
+
+		// A chunk sent again replaces what followed it.
+		if err := chunk(3, "p me"); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if offset, err := client.SessionOffset(ctx, session); err != nil || offset != 7 {
+			t.Errorf("%s: offset %d, %v, want 7", name, offset, err)
+		}
+
+		if _, err := client.FinishSession(ctx, session, 5); err == nil {
+			t.Errorf("%s: finished a session with the wrong size", name)
+		}
+
+		id, err := client.FinishSession(ctx, session, 7)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if content, err := read(client.Download(ctx, id)); err != nil || content != "help me" {
+			t.Errorf("%s: got %q, %v", name, content, err)
+		}
+
+		if _, err := client.SessionOffset(ctx, session); err == nil {
+			t.Errorf("%s: finished session still open", name)
+		}
+	}
+}
+
+func TestAbortSession(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		session, _, err := client.StartSession(ctx, UploadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checksum := sha256.Sum256([]byte("partial"))
+		if err := client.UploadChunk(ctx, session, 0, []byte("partial"), checksum[:]); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if err := client.AbortSession(ctx, session); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if _, err := client.SessionOffset(ctx, session); err == nil {
+			t.Errorf("%s: aborted session still open", name)
+		}
+
+		if _, err := client.FinishSession(ctx, session, 7); err == nil {
+			t.Errorf("%s: finished an aborted session", name)
+		}
+
+		if ids, err := client.(Manager).List(ctx); err != nil || len(ids) != 0 {
+			t.Errorf("%s: aborted session left %v, %v", name, ids, err)
+		}
+	}
+}
+
+// flakyClient drops each download after a few bytes.
+type flakyClient struct {
+	ResumableClient
+	offsets []int64
+}
+
+type flakyReader struct {
+	io.ReadCloser
+}
+
+func (reader flakyReader) Read(buf []byte) (int, error) {
+	if len(buf) > 3 {
+		buf = buf[:3]
+	}
+
+	count, err := reader.ReadCloser.Read(buf)
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return count, err
+}
+
+func (client *flakyClient) DownloadFrom(ctx context.Context, id string, offset int64) io.ReadCloser {
+	client.offsets = append(client.offsets, offset)
+	return flakyReader{client.ResumableClient.DownloadFrom(ctx, id, offset)}
+}
+
+func TestResumingReader(t *testing.T) {
+	ctx := context.Background()
+	for name, client := range clients(t) {
+		id := upload(t, client, "interrupted download", UploadOptions{}).GetID()
+		flaky := &flakyClient{ResumableClient: client}
+		if content, err := read(NewResumingReader(ctx, flaky, id)); err != nil || content != "interrupted download" {
+			t.Errorf("%s: got %q, %v", name, content, err)
+		}
+
+		if len(flaky.offsets) < 2 || flaky.offsets[1] != 3 {
+			t.Errorf("%s: downloaded from offsets %v", name, flaky.offsets)
+		}
+	}
+}
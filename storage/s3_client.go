@@ -0,0 +1,814 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schmich/stash/owner"
+)
+
+// ExpiryTag is the object tag holding S3Config.ExpiryDays, or the days
+// until a stash expires, rounded up. Objects are purged through bucket
+// lifecycle rules that filter on it, one rule per value.
+const ExpiryTag = "stash-expiry-days"
+
+// expiresMetadata holds UploadOptions.Expires, which is checked on download.
+const expiresMetadata = "X-Amz-Meta-Stash-Expires"
+
+// ownerMetadata holds the hash of the stash's owner token.
+const ownerMetadata = "X-Amz-Meta-Stash-Owner"
+
+// abortTimeout bounds the cleanup of an upload whose context is done.
+const abortTimeout = 10 * time.Second
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type S3Config struct {
+	// Endpoint is the store's URL, e.g. https://s3.us-east-1.amazonaws.com
+	// or http://localhost:9000 for MinIO.
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix"`
+	Region   string `json:"region"`
+
+	AccessKey    string `json:"access_key"`
+	SecretKey    string `json:"secret_key"`
+	SessionToken string `json:"session_token"`
+
+	// PathStyle addresses the bucket in the path rather than the host name,
+	// as MinIO and Ceph usually need.
+	PathStyle bool `json:"path_style"`
+
+	// ExpiryDays tags stashes with ExpiryTag, if set.
+	ExpiryDays int `json:"expiry_days"`
+}
+
+type s3Client struct {
+	config S3Config
+	http   *http.Client
+}
+
+// s3Uploader buffers a part at a time. A stash smaller than one part is
+// stored with a single request, a larger one with a multipart upload.
+type s3Uploader struct {
+	ctx     context.Context
+	client  *s3Client
+	id      string
+	token   string
+	owner   string
+	etag    string
+	replace bool
+	options UploadOptions
+	session string
+	buffer  bytes.Buffer
+	offset  int64
+	err     error
+}
+
+type s3Downloader struct {
+	ctx    context.Context
+	client *s3Client
+	id     string
+	offset int64
+	body   io.ReadCloser
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+type listObjectsResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type listPartsResult struct {
+	Parts                []s3Part `xml:"Part"`
+	IsTruncated          bool     `xml:"IsTruncated"`
+	NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
+}
+
+// s3://bucket/prefix takes the other settings from the query, e.g.
+// ?endpoint=http://localhost:9000&path_style=true for MinIO.
+func init() {
+	Register("s3", func(backend *url.URL) (Client, error) {
+		query := backend.Query()
+		config := S3Config{
+			Endpoint: query.Get("endpoint"),
+			Bucket:   backend.Host,
+			Prefix:   strings.TrimPrefix(backend.Path, "/"),
+			Region:   query.Get("region"),
+		}
+
+		var err error
+		if value := query.Get("path_style"); value != "" {
+			if config.PathStyle, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("invalid path_style \"%s\"", value)
+			}
+		}
+
+		if value := query.Get("expiry_days"); value != "" {
+			if config.ExpiryDays, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("invalid expiry_days \"%s\"", value)
+			}
+		}
+
+		return NewS3Client(config)
+	})
+}
+
+// NewS3Client takes credentials and region not configured from the usual
+// AWS environment variables. Without an endpoint, it uses AWS's for the
+// region.
+func NewS3Client(config S3Config) (ResumableClient, error) {
+	if config.AccessKey == "" && config.SecretKey == "" {
+		config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		config.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	if config.Region == "" {
+		config.Region = os.Getenv("AWS_REGION")
+	}
+
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	if config.Bucket == "" {
+		return nil, errors.New("S3 storage needs a bucket")
+	}
+
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+
+	if _, err := url.Parse(config.Endpoint); err != nil {
+		return nil, err
+	}
+
+	return &s3Client{config: config, http: http.DefaultClient}, nil
+}
+
+func (client *s3Client) objectURL(id string, query url.Values) *url.URL {
+	return client.keyURL(client.config.Prefix+id, query)
+}
+
+// keyURL addresses the object with the given key, or with an empty one, the
+// bucket.
+func (client *s3Client) keyURL(key string, query url.Values) *url.URL {
+	endpoint, _ := url.Parse(client.config.Endpoint)
+	if client.config.PathStyle {
+		endpoint.Path = "/" + client.config.Bucket + "/" + key
+	} else {
+		endpoint.Host = client.config.Bucket + "." + endpoint.Host
+		endpoint.Path = "/" + key
+	}
+
+	endpoint.RawPath = escape(endpoint.Path, true)
+	endpoint.RawQuery = canonicalQuery(query)
+	return endpoint
+}
+
+// do sends a signed request for the object with the given ID and checks
+// that it succeeded with one of the expected statuses.
+func (client *s3Client) do(ctx context.Context, method, id string, query url.Values, headers map[string]string, body []byte, expected ...int) (*http.Response, error) {
+	return client.send(ctx, method, client.objectURL(id, query), headers, body, expected...)
+}
+
+func (client *s3Client) send(ctx context.Context, method string, target *url.URL, headers map[string]string, body []byte, expected ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	payloadHash := emptyPayloadHash
+	if hash, ok := headers["X-Amz-Content-Sha256"]; ok {
+		payloadHash = hash
+	} else if len(body) > 0 {
+		digest := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(digest[:])
+	}
+
+	client.sign(req, payloadHash, time.Now())
+	res, err := client.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(expected) == 0 {
+		expected = []int{http.StatusOK}
+	}
+
+	for _, status := range expected {
+		if res.StatusCode == status {
+			return res, nil
+		}
+	}
+
+	defer res.Body.Close()
+	return nil, readS3Error(res)
+}
+
+func readS3Error(res *http.Response) error {
+	content, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	var response s3Error
+	xml.Unmarshal(content, &response)
+
+	var err error
+	if res.StatusCode == http.StatusNotFound && response.Code != "NoSuchUpload" {
+		err = fmt.Errorf("S3 request failed: %s: %w", res.Status, os.ErrNotExist)
+	} else if response.Code != "" {
+		err = fmt.Errorf("S3 request failed: %s: %s", response.Code, response.Message)
+	} else {
+		err = fmt.Errorf("S3 request failed: %s", res.Status)
+	}
+
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || response.Code == "SlowDown" || response.Code == "RequestTimeout" {
+		return &transientError{err}
+	}
+
+	return err
+}
+
+// readXML reads a successful response, which S3 may still use to report
+// an error, e.g. when completing a multipart upload.
+func readXML(res *http.Response, result interface{}) error {
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var response s3Error
+	if xml.Unmarshal(content, &response) == nil && response.Code != "" {
+		return &transientError{fmt.Errorf("S3 request failed: %s: %s", response.Code, response.Message)}
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return xml.Unmarshal(content, result)
+}
+
+// conditions returns the headers that keep a write from overwriting another
+// stash, or, when replacing, anything but the version read.
+func (uploader *s3Uploader) conditions() map[string]string {
+	headers := make(map[string]string)
+	if uploader.replace {
+		headers["If-Match"] = uploader.etag
+	} else {
+		headers["If-None-Match"] = "*"
+	}
+
+	return headers
+}
+
+// uploadHeaders adds the metadata and tags of a new object, owned by the
+// token with the given hash, to headers.
+func (client *s3Client) uploadHeaders(headers map[string]string, options UploadOptions, ownerHash string) map[string]string {
+	headers[ownerMetadata] = ownerHash
+	days := client.config.ExpiryDays
+	if !options.Expires.IsZero() {
+		headers[expiresMetadata] = options.Expires.UTC().Format(time.RFC3339)
+
+		remaining := int(math.Ceil(time.Until(options.Expires).Hours() / 24))
+		if remaining < 1 {
+			remaining = 1
+		}
+
+		if days == 0 || remaining < days {
+			days = remaining
+		}
+	}
+
+	if days > 0 {
+		headers["X-Amz-Tagging"] = ExpiryTag + "=" + strconv.Itoa(days)
+	}
+
+	return headers
+}
+
+// readExpires returns the options of the object answered with res.
+func readExpires(res *http.Response) UploadOptions {
+	var options UploadOptions
+	if value := res.Header.Get(expiresMetadata); value != "" {
+		options.Expires, _ = time.Parse(time.RFC3339, value)
+	}
+
+	return options
+}
+
+func (client *s3Client) Upload(ctx context.Context, options UploadOptions) Uploader {
+	if options.MaxDownloads > 0 {
+		return &s3Uploader{err: errDownloadLimit}
+	}
+
+	id, err := newID()
+	if err != nil {
+		return &s3Uploader{err: err}
+	}
+
+	token, err := owner.NewToken()
+	return &s3Uploader{ctx: ctx, client: client, id: id, token: token, owner: owner.Hash(token), options: options, err: err}
+}
+
+func (client *s3Client) Replace(ctx context.Context, id string, token string) Uploader {
+	res, err := client.headOwned(ctx, id, token)
+	if err != nil {
+		return &s3Uploader{err: err}
+	}
+
+	return &s3Uploader{
+		ctx:     ctx,
+		client:  client,
+		id:      id,
+		token:   token,
+		owner:   res.Header.Get(ownerMetadata),
+		etag:    res.Header.Get("ETag"),
+		replace: true,
+		options: readExpires(res),
+	}
+}
+
+// headOwned returns the headers of the object with the given ID if token
+// owns it.
+func (client *s3Client) headOwned(ctx context.Context, id string, token string) (*http.Response, error) {
+	res, err := client.do(ctx, "HEAD", id, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Body.Close()
+	if err := owner.Check(res.Header.Get(ownerMetadata), token); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (uploader *s3Uploader) GetID() string {
+	return uploader.id
+}
+
+func (uploader *s3Uploader) GetToken() string {
+	return uploader.token
+}
+
+func (uploader *s3Uploader) Write(buf []byte) (int, error) {
+	if uploader.err != nil {
+		return 0, uploader.err
+	}
+
+	count := 0
+	for len(buf) > 0 {
+		space := ChunkSize - uploader.buffer.Len()
+		if space > len(buf) {
+			space = len(buf)
+		}
+
+		uploader.buffer.Write(buf[:space])
+		buf = buf[space:]
+		count += space
+
+		if uploader.buffer.Len() == ChunkSize {
+			if uploader.err = uploader.flush(); uploader.err != nil {
+				return count, uploader.err
+			}
+		}
+	}
+
+	return count, nil
+}
+
+func (uploader *s3Uploader) flush() error {
+	if uploader.session == "" {
+		uploadID, err := uploader.client.createMultipartUpload(uploader.ctx, uploader.id, uploader.options, uploader.owner)
+		if err != nil {
+			return err
+		}
+
+		uploader.session = newSession(uploader.id, uploadID)
+	}
+
+	chunk := uploader.buffer.Bytes()
+	checksum := sha256.Sum256(chunk)
+	err := retry(uploader.ctx, func() error {
+		return uploader.client.UploadChunk(uploader.ctx, uploader.session, uploader.offset, chunk, checksum[:])
+	})
+
+	if err != nil {
+		uploader.abort()
+		return err
+	}
+
+	uploader.offset += int64(len(chunk))
+	uploader.buffer.Reset()
+	return nil
+}
+
+// abort discards the parts uploaded, even once the upload's context is done.
+func (uploader *s3Uploader) abort() {
+	if uploader.session == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(uploader.ctx), abortTimeout)
+	defer cancel()
+	uploader.client.AbortSession(ctx, uploader.session)
+	uploader.session = ""
+}
+
+func (uploader *s3Uploader) Close() error {
+	if uploader.err != nil {
+		return uploader.err
+	}
+
+	if err := uploader.ctx.Err(); err != nil {
+		uploader.abort()
+		return err
+	}
+
+	if uploader.session == "" {
+		headers := uploader.client.uploadHeaders(uploader.conditions(), uploader.options, uploader.owner)
+		res, err := uploader.client.do(uploader.ctx, "PUT", uploader.id, nil, headers, uploader.buffer.Bytes())
+		if err != nil {
+			return err
+		}
+
+		res.Body.Close()
+		return nil
+	}
+
+	if uploader.buffer.Len() > 0 {
+		if err := uploader.flush(); err != nil {
+			return err
+		}
+	}
+
+	err := uploader.client.completeMultipartUpload(uploader.ctx, uploader.session, uploader.offset, uploader.conditions())
+	if err != nil && uploader.ctx.Err() != nil {
+		uploader.abort()
+		return uploader.ctx.Err()
+	}
+
+	return err
+}
+
+func (client *s3Client) Download(ctx context.Context, id string) io.ReadCloser {
+	return &s3Downloader{ctx: ctx, client: client, id: id}
+}
+
+func (client *s3Client) DownloadFrom(ctx context.Context, id string, offset int64) io.ReadCloser {
+	return &s3Downloader{ctx: ctx, client: client, id: id, offset: offset}
+}
+
+func (downloader *s3Downloader) Read(buf []byte) (int, error) {
+	if downloader.body == nil {
+		var headers map[string]string
+		if downloader.offset > 0 {
+			headers = map[string]string{"Range": fmt.Sprintf("bytes=%d-", downloader.offset)}
+		}
+
+		res, err := downloader.client.do(downloader.ctx, "GET", downloader.id, nil, headers, nil, http.StatusOK, http.StatusPartialContent)
+		if err != nil {
+			return 0, err
+		}
+
+		if IsExpired(readExpires(res).Expires) {
+			res.Body.Close()
+			return 0, ErrExpired
+		}
+
+		downloader.body = res.Body
+	}
+
+	return downloader.body.Read(buf)
+}
+
+func (downloader *s3Downloader) Close() error {
+	if downloader.body == nil {
+		return nil
+	}
+
+	return downloader.body.Close()
+}
+
+// createMultipartUpload starts an upload; its conditions are checked when
+// it is completed.
+func (client *s3Client) createMultipartUpload(ctx context.Context, id string, options UploadOptions, ownerHash string) (string, error) {
+	headers := client.uploadHeaders(make(map[string]string), options, ownerHash)
+	res, err := client.do(ctx, "POST", id, url.Values{"uploads": {""}}, headers, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+
+	if err := readXML(res, &result); err != nil {
+		return "", err
+	}
+
+	return result.UploadID, nil
+}
+
+func (client *s3Client) listParts(ctx context.Context, id, uploadID string) ([]s3Part, error) {
+	var parts []s3Part
+	marker := 0
+	for {
+		query := url.Values{"uploadId": {uploadID}, "part-number-marker": {strconv.Itoa(marker)}}
+		res, err := client.do(ctx, "GET", id, query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listPartsResult
+		if err := readXML(res, &result); err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, result.Parts...)
+		if !result.IsTruncated {
+			return parts, nil
+		}
+
+		marker = result.NextPartNumberMarker
+	}
+}
+
+func (client *s3Client) completeMultipartUpload(ctx context.Context, session string, size int64, headers map[string]string) error {
+	id, uploadID, err := parseSession(session)
+	if err != nil {
+		return err
+	}
+
+	parts, err := client.listParts(ctx, id, uploadID)
+	if err != nil {
+		return err
+	}
+
+	var request struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}
+
+	var stored int64
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			return fmt.Errorf("upload session is missing part %d", i+1)
+		}
+
+		stored += part.Size
+		request.Parts = append(request.Parts, s3Part{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+
+	if stored != size {
+		return fmt.Errorf("upload session has %d bytes, expected %d", stored, size)
+	}
+
+	body, err := xml.Marshal(&request)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.do(ctx, "POST", id, url.Values{"uploadId": {uploadID}}, headers, body)
+	if err != nil {
+		return err
+	}
+
+	return readXML(res, nil)
+}
+
+// A session's upload is an S3 multipart upload ID. Each chunk is a
+// part, which S3 stores whole or not at all.
+
+func (client *s3Client) StartSession(ctx context.Context, options UploadOptions) (string, string, error) {
+	if options.MaxDownloads > 0 {
+		return "", "", errDownloadLimit
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", "", err
+	}
+
+	token, err := owner.NewToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	uploadID, err := client.createMultipartUpload(ctx, id, options, owner.Hash(token))
+	if err != nil {
+		return "", "", err
+	}
+
+	return newSession(id, uploadID), token, nil
+}
+
+func (client *s3Client) SessionOffset(ctx context.Context, session string) (int64, error) {
+	id, uploadID, err := parseSession(session)
+	if err != nil {
+		return 0, err
+	}
+
+	parts, err := client.listParts(ctx, id, uploadID)
+	if err != nil {
+		// A completed upload is gone, and its stash is there instead.
+		if res, headErr := client.do(ctx, "HEAD", id, nil, nil, nil); headErr == nil {
+			res.Body.Close()
+			return 0, errSessionFinished
+		}
+
+		return 0, err
+	}
+
+	var offset int64
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			break
+		}
+
+		offset += part.Size
+	}
+
+	return offset, nil
+}
+
+// UploadChunk uploads chunk as a part. S3 verifies its SHA-256 checksum as
+// the signed payload hash.
+func (client *s3Client) UploadChunk(ctx context.Context, session string, offset int64, chunk []byte, checksum []byte) error {
+	id, uploadID, err := parseSession(session)
+	if err != nil {
+		return err
+	}
+
+	if offset%ChunkSize != 0 {
+		return fmt.Errorf("chunk offset %d is not a multiple of %d", offset, ChunkSize)
+	}
+
+	query := url.Values{"uploadId": {uploadID}, "partNumber": {strconv.FormatInt(offset/ChunkSize+1, 10)}}
+	headers := map[string]string{"X-Amz-Content-Sha256": hex.EncodeToString(checksum)}
+	res, err := client.do(ctx, "PUT", id, query, headers, chunk)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+	return nil
+}
+
+func (client *s3Client) FinishSession(ctx context.Context, session string, size int64) (string, error) {
+	id, _, err := parseSession(session)
+	if err != nil {
+		return "", err
+	}
+
+	err = client.completeMultipartUpload(ctx, session, size, map[string]string{"If-None-Match": "*"})
+	if err != nil {
+		// The upload may have been completed by an earlier attempt.
+		if res, headErr := client.do(ctx, "HEAD", id, nil, nil, nil); headErr == nil {
+			res.Body.Close()
+			return id, nil
+		}
+
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (client *s3Client) AbortSession(ctx context.Context, session string) error {
+	id, uploadID, err := parseSession(session)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.do(ctx, "DELETE", id, url.Values{"uploadId": {uploadID}}, nil, nil, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+	return nil
+}
+
+func (client *s3Client) Delete(ctx context.Context, id string, token string) error {
+	// Deleting a missing object succeeds, so check it is there first.
+	if _, err := client.headOwned(ctx, id, token); err != nil {
+		return err
+	}
+
+	res, err := client.do(ctx, "DELETE", id, nil, nil, nil, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+	return nil
+}
+
+// SetExpires copies the object onto itself with new metadata and tags, as
+// S3 cannot change them in place. A single copy is limited to 5 GB.
+func (client *s3Client) SetExpires(ctx context.Context, id string, token string, expires time.Time) error {
+	res, err := client.headOwned(ctx, id, token)
+	if err != nil {
+		return err
+	}
+
+	source := client.objectURL(id, nil)
+	if client.config.PathStyle {
+		source.Path = strings.TrimPrefix(source.Path, "/")
+	} else {
+		source.Path = client.config.Bucket + source.Path
+	}
+
+	headers := map[string]string{
+		"X-Amz-Copy-Source":          escape(source.Path, true),
+		"X-Amz-Copy-Source-If-Match": res.Header.Get("ETag"),
+		"X-Amz-Metadata-Directive":   "REPLACE",
+		"X-Amz-Tagging-Directive":    "REPLACE",
+	}
+
+	options := UploadOptions{Expires: expires}
+	res, err = client.do(ctx, "PUT", id, nil, client.uploadHeaders(headers, options, res.Header.Get(ownerMetadata)), nil)
+	if err != nil {
+		return err
+	}
+
+	return readXML(res, nil)
+}
+
+func (client *s3Client) Stat(ctx context.Context, id string) (*StashInfo, error) {
+	res, err := client.do(ctx, "HEAD", id, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Body.Close()
+	created, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &StashInfo{ID: id, Size: res.ContentLength, Created: created, Expires: readExpires(res).Expires}, nil
+}
+
+// List returns the stashes under the prefix, but not in "directories" below
+// it.
+func (client *s3Client) List(ctx context.Context) ([]string, error) {
+	var ids []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {client.config.Prefix}, "delimiter": {"/"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := client.send(ctx, "GET", client.keyURL("", query), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listObjectsResult
+		if err := readXML(res, &result); err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			ids = append(ids, strings.TrimPrefix(object.Key, client.config.Prefix))
+		}
+
+		if !result.IsTruncated {
+			return ids, nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
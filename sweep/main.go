@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/flowup/cloudfunc/api"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// The function is run on a schedule to purge expired stashes, which paste
+// already refuses.
+
+type SweepResponse struct {
+	Count int    `json:"count"`
+	Error string `json:"error,omitempty"`
+}
+
+func sweep() (int, error) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	bucket := client.Bucket("stash-215008")
+	objects := bucket.Objects(ctx, nil)
+	count := 0
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+
+		expires, err := time.Parse(time.RFC3339, attrs.Metadata["expires"])
+		if err != nil || time.Now().Before(expires) {
+			continue
+		}
+
+		// A stash replaced since it was listed is left for the next sweep.
+		obj := bucket.Object(attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+		err = obj.Delete(ctx)
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusPreconditionFailed || err == storage.ErrObjectNotExist {
+			continue
+		} else if err != nil {
+			return count, err
+		}
+
+		count++
+	}
+}
+
+func main() {
+	function := api.NewCloudFunc()
+	count, err := sweep()
+	if err == nil {
+		function.SendResponse(&SweepResponse{Count: count})
+	} else {
+		function.SendResponse(&SweepResponse{Count: count, Error: err.Error()})
+	}
+}